@@ -0,0 +1,115 @@
+// Package acl provides access control lists, which grant permissions on databases and
+// collections to users and to groups of users.
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Permission is a level of access. Each level includes the levels below it.
+type Permission int
+
+const (
+	None  Permission = iota // no access
+	Read                    // get documents and collections and subscribe to them
+	Write                   // create, replace, patch and delete documents and collections
+	Admin                   // change access control lists and indexes and delete the database
+)
+
+// names are the names of permissions as they appear in JSON.
+var names = []string{"none", "read", "write", "admin"}
+
+// ParsePermission converts a permission name (none, read, write or admin) into a Permission.
+func ParsePermission(name string) (Permission, error) {
+	for p, n := range names {
+		if n == name {
+			return Permission(p), nil
+		}
+	}
+	return None, fmt.Errorf("unknown permission %q: must be read, write or admin", name)
+}
+
+// String returns the name of p.
+func (p Permission) String() string {
+	if p < None || int(p) >= len(names) {
+		return fmt.Sprintf("Permission(%d)", int(p))
+	}
+	return names[p]
+}
+
+// MarshalJSON encodes p as its name.
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON decodes p from its name.
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	*p, err = ParsePermission(name)
+	return err
+}
+
+// Rule is a restriction on the documents of a collection, in addition to the permissions.
+type Rule string
+
+// OwnerWrite restricts replacing, patching and deleting a document to the user who created it
+// and users with admin access.
+const OwnerWrite Rule = "owner-write"
+
+// UnmarshalJSON decodes r, which must be a known rule.
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	if Rule(name) != OwnerWrite {
+		return fmt.Errorf("unknown rule %q: must be %s", name, OwnerWrite)
+	}
+	*r = Rule(name)
+	return nil
+}
+
+// ACL grants permissions to users and groups by name. Rules apply to the documents directly
+// in the collection of the ACL and are not inherited.
+type ACL struct {
+	Users  map[string]Permission `json:"users,omitempty"`
+	Groups map[string]Permission `json:"groups,omitempty"`
+	Rules  []Rule                `json:"rules,omitempty"`
+}
+
+// Principal is a user and the groups the user is a member of.
+type Principal struct {
+	User   string
+	Groups []string
+}
+
+// Restricts reports whether a grants permissions to anyone. An ACL that only has rules
+// leaves access as it would be without it.
+func (a *ACL) Restricts() bool {
+	return a != nil && (len(a.Users) > 0 || len(a.Groups) > 0)
+}
+
+// HasRule reports whether a has rule. A nil ACL has no rules.
+func (a *ACL) HasRule(rule Rule) bool {
+	return a != nil && slices.Contains(a.Rules, rule)
+}
+
+// Permission returns the highest permission a grants to who, directly or through a group.
+// A nil ACL grants nothing.
+func (a *ACL) Permission(who Principal) Permission {
+	if a == nil {
+		return None
+	}
+	granted := a.Users[who.User]
+	for _, group := range who.Groups {
+		granted = max(granted, a.Groups[group])
+	}
+	return granted
+}
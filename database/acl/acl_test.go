@@ -0,0 +1,59 @@
+// Test cases for acl.
+package acl
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Test that a principal gets the highest permission granted to it or its groups.
+func TestPermission(t *testing.T) {
+	a := &ACL{
+		Users:  map[string]Permission{"alice": Read},
+		Groups: map[string]Permission{"team": Write, "admins": Admin},
+	}
+	tests := []struct {
+		who  Principal
+		want Permission
+	}{
+		{Principal{User: "alice"}, Read},
+		{Principal{User: "alice", Groups: []string{"team"}}, Write},
+		{Principal{User: "bob", Groups: []string{"other", "admins"}}, Admin},
+		{Principal{User: "bob"}, None},
+	}
+	for _, test := range tests {
+		if got := a.Permission(test.who); got != test.want {
+			t.Errorf("Permission(%v) = %v, expected %v", test.who, got, test.want)
+		}
+	}
+	var empty *ACL
+	if empty.Permission(Principal{User: "alice"}) != None {
+		t.Errorf("expected a nil ACL to grant nothing")
+	}
+}
+
+// Test that ACLs round trip through JSON and that unknown permissions are rejected.
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(&ACL{Users: map[string]Permission{"alice": Admin}})
+	if err != nil || string(data) != `{"users":{"alice":"admin"}}` {
+		t.Errorf("unexpected encoding %s, error %v", data, err)
+	}
+	var a ACL
+	err = json.Unmarshal([]byte(`{"users": {"bob": "write"}, "groups": {"team": "read"}}`), &a)
+	if err != nil || a.Users["bob"] != Write || a.Groups["team"] != Read {
+		t.Errorf("unexpected decoding %v, error %v", a, err)
+	}
+	err = json.Unmarshal([]byte(`{"users": {"bob": "owner"}}`), &a)
+	if err == nil {
+		t.Errorf("expected an error for an unknown permission")
+	}
+	var rules ACL
+	err = json.Unmarshal([]byte(`{"rules": ["owner-write"]}`), &rules)
+	if err != nil || !rules.HasRule(OwnerWrite) || rules.Restricts() {
+		t.Errorf("unexpected rules %v, error %v", rules, err)
+	}
+	err = json.Unmarshal([]byte(`{"rules": ["owner-read"]}`), &rules)
+	if err == nil {
+		t.Errorf("expected an error for an unknown rule")
+	}
+}
@@ -12,19 +12,41 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // UserToken manages a skip list of tokens associated with users.
 type UserToken struct {
-	Records skiplist.SkipList[string, User]
+	Records   skiplist.SkipList[string, User]
+	lifetimes Lifetimes
 }
 
-// User represents information about a user, including their start time
-// (which can be used to check token expiration) and their username.
+// User represents information about a user, including their start time,
+// when their token expires, their username and what kind of token it is.
+// Tokens with an idle timeout also expire when they have not been used for that long.
 type User struct {
 	StartTime time.Time
-	UserName  string
+	ExpiresAt time.Time
+	// LastUsed is when the token was last used in Unix nanoseconds. It is shared by the copies
+	// of User returned by the skip list, so that using a token does not replace its record.
+	LastUsed *atomic.Int64
+	Idle     time.Duration // zero if the token does not expire when unused
+	UserName string
+	Service  bool
+	Refresh  bool // refresh tokens can only be exchanged for new tokens
+}
+
+// expiry returns when the token of user expires if it is not used again.
+func (user User) expiry() time.Time {
+	if user.Idle <= 0 || user.LastUsed == nil {
+		return user.ExpiresAt
+	}
+	idleAt := time.Unix(0, user.LastUsed.Load()).Add(user.Idle)
+	if idleAt.Before(user.ExpiresAt) {
+		return idleAt
+	}
+	return user.ExpiresAt
 }
 
 // UserString is a structure to unmarshal or marshal user details from/to JSON.
@@ -32,38 +54,91 @@ type UserString struct {
 	Username string
 }
 
+// errInvalidRefresh is returned for refresh tokens that are invalid, expired or already used.
+var errInvalidRefresh = errors.New("invalid or expired refresh token")
+
 // Token is a structure to hold a token in string format.
 // Used for JSON marshaling and unmarshaling.
 type Token struct {
 	Token string `json:"token"`
 }
 
-// New initializes a new UserToken instance.
+// New initializes a new UserToken instance with the DefaultLifetimes.
 // Returns a new instance of the UserToken type.
 func New() UserToken {
+	return NewWithLifetimes(DefaultLifetimes)
+}
+
+// NewWithLifetimes initializes a new UserToken instance whose tokens have lifetimes.
+// Zero absolute and refresh lifetimes are replaced by their defaults, and a zero idle timeout
+// means tokens do not expire when unused.
+func NewWithLifetimes(lifetimes Lifetimes) UserToken {
 	var list skiplist.SkipList[string, User]
 	list.MakeSkipList()
 	new := UserToken{
-		Records: list,
+		Records:   list,
+		lifetimes: lifetimes.withDefaults(),
 	}
 	return new
 }
 
-// MapToken associates a token with the given user.
+// MapToken associates a session token with the given user.
 // Returns the generated token and any potential errors.
 func (u *UserToken) MapToken(user string) (string, error) {
 	if user == "" {
 		return "", errors.New("No username in request body")
 	}
 
+	now := time.Now()
+	lastUsed := new(atomic.Int64)
+	lastUsed.Store(now.UnixNano())
+	return u.issue(User{StartTime: now, ExpiresAt: now.Add(u.lifetimes.Absolute), LastUsed: lastUsed, Idle: u.lifetimes.Idle, UserName: user})
+}
+
+// Login issues a session token and a refresh token for the given user.
+func (u *UserToken) Login(user string) (Grant, error) {
+	var grant Grant
+	token, err := u.MapToken(user)
+	if err != nil {
+		return grant, err
+	}
+	now := time.Now()
+	refresh := User{StartTime: now, ExpiresAt: now.Add(u.lifetimes.Refresh), UserName: user, Refresh: true}
+	refreshToken, err := u.issue(refresh)
+	if err != nil {
+		return grant, err
+	}
+	info, _ := u.Records.Find(token)
+	return Grant{Token: token, ExpiresAt: info.GetVal().expiry(), RefreshToken: refreshToken, RefreshExpiresAt: refresh.ExpiresAt}, nil
+}
+
+// Refresh exchanges refreshToken for a new session token and refresh token.
+// The refresh token can only be used once.
+func (u *UserToken) Refresh(refreshToken string) (Grant, error) {
+	if refreshToken == "" {
+		return Grant{}, errInvalidRefresh
+	}
+	info, exists := u.Records.Find(refreshToken)
+	if !exists || !info.GetVal().Refresh {
+		return Grant{}, errInvalidRefresh
+	}
+	user := info.GetVal()
+	// Only one of several concurrent refreshes succeeds
+	_, deleted := u.Records.Delete(refreshToken)
+	if !deleted || time.Now().After(user.ExpiresAt) {
+		return Grant{}, errInvalidRefresh
+	}
+	return u.Login(user.UserName)
+}
+
+// issue generates a token for the user described by userInfo and adds it to the skip list.
+// Returns the generated token and any potential errors.
+func (u *UserToken) issue(userInfo User) (string, error) {
 	// generate token for the user
 	token, err := generateToken()
 	if err != nil {
 		return "", err
 	}
-	var userInfo User
-	userInfo.StartTime = time.Now()
-	userInfo.UserName = user
 
 	check := func(key string, currVal User, exists bool) (newValue User, err error) {
 		if !exists {
@@ -81,6 +156,11 @@ func (u *UserToken) MapToken(user string) (string, error) {
 	return token, nil
 }
 
+// Close does nothing, since the tokens are only kept in memory.
+func (u *UserToken) Close() error {
+	return nil
+}
+
 // generateToken produces a new random token for user authentication.
 // Returns a generated token and an error.
 func generateToken() (string, error) {
@@ -103,6 +183,10 @@ func generateToken() (string, error) {
 // DeleteToken removes the given token from the skip list.
 // Returns an HTTP status code based on the outcome.
 func (u *UserToken) DeleteToken(token string) int {
+	// The empty key is the head of the skip list
+	if token == "" {
+		return http.StatusUnauthorized
+	}
 	_, exists := u.Records.Find(token)
 	if !exists {
 		return http.StatusUnauthorized
@@ -115,8 +199,11 @@ func (u *UserToken) DeleteToken(token string) int {
 // CheckToken verifies the validity of the provided token.
 // Returns the username associated with the token if valid, otherwise returns an empty string.
 func (u *UserToken) CheckToken(token string) string {
+	if token == "" {
+		return ""
+	}
 	user, exists := u.Records.Find(token)
-	if !exists {
+	if !exists || user.GetVal().Refresh {
 		return ""
 	}
 
@@ -124,45 +211,87 @@ func (u *UserToken) CheckToken(token string) string {
 		// Token expired.
 		return ""
 	}
-	// Success.
+	// Success, which renews a token with an idle timeout.
+	user.GetVal().touch()
 	return user.GetVal().UserName
 }
 
-// checkExpiration checks if the token has expired based on its start time.
-// Tokens are valid for 1 hour after their start time.
+// CheckStream returns the username associated with token if it has been neither revoked nor
+// outlived its absolute lifetime, and renews it, since the open stream that holds it uses it.
+func (u *UserToken) CheckStream(token string) string {
+	if token == "" {
+		return ""
+	}
+	user, exists := u.Records.Find(token)
+	if !exists || user.GetVal().Refresh || time.Now().After(user.GetVal().ExpiresAt) {
+		return ""
+	}
+	user.GetVal().touch()
+	return user.GetVal().UserName
+}
+
+// Prune removes every expired token, including tokens that were never presented again.
+// Returns the number of tokens removed.
+func (u *UserToken) Prune() int {
+	now := time.Now()
+	expired := make([]string, 0)
+	u.Records.Range(func(token string, user User) bool {
+		if now.After(user.expiry()) {
+			expired = append(expired, token)
+		}
+		return true
+	})
+	// An expired token is never renewed, so it cannot have become valid again
+	pruned := 0
+	for _, token := range expired {
+		if _, ok := u.Records.Delete(token); ok {
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// touch records that the token of user was used now.
+func (user User) touch() {
+	if user.LastUsed != nil {
+		user.LastUsed.Store(time.Now().UnixNano())
+	}
+}
+
+// checkExpiration checks if the token has expired.
 // Returns true if the token has expired, false otherwise.
 func (u *UserToken) checkExpiration(token string) bool {
 	curTime := time.Now()
 	user, _ := u.Records.Find(token)
-	if curTime.Sub(user.GetVal().StartTime) > time.Hour {
+	if curTime.After(user.GetVal().expiry()) {
 		u.Records.Delete(token)
 		return true
 	}
 	return false
 }
 
-// UnexpiredToken reads a given token file and sets its start time
-// to ensure it does not expire for 24 hours.
+// UnexpiredToken reads a given token file and adds its tokens so that they expire
+// after the absolute lifetime, however long they are unused.
 // Returns an error if there's an issue reading the token file or unmarshalling its content.
 // Used for -t command.
 func (u *UserToken) UnexpiredToken(token string) error {
 	tok, err := os.ReadFile(token)
 	if err != nil {
-		slog.Error("Failed to read token file, ", err)
+		slog.Error("Failed to read token file", "error", err)
 		return err
 	}
 
 	var tokenFile map[string]string
 	err = json.Unmarshal(tok, &tokenFile)
 	if err != nil {
-		slog.Error("Failed to unmarshal token file, ", err)
+		slog.Error("Failed to unmarshal token file", "error", err)
 		return err
 	}
 
 	for user, token := range tokenFile {
 		var userInf User
-		// set time to 23 hour in the future so that it expires in 24 hours
-		userInf.StartTime = time.Now().Add(23 * time.Hour)
+		userInf.StartTime = time.Now()
+		userInf.ExpiresAt = userInf.StartTime.Add(u.lifetimes.Absolute)
 		userInf.UserName = user
 		check := func(key string, currVal User, exists bool) (newValue User, err error) {
 			if !exists {
@@ -4,8 +4,12 @@ package authentication
 import (
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Test the ability to map a token to a user.
@@ -241,3 +245,283 @@ func TestConcurrentCheckToken(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// Test that a password hash verifies only its own password and is salted.
+func TestHashPassword(t *testing.T) {
+	PasswordCost = bcrypt.MinCost
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hash.Verify("correct horse") || hash.Verify("wrong horse") {
+		t.Errorf("hash verified the wrong passwords")
+	}
+	other, _ := HashPassword("correct horse")
+	if string(other.Hash) == string(hash.Hash) {
+		t.Errorf("expected hashes of the same password to differ by salt")
+	}
+	_, err = HashPassword("short")
+	if err == nil {
+		t.Errorf("expected an error for a short password")
+	}
+	_, err = HashPassword(strings.Repeat("long", 19))
+	if err == nil {
+		t.Errorf("expected an error for a password bcrypt would truncate")
+	}
+	if (PasswordHash{}).Verify("correct horse") {
+		t.Errorf("expected the zero hash to verify no password")
+	}
+}
+
+// Test that sessions are listed with masked tokens and revoked by user.
+func TestSessions(t *testing.T) {
+	ut := New()
+	token, _ := ut.MapToken("user1")
+	ut.MapToken("user1")
+	service, expires, err := ut.MapServiceToken("service", 0)
+	if err != nil || ut.CheckToken(service) != "service" || time.Until(expires) < ServiceTokenLifetime-time.Minute {
+		t.Errorf("unexpected service token %v expiring %v, error %v", service, expires, err)
+	}
+
+	sessions := ut.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %v", sessions)
+	}
+	for _, session := range sessions {
+		if session.Token == token || len(session.Token) > 7 {
+			t.Errorf("expected a masked token, got %v", session.Token)
+		}
+		if session.Service != (session.User == "service") {
+			t.Errorf("unexpected session %v", session)
+		}
+	}
+
+	if revoked := ut.RevokeUser("user1"); revoked != 2 {
+		t.Errorf("expected 2 revoked tokens, got %d", revoked)
+	}
+	if ut.CheckToken(token) != "" || ut.CheckToken(service) != "service" {
+		t.Errorf("expected only the tokens of user1 to be revoked")
+	}
+}
+
+// Test that empty tokens are rejected rather than matching the head of the skip list.
+func TestEmptyToken(t *testing.T) {
+	ut := New()
+	ut.MapToken("user1")
+	if user := ut.CheckToken(""); user != "" {
+		t.Errorf("expected no user for an empty token, got %v", user)
+	}
+	if status := ut.DeleteToken(""); status != 401 {
+		t.Errorf("expected 401 when deleting an empty token, got %d", status)
+	}
+}
+
+// Test that signed tokens are verified, can be revoked, and that revocations survive a restart.
+func TestSigned(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	revocations := t.TempDir() + "/revoked.jsonl"
+	s, err := NewSigned(key, revocations, DefaultLifetimes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, _ := s.MapToken("user1")
+	if user := s.CheckToken(token); user != "user1" {
+		t.Errorf("expected user1, got %v", user)
+	}
+	other, _ := NewSigned([]byte("fedcba9876543210fedcba9876543210"), "", DefaultLifetimes)
+	if user := other.CheckToken(token); user != "" {
+		t.Errorf("expected a token signed with another key to be rejected, got %v", user)
+	}
+	if user := s.CheckToken(token[:len(token)-2] + "xx"); user != "" {
+		t.Errorf("expected a tampered token to be rejected, got %v", user)
+	}
+	expired, _ := s.sign("user1", time.Now().Add(-time.Second), false, false)
+	if user := s.CheckToken(expired); user != "" {
+		t.Errorf("expected an expired token to be rejected, got %v", user)
+	}
+
+	second, _ := s.MapToken("user1")
+	if status := s.DeleteToken(token); status != 204 || s.CheckToken(token) != "" || s.CheckToken(second) != "user1" {
+		t.Errorf("expected only the deleted token to be revoked, got status %d", status)
+	}
+	service, _, _ := s.MapServiceToken("user2", 0)
+	s.RevokeUser("user2")
+	if user := s.CheckToken(service); user != "" {
+		t.Errorf("expected the tokens of a revoked user to be rejected, got %v", user)
+	}
+	time.Sleep(2 * time.Millisecond)
+	later, _ := s.MapToken("user2")
+	if user := s.CheckToken(later); user != "user2" {
+		t.Errorf("expected tokens issued after revocation to be accepted, got %v", user)
+	}
+	s.Close()
+
+	s, err = NewSigned(key, revocations, DefaultLifetimes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	if s.CheckToken(token) != "" || s.CheckToken(service) != "" {
+		t.Errorf("expected revocations to survive a restart")
+	}
+	if s.CheckToken(second) != "user1" || s.CheckToken(later) != "user2" {
+		t.Errorf("expected unrevoked tokens to survive a restart")
+	}
+}
+
+// Test that session tokens expire when idle, are renewed by use, and never outlive their absolute lifetime.
+func TestLifetimes(t *testing.T) {
+	ut := NewWithLifetimes(Lifetimes{Absolute: 200 * time.Millisecond, Idle: 80 * time.Millisecond})
+	idle, _ := ut.MapToken("user1")
+	used, _ := ut.MapToken("user1")
+	for i := 0; i < 3; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if user := ut.CheckToken(used); user != "user1" {
+			t.Fatalf("expected a used token to be renewed, got %v", user)
+		}
+	}
+	if user := ut.CheckToken(idle); user != "" {
+		t.Errorf("expected an idle token to expire, got %v", user)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(40 * time.Millisecond)
+		ut.CheckToken(used)
+	}
+	if user := ut.CheckToken(used); user != "" {
+		t.Errorf("expected a token to expire after its absolute lifetime, got %v", user)
+	}
+}
+
+// Test that a zero idle timeout disables it, so that unused tokens expire at their absolute lifetime.
+func TestNoIdleTimeout(t *testing.T) {
+	ut := NewWithLifetimes(Lifetimes{Absolute: 150 * time.Millisecond, Idle: 0})
+	token, _ := ut.MapToken("user1")
+	time.Sleep(100 * time.Millisecond)
+	if user := ut.CheckToken(token); user != "user1" {
+		t.Errorf("expected an unused token without idle timeout to stay valid, got %v", user)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if user := ut.CheckToken(token); user != "" {
+		t.Errorf("expected a token to expire after its absolute lifetime, got %v", user)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signed, err := NewSigned(key, "", Lifetimes{Absolute: time.Hour, Idle: 0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer signed.Close()
+	grant, err := signed.Login("user1")
+	if err != nil || grant.ExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expected a signed token to expire after its absolute lifetime, got %v, error %v", grant.ExpiresAt, err)
+	}
+}
+
+// Test that refresh tokens can only be used once and are not accepted as session tokens.
+func TestRefresh(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signed, err := NewSigned(key, "", DefaultLifetimes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer signed.Close()
+	store := New()
+	for _, backend := range []Backend{&store, signed} {
+		grant, err := backend.Login("user1")
+		if err != nil || grant.Token == "" || grant.RefreshToken == "" || !grant.ExpiresAt.After(time.Now()) {
+			t.Fatalf("unexpected grant %v, error %v", grant, err)
+		}
+		if user := backend.CheckToken(grant.RefreshToken); user != "" {
+			t.Errorf("expected a refresh token to be rejected as a session token, got %v", user)
+		}
+		renewed, err := backend.Refresh(grant.RefreshToken)
+		if err != nil || backend.CheckToken(renewed.Token) != "user1" {
+			t.Fatalf("expected refresh to issue a session token, got error %v", err)
+		}
+		if _, err := backend.Refresh(grant.RefreshToken); err == nil {
+			t.Errorf("expected a refresh token to be usable only once")
+		}
+		if _, err := backend.Refresh(renewed.Token); err == nil {
+			t.Errorf("expected a session token to be rejected as a refresh token")
+		}
+		if status := backend.DeleteToken(renewed.RefreshToken); status != 204 {
+			t.Errorf("expected a refresh token to be revocable, got %d", status)
+		}
+		if _, err := backend.Refresh(renewed.RefreshToken); err == nil {
+			t.Errorf("expected a revoked refresh token to be rejected")
+		}
+	}
+}
+
+// Test that the tokens of open streams are only rejected once revoked or past their absolute lifetime.
+func TestCheckStream(t *testing.T) {
+	ut := NewWithLifetimes(Lifetimes{Absolute: 150 * time.Millisecond, Idle: 50 * time.Millisecond})
+	token, _ := ut.MapToken("user1")
+	time.Sleep(80 * time.Millisecond)
+	if user := ut.CheckStream(token); user != "user1" {
+		t.Errorf("expected an idle token to stay valid for a stream, got %v", user)
+	}
+	if user := ut.CheckToken(token); user != "user1" {
+		t.Errorf("expected a stream to renew its token, got %v", user)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if user := ut.CheckStream(token); user != "" {
+		t.Errorf("expected a token past its absolute lifetime to be rejected, got %v", user)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s, err := NewSigned(key, "", DefaultLifetimes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	expired, _ := s.sign("user1", time.Now().Add(-time.Second), false, false)
+	if s.CheckToken(expired) != "" || s.CheckStream(expired) != "user1" {
+		t.Errorf("expected an expired signed token to stay valid for a stream only")
+	}
+	s.RevokeUser("user1")
+	if user := s.CheckStream(expired); user != "" {
+		t.Errorf("expected a revoked signed token to be rejected, got %v", user)
+	}
+}
+
+// Test that expired tokens and revocations are pruned.
+func TestPrune(t *testing.T) {
+	ut := NewWithLifetimes(Lifetimes{Idle: 50 * time.Millisecond})
+	idle, _ := ut.MapToken("user1")
+	service, _, _ := ut.MapServiceToken("user2", 0)
+	time.Sleep(60 * time.Millisecond)
+	if pruned := ut.Prune(); pruned != 1 {
+		t.Errorf("expected the idle token to be pruned, pruned %d", pruned)
+	}
+	if _, exists := ut.Records.Find(idle); exists || ut.CheckToken(service) != "user2" {
+		t.Errorf("expected only the expired token to be removed")
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	revocations := t.TempDir() + "/revoked.jsonl"
+	lifetimes := Lifetimes{Absolute: time.Second}
+	s, err := NewSigned(key, revocations, lifetimes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	short, _ := s.MapToken("user1")
+	long, _, _ := s.MapServiceToken("user1", time.Hour)
+	s.DeleteToken(short)
+	s.DeleteToken(long)
+	s.RevokeUser("user2")
+	time.Sleep(1100 * time.Millisecond)
+	if pruned := s.Prune(); pruned != 1 {
+		t.Errorf("expected the expired revocation to be pruned, pruned %d", pruned)
+	}
+	s.Close()
+	data, _ := os.ReadFile(revocations)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected the revocation list to be compacted to 2 lines, got %q", data)
+	}
+	s, _ = NewSigned(key, revocations, lifetimes)
+	defer s.Close()
+	if s.CheckToken(long) != "" {
+		t.Errorf("expected revocations to survive compaction")
+	}
+}
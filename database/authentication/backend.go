@@ -0,0 +1,35 @@
+package authentication
+
+import "time"
+
+// Backend issues and checks the bearer tokens of users.
+// UserToken, which keeps tokens in memory, is the default, and Signed issues tokens
+// that can be checked without storing them.
+type Backend interface {
+	// MapToken issues a session token for user.
+	MapToken(user string) (string, error)
+	// Login issues a session token and a refresh token for user.
+	Login(user string) (Grant, error)
+	// Refresh exchanges a refresh token, which can only be used once, for a new Grant.
+	Refresh(refreshToken string) (Grant, error)
+	// MapServiceToken issues a long-lived token for user, valid for lifetime or
+	// ServiceTokenLifetime if lifetime is zero, and returns when it expires.
+	MapServiceToken(user string, lifetime time.Duration) (string, time.Time, error)
+	// CheckToken returns the user of token, or an empty string if it is invalid or expired.
+	CheckToken(token string) string
+	// CheckStream is like CheckToken for the token of a stream that is still open, which counts as
+	// using it: the idle timeout does not apply, only the absolute lifetime and revocation.
+	CheckStream(token string) string
+	// DeleteToken revokes token, returning 204, or 401 if it is invalid.
+	DeleteToken(token string) int
+	// RevokeUser revokes every token of user and returns the number of stored tokens removed.
+	RevokeUser(user string) int
+	// Sessions returns the stored unexpired tokens, masked.
+	Sessions() []Session
+	// UnexpiredToken adds the tokens of the token file at path, which expire after the absolute lifetime.
+	UnexpiredToken(path string) error
+	// Prune removes expired tokens and revocations and returns how many were removed.
+	Prune() int
+	// Close releases the resources of the backend.
+	Close() error
+}
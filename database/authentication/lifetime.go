@@ -0,0 +1,44 @@
+package authentication
+
+import "time"
+
+// Lifetimes determines how long tokens are valid.
+type Lifetimes struct {
+	Absolute time.Duration // how long a session token is valid at most
+	Idle     time.Duration // how long a session token is valid without being used, zero or negative for no idle timeout
+	Refresh  time.Duration // how long a refresh token is valid
+}
+
+// DefaultLifetimes are the lifetimes of tokens when none are configured.
+var DefaultLifetimes = Lifetimes{Absolute: 24 * time.Hour, Idle: time.Hour, Refresh: 30 * 24 * time.Hour}
+
+// withDefaults returns l with a zero absolute or refresh lifetime replaced by its default.
+// The idle timeout is kept, since zero disables it.
+func (l Lifetimes) withDefaults() Lifetimes {
+	if l.Absolute <= 0 {
+		l.Absolute = DefaultLifetimes.Absolute
+	}
+	if l.Refresh <= 0 {
+		l.Refresh = DefaultLifetimes.Refresh
+	}
+	return l
+}
+
+// session returns how long a session token that is not renewed by use is valid:
+// the idle timeout, if there is one and it is shorter than the absolute lifetime.
+func (l Lifetimes) session() time.Duration {
+	if l.Idle > 0 && l.Idle < l.Absolute {
+		return l.Idle
+	}
+	return l.Absolute
+}
+
+// Grant is a session token and the refresh token that renews it, issued at login and refresh.
+// ExpiresAt is when the session token expires if it is not used; using it renews it up to its
+// absolute lifetime.
+type Grant struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
@@ -0,0 +1,60 @@
+package authentication
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordCost is the bcrypt cost used for new password hashes.
+// Existing hashes keep the cost they were created with.
+var PasswordCost = 12
+
+// MinPasswordLength is the minimum number of bytes in a password.
+const MinPasswordLength = 8
+
+// MaxPasswordLength is the maximum number of bytes in a password, beyond which bcrypt ignores them.
+const MaxPasswordLength = 72
+
+// PasswordHash is a bcrypt hash of a password, which includes its salt and cost.
+type PasswordHash struct {
+	Algorithm string `json:"algorithm"`
+	Hash      []byte `json:"hash"`
+}
+
+// bcryptAlgorithm is the Algorithm of hashes created by HashPassword.
+const bcryptAlgorithm = "bcrypt"
+
+// dummyHash is compared against when verifying an empty hash, so that checking the password
+// of an unknown user takes as long as for a known one.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), PasswordCost)
+	return hash
+})
+
+// HashPassword returns a hash of password with a new random salt. Returns an error if the
+// password is shorter than MinPasswordLength or longer than MaxPasswordLength.
+func HashPassword(password string) (PasswordHash, error) {
+	if len(password) < MinPasswordLength {
+		return PasswordHash{}, errors.New("password must be at least 8 characters")
+	}
+	if len(password) > MaxPasswordLength {
+		return PasswordHash{}, errors.New("password must be at most 72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return PasswordHash{}, err
+	}
+	return PasswordHash{Algorithm: bcryptAlgorithm, Hash: hash}, nil
+}
+
+// Verify reports whether password is the password h was created from. The zero PasswordHash,
+// such as the hash of a user who does not exist, matches no password but takes as long to check.
+func (h PasswordHash) Verify(password string) bool {
+	if h.Algorithm != bcryptAlgorithm || len(h.Hash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(h.Hash, []byte(password)) == nil
+}
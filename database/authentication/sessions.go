@@ -0,0 +1,82 @@
+package authentication
+
+import (
+	"errors"
+	"time"
+)
+
+// ServiceTokenLifetime is how long service tokens are valid if no lifetime is given.
+const ServiceTokenLifetime = 365 * 24 * time.Hour
+
+// maskedLength is the number of characters of a token shown in a Session.
+const maskedLength = 4
+
+// Session describes an issued token without revealing it.
+type Session struct {
+	Token     string    `json:"token"` // the first characters of the token
+	User      string    `json:"user"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Service   bool      `json:"service"`
+	Refresh   bool      `json:"refresh"`
+}
+
+// MaskToken returns the first characters of token, which identify it to an administrator
+// but cannot be used to authenticate.
+func MaskToken(token string) string {
+	if len(token) <= maskedLength {
+		return "..."
+	}
+	return token[:maskedLength] + "..."
+}
+
+// Sessions returns the unexpired tokens with their users, ordered by token.
+func (u *UserToken) Sessions() []Session {
+	now := time.Now()
+	sessions := make([]Session, 0)
+	u.Records.Range(func(token string, user User) bool {
+		if now.After(user.expiry()) {
+			return true
+		}
+		sessions = append(sessions, Session{Token: MaskToken(token), User: user.UserName, ExpiresAt: user.expiry(), Service: user.Service, Refresh: user.Refresh})
+		return true
+	})
+	return sessions
+}
+
+// RevokeUser removes every token of user, including service and refresh tokens.
+// Returns the number of tokens removed.
+func (u *UserToken) RevokeUser(user string) int {
+	tokens := make([]string, 0)
+	u.Records.Range(func(token string, info User) bool {
+		if info.UserName == user {
+			tokens = append(tokens, token)
+		}
+		return true
+	})
+	revoked := 0
+	for _, token := range tokens {
+		if _, ok := u.Records.Delete(token); ok {
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// MapServiceToken associates a long-lived service token with the given user, valid for lifetime,
+// or for ServiceTokenLifetime if lifetime is zero.
+// Returns the generated token, when it expires and any potential errors.
+func (u *UserToken) MapServiceToken(user string, lifetime time.Duration) (string, time.Time, error) {
+	if user == "" {
+		return "", time.Time{}, errors.New("No username in request body")
+	}
+	if lifetime < 0 {
+		return "", time.Time{}, errors.New("lifetime must not be negative")
+	}
+	if lifetime == 0 {
+		lifetime = ServiceTokenLifetime
+	}
+	now := time.Now()
+	info := User{StartTime: now, ExpiresAt: now.Add(lifetime), UserName: user, Service: true}
+	token, err := u.issue(info)
+	return token, info.ExpiresAt, err
+}
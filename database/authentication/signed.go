@@ -0,0 +1,476 @@
+package authentication
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
+)
+
+// MinKeyLength is the minimum number of bytes in the key of signed tokens.
+const MinKeyLength = 32
+
+// signedHeader is the encoded JWT header of signed tokens, which are always HMAC-SHA256.
+var signedHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// claims is the payload of a signed token. Times are NumericDates, in seconds since the epoch,
+// and IssuedAt keeps milliseconds so that tokens issued after a user's sessions are revoked stay valid.
+type claims struct {
+	Subject  string  `json:"sub"`
+	Expires  int64   `json:"exp"`
+	IssuedAt float64 `json:"iat"`
+	ID       string  `json:"jti"`
+	Service  bool    `json:"svc,omitempty"`
+	Refresh  bool    `json:"rfr,omitempty"`
+}
+
+// revocation is a line of the revocation list: either a token ID revoked until the token expires,
+// or a user whose tokens issued before a time are revoked. Times are in milliseconds.
+type revocation struct {
+	ID      string `json:"id,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	User    string `json:"user,omitempty"`
+	Before  int64  `json:"before,omitempty"`
+}
+
+// Signed issues HMAC-signed JSON Web Tokens carrying the user and expiry, so that tokens
+// survive restarts and can be checked by every server sharing the key. Logged out tokens,
+// used refresh tokens and users whose sessions were revoked are kept in a revocation list.
+// Tokens from the token file are stored as by UserToken.
+//
+// Since nothing records when a signed token was last used, session tokens are not renewed
+// by activity and instead expire after the idle timeout, if there is one, or the absolute
+// lifetime, whichever is shorter. Clients renew them with their refresh token.
+type Signed struct {
+	key       []byte
+	lifetimes Lifetimes
+	static    UserToken                            // tokens from the token file
+	revoked   skiplist.SkipList[string, time.Time] // revoked token IDs to when the tokens expire
+	users     skiplist.SkipList[string, time.Time] // users to the time before which their tokens are revoked
+	mu        sync.Mutex                           // guards file
+	file      *os.File                             // revocation list, nil if it is kept in memory only
+	path      string                               // path of file
+}
+
+// LoadKey reads the key of signed tokens from the file at path, ignoring surrounding whitespace.
+// Returns an error if the key is shorter than MinKeyLength.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("key in %s must be at least %d bytes", path, MinKeyLength)
+	}
+	return key, nil
+}
+
+// NewSigned creates a Signed backend with key whose tokens have lifetimes, replacing zero lifetimes
+// by their defaults. If revocations is not empty, the revocation list is loaded from and appended
+// to the file at that path, so that it survives restarts.
+func NewSigned(key []byte, revocations string, lifetimes Lifetimes) (*Signed, error) {
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("key must be at least %d bytes", MinKeyLength)
+	}
+	lifetimes = lifetimes.withDefaults()
+	s := &Signed{key: key, lifetimes: lifetimes, static: NewWithLifetimes(lifetimes)}
+	s.revoked.MakeSkipList()
+	s.users.MakeSkipList()
+	if revocations == "" {
+		return s, nil
+	}
+	err := s.load(revocations)
+	if err != nil {
+		return nil, err
+	}
+	s.path = revocations
+	s.file, err = os.OpenFile(revocations, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the revocation list at path, skipping revoked tokens that have expired.
+func (s *Signed) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rev revocation
+		if json.Unmarshal(scanner.Bytes(), &rev) != nil {
+			// A torn final line from a crash
+			continue
+		}
+		if rev.ID != "" && time.UnixMilli(rev.Expires).After(now) {
+			s.revokeID(rev.ID, time.UnixMilli(rev.Expires))
+		}
+		if rev.User != "" {
+			s.revokeBefore(rev.User, time.UnixMilli(rev.Before))
+		}
+	}
+	return scanner.Err()
+}
+
+// MapToken issues a signed session token for user.
+func (s *Signed) MapToken(user string) (string, error) {
+	if user == "" {
+		return "", errors.New("No username in request body")
+	}
+	return s.sign(user, time.Now().Add(s.lifetimes.session()), false, false)
+}
+
+// Login issues a signed session token and refresh token for user.
+func (s *Signed) Login(user string) (Grant, error) {
+	if user == "" {
+		return Grant{}, errors.New("No username in request body")
+	}
+	now := time.Now()
+	grant := Grant{
+		ExpiresAt:        now.Add(s.lifetimes.session()).Truncate(time.Second),
+		RefreshExpiresAt: now.Add(s.lifetimes.Refresh).Truncate(time.Second),
+	}
+	var err error
+	grant.Token, err = s.sign(user, grant.ExpiresAt, false, false)
+	if err != nil {
+		return Grant{}, err
+	}
+	grant.RefreshToken, err = s.sign(user, grant.RefreshExpiresAt, false, true)
+	if err != nil {
+		return Grant{}, err
+	}
+	return grant, nil
+}
+
+// Refresh exchanges refreshToken for a new Grant, revoking refreshToken so that it can only be used once.
+func (s *Signed) Refresh(refreshToken string) (Grant, error) {
+	c, ok := s.verify(refreshToken)
+	if !ok || !c.Refresh || s.userRevoked(c) {
+		return Grant{}, errInvalidRefresh
+	}
+	expires := time.Unix(c.Expires, 0)
+	if !s.revokeID(c.ID, expires) {
+		// Already used or logged out
+		return Grant{}, errInvalidRefresh
+	}
+	s.persist(revocation{ID: c.ID, Expires: expires.UnixMilli()})
+	return s.Login(c.Subject)
+}
+
+// MapServiceToken issues a signed service token for user, valid for lifetime,
+// or for ServiceTokenLifetime if lifetime is zero.
+func (s *Signed) MapServiceToken(user string, lifetime time.Duration) (string, time.Time, error) {
+	if user == "" {
+		return "", time.Time{}, errors.New("No username in request body")
+	}
+	if lifetime < 0 {
+		return "", time.Time{}, errors.New("lifetime must not be negative")
+	}
+	if lifetime == 0 {
+		lifetime = ServiceTokenLifetime
+	}
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	token, err := s.sign(user, expires, true, false)
+	return token, expires, err
+}
+
+// sign returns a token for user that expires at expires, which is a refresh token if refresh is set.
+func (s *Signed) sign(user string, expires time.Time, service bool, refresh bool) (string, error) {
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	payload, _ := json.Marshal(claims{
+		Subject:  user,
+		Expires:  expires.Unix(),
+		IssuedAt: float64(now.UnixMilli()) / 1000,
+		ID:       base64.RawURLEncoding.EncodeToString(id),
+		Service:  service,
+		Refresh:  refresh,
+	})
+	signingInput := signedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + s.signature(signingInput), nil
+}
+
+// signature returns the encoded HMAC-SHA256 of signingInput.
+func (s *Signed) signature(signingInput string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the claims of token if it is signed with the key of s and has not expired.
+// Revocations are not checked.
+func (s *Signed) verify(token string) (claims, bool) {
+	c, ok := s.decode(token)
+	if !ok || !time.Now().Before(time.Unix(c.Expires, 0)) {
+		return c, false
+	}
+	return c, true
+}
+
+// decode returns the claims of token if its signature is valid, whether or not it has expired.
+func (s *Signed) decode(token string) (claims, bool) {
+	var c claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != signedHeader {
+		return c, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.signature(parts[0]+"."+parts[1]))) {
+		return c, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil || c.Subject == "" {
+		return c, false
+	}
+	return c, true
+}
+
+// CheckToken returns the user of token if it is a stored token, or a valid signed session token
+// that has not been revoked. Returns an empty string otherwise.
+func (s *Signed) CheckToken(token string) string {
+	if user := s.static.CheckToken(token); user != "" {
+		return user
+	}
+	return s.checkSigned(token)
+}
+
+// CheckStream returns the user of token if it is a stored token or a signed session token that
+// has been neither revoked nor outlived its absolute lifetime. Signed tokens cannot be renewed,
+// so streams stay open past the expiry of their token until its absolute lifetime.
+func (s *Signed) CheckStream(token string) string {
+	if user := s.static.CheckStream(token); user != "" {
+		return user
+	}
+	c, ok := s.decode(token)
+	if !ok || c.Refresh || !time.Now().Before(s.absolute(c)) {
+		return ""
+	}
+	if _, revoked := s.revoked.Find(c.ID); revoked || s.userRevoked(c) {
+		return ""
+	}
+	return c.Subject
+}
+
+// absolute returns when the token with claims c reaches its absolute lifetime: when it expires
+// for service and refresh tokens, and the absolute lifetime after it was issued for session tokens.
+func (s *Signed) absolute(c claims) time.Time {
+	expires := time.Unix(c.Expires, 0)
+	if c.Service || c.Refresh {
+		return expires
+	}
+	absolute := time.UnixMilli(int64(math.Round(c.IssuedAt * 1000))).Add(s.lifetimes.Absolute)
+	if absolute.Before(expires) {
+		return expires
+	}
+	return absolute
+}
+
+// checkSigned returns the user of token if it is a valid signed session token that has not been revoked.
+func (s *Signed) checkSigned(token string) string {
+	c, ok := s.verify(token)
+	if !ok || c.Refresh {
+		return ""
+	}
+	if _, revoked := s.revoked.Find(c.ID); revoked || s.userRevoked(c) {
+		return ""
+	}
+	return c.Subject
+}
+
+// userRevoked reports whether the token with claims c was issued before the sessions of its user were revoked.
+func (s *Signed) userRevoked(c claims) bool {
+	before, found := s.users.Find(c.Subject)
+	if !found {
+		return false
+	}
+	issued := time.UnixMilli(int64(math.Round(c.IssuedAt * 1000)))
+	return !issued.After(before.GetVal())
+}
+
+// DeleteToken revokes token, which may be a session or a refresh token, until it reaches its
+// absolute lifetime, since streams holding it stay open until then.
+// Returns 204, or 401 if the token is invalid.
+func (s *Signed) DeleteToken(token string) int {
+	if s.static.DeleteToken(token) == http.StatusNoContent {
+		return http.StatusNoContent
+	}
+	c, ok := s.verify(token)
+	if !ok || s.userRevoked(c) {
+		return http.StatusUnauthorized
+	}
+	expires := s.absolute(c)
+	if !s.revokeID(c.ID, expires) {
+		return http.StatusUnauthorized
+	}
+	s.persist(revocation{ID: c.ID, Expires: expires.UnixMilli()})
+	return http.StatusNoContent
+}
+
+// RevokeUser revokes every token of user issued until now.
+// Returns the number of stored tokens removed, since signed tokens are not stored.
+func (s *Signed) RevokeUser(user string) int {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	s.revokeBefore(user, now)
+	s.persist(revocation{User: user, Before: now.UnixMilli()})
+	return s.static.RevokeUser(user)
+}
+
+// Sessions returns the unexpired tokens from the token file, masked.
+// Signed tokens are not stored, so they cannot be listed.
+func (s *Signed) Sessions() []Session {
+	return s.static.Sessions()
+}
+
+// UnexpiredToken adds the tokens of the token file at path, which expire after the absolute lifetime.
+func (s *Signed) UnexpiredToken(path string) error {
+	return s.static.UnexpiredToken(path)
+}
+
+// Prune removes expired tokens from the token file and revoked token IDs that have expired,
+// rewriting the revocation list without them. Since service tokens can be valid for any
+// length of time, users whose sessions were revoked are kept.
+// Returns the number of tokens and revocations removed.
+func (s *Signed) Prune() int {
+	pruned := s.static.Prune()
+	// Holding the lock while collecting the revocations keeps later ones from being lost
+	// by the rewrite, since they are only written after it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	expired := make([]string, 0)
+	s.revoked.Range(func(id string, expires time.Time) bool {
+		if now.After(expires) {
+			expired = append(expired, id)
+		}
+		return true
+	})
+	for _, id := range expired {
+		if _, ok := s.revoked.Delete(id); ok {
+			pruned++
+		}
+	}
+	if len(expired) > 0 && s.file != nil {
+		err := s.compact()
+		if err != nil {
+			slog.Error("Failed to compact revocation list", "error", err)
+		}
+	}
+	return pruned
+}
+
+// compact rewrites the revocation list with the revocations in memory.
+// The caller must hold s.mu.
+func (s *Signed) compact() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	s.revoked.Range(func(id string, expires time.Time) bool {
+		line, _ := json.Marshal(revocation{ID: id, Expires: expires.UnixMilli()})
+		w.Write(append(line, '\n'))
+		return true
+	})
+	s.users.Range(func(user string, before time.Time) bool {
+		line, _ := json.Marshal(revocation{User: user, Before: before.UnixMilli()})
+		w.Write(append(line, '\n'))
+		return true
+	})
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	appended, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = appended
+	return nil
+}
+
+// Close closes the revocation list.
+func (s *Signed) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// revokeID adds the token ID id, which expires at expires, to the revocation list in memory.
+// Returns false if it was already revoked.
+func (s *Signed) revokeID(id string, expires time.Time) bool {
+	added, _ := s.revoked.Upsert(id, func(key string, currVal time.Time, exists bool) (time.Time, error) {
+		if exists {
+			return currVal, errors.New("already revoked")
+		}
+		return expires, nil
+	})
+	return added
+}
+
+// revokeBefore revokes the tokens of user issued until before in memory, unless a later revocation exists.
+func (s *Signed) revokeBefore(user string, before time.Time) {
+	s.users.Upsert(user, func(key string, currVal time.Time, exists bool) (time.Time, error) {
+		if exists && currVal.After(before) {
+			return currVal, nil
+		}
+		return before, nil
+	})
+}
+
+// persist appends rev to the revocation list file, if there is one.
+func (s *Signed) persist(rev revocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return
+	}
+	line, _ := json.Marshal(rev)
+	_, err := s.file.Write(append(line, '\n'))
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		slog.Error("Failed to write revocation list", "error", err)
+	}
+}
@@ -12,10 +12,15 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"sort"
 	"strings"
+	"sync/atomic"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filter"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/index"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
 )
@@ -24,16 +29,26 @@ import (
 type Collection struct {
 	path      string
 	documents skiplist.SkipList[string, filejson.FileJson]
+	indexes   skiplist.SkipList[string, *index.Index] // secondary indexes by field
+	access    *atomic.Pointer[acl.ACL]                // nil if the collection has no access control list
+	schema    *atomic.Pointer[validation.Validator]   // nil if the collection has no schema of its own
 }
 
 // New creates a new Collection instance based on the provided HTTP request.
 func New(r *http.Request) Collection {
 	index := strings.Index(r.URL.Path, "/v1/")
 	path := r.URL.Path[index+4:]
+	return NewWithPath(path)
+}
+
+// NewWithPath creates a new, empty Collection at the given path below /v1/.
+func NewWithPath(path string) Collection {
 	path = strings.Trim(path, "/")
 	var list skiplist.SkipList[string, filejson.FileJson]
 	list.MakeSkipList()
-	return Collection{path: path, documents: list}
+	var indexes skiplist.SkipList[string, *index.Index]
+	indexes.MakeSkipList()
+	return Collection{path: path, documents: list, indexes: indexes, access: new(atomic.Pointer[acl.ACL]), schema: new(atomic.Pointer[validation.Validator])}
 }
 
 // Put adds a new document to the collection and returns the marshaled document URI and a status.
@@ -53,7 +68,11 @@ func (c *Collection) Put(docName string, doc filejson.FileJson, validator valida
 		return []byte{}, http.StatusBadRequest
 	}
 
+	var old filejson.FileJson
 	check := func(key string, currVal filejson.FileJson, exists bool) (newValue filejson.FileJson, err error) {
+		if exists {
+			old = currVal
+		}
 		return doc, nil
 	}
 	success, err := c.documents.Upsert(docName, check)
@@ -65,6 +84,7 @@ func (c *Collection) Put(docName string, doc filejson.FileJson, validator valida
 		errMsg, _ := json.Marshal("Inserting into collection failed")
 		return errMsg, http.StatusInternalServerError
 	}
+	c.reindex(docName, old, doc)
 
 	uri := make(map[string]string)
 	uri["uri"] = "/v1/" + c.path + "/" + docName
@@ -75,8 +95,60 @@ func (c *Collection) Put(docName string, doc filejson.FileJson, validator valida
 	return jsonUri, status
 }
 
+// Restore stores doc under docName without schema validation, replacing any existing document.
+// It is used to rebuild the collection from durable storage. Returns whether the insert succeeded.
+func (c *Collection) Restore(docName string, doc *document.Document) bool {
+	var old filejson.FileJson
+	check := func(key string, currVal filejson.FileJson, exists bool) (newValue filejson.FileJson, err error) {
+		if exists {
+			old = currVal
+		}
+		return doc, nil
+	}
+	success, err := c.documents.Upsert(docName, check)
+	if err != nil {
+		slog.Error("Error in restoring document into collection", "error", err)
+	}
+	if success {
+		c.reindex(docName, old, doc)
+	}
+	return success
+}
+
+// Query selects the documents returned by GetQuery.
+// Low and High bound the document names, where empty means unbounded,
+// and Filter, if not nil, must match a document's body.
+// If Limit is positive, at most Limit documents are returned, and
+// if After is set, only documents named after it are returned.
+type Query struct {
+	Low    string
+	High   string
+	Filter *filter.Filter
+	Limit  int
+	After  string
+}
+
 // Get retrieves all documents in the collection within the specified range and returns them as a JSON byte slice of DocumentContent, and returns a status code.
 func (c *Collection) Get(ctx context.Context, high string, low string) ([]byte, int) {
+	data, status, _ := c.GetQuery(ctx, Query{Low: low, High: high})
+	return data, status
+}
+
+// GetQuery retrieves the documents in the collection selected by query and returns them as a JSON byte slice of DocumentContent, and returns a status code.
+// If the query's limit cut the result short, it also returns the name of the last document returned, to be passed as After for the next page.
+// Filters with a top level condition on an indexed field only visit the documents the index selects.
+func (c *Collection) GetQuery(ctx context.Context, query Query) ([]byte, int, string) {
+	if query.Filter != nil {
+		names, ok := c.lookup(query.Filter)
+		if ok {
+			return c.getPage(ctx, query, c.walkNames(names))
+		}
+	}
+	if query.Limit > 0 || query.After != "" {
+		return c.getPage(ctx, query, c.documents.RangeFrom)
+	}
+	high := query.High
+	low := query.Low
 	data := make([]document.DocumentContent, 0)
 	var documents []*skiplist.Node[string, filejson.FileJson]
 	var success bool
@@ -89,7 +161,7 @@ func (c *Collection) Get(ctx context.Context, high string, low string) ([]byte,
 	documents, success = c.documents.Query(ctx, low, high)
 	if !success {
 		errMsg, _ := json.Marshal("Getting all documents in collection failed")
-		return errMsg, http.StatusInternalServerError
+		return errMsg, http.StatusInternalServerError, ""
 	}
 	for _, fileJsonDoc := range documents {
 		// Use type assertion to convert the FileJson interface to Document
@@ -99,13 +171,126 @@ func (c *Collection) Get(ctx context.Context, high string, low string) ([]byte,
 			slog.Error("Error: Document is not of type *document.Document")
 			continue
 		}
-		data = append(data, doc.GetContent())
+		content := doc.GetContent()
+		if query.Filter != nil && !query.Filter.Match(content.Doc) {
+			continue
+		}
+		data = append(data, content)
+	}
+	docs, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Error in Collection marshal")
+	}
+	return docs, http.StatusOK, ""
+}
+
+// getPage retrieves one page of the documents selected by query by using walk to
+// visit the collection in name order from query.After. Because pages are delimited
+// by name, documents inserted or deleted between pages never cause another document
+// to be skipped or returned twice.
+func (c *Collection) getPage(ctx context.Context, query Query, walk func(start string, fn func(name string, file filejson.FileJson) bool)) ([]byte, int, string) {
+	data := make([]document.DocumentContent, 0)
+	start := query.Low
+	if query.After > start {
+		start = query.After
+	}
+	var last string
+	var next string
+	walk(start, func(name string, file filejson.FileJson) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if query.After != "" && name <= query.After {
+			return true
+		}
+		if query.High != "" && name > query.High {
+			return false
+		}
+		doc, ok := file.(*document.Document)
+		if !ok {
+			slog.Error("Error: Document is not of type *document.Document")
+			return true
+		}
+		content := doc.GetContent()
+		if query.Filter != nil && !query.Filter.Match(content.Doc) {
+			return true
+		}
+		// Only report a next page once another document is known to exist
+		if query.Limit > 0 && len(data) == query.Limit {
+			next = last
+			return false
+		}
+		data = append(data, content)
+		last = name
+		return true
+	})
+	if ctx.Err() != nil {
+		errMsg, _ := json.Marshal("Getting documents in collection failed")
+		return errMsg, http.StatusInternalServerError, ""
 	}
 	docs, err := json.Marshal(data)
 	if err != nil {
 		slog.Error("Error in Collection marshal")
 	}
-	return docs, http.StatusOK
+	return docs, http.StatusOK, next
+}
+
+// lookup returns the sorted names of the documents an index selects for the first top level
+// condition of filt on an indexed field, and whether there was such a condition.
+func (c *Collection) lookup(filt *filter.Filter) ([]string, bool) {
+	for _, cond := range filt.Conditions() {
+		node, exists := c.indexes.Find(cond.Path)
+		if !exists {
+			continue
+		}
+		names := make([]string, 0)
+		ok := node.GetVal().Lookup(cond.Op, cond.Values, func(docName string) bool {
+			names = append(names, docName)
+			return true
+		})
+		if !ok {
+			continue
+		}
+		sort.Strings(names)
+		// An in list may select the same document more than once
+		unique := names[:0]
+		for i, name := range names {
+			if i == 0 || name != names[i-1] {
+				unique = append(unique, name)
+			}
+		}
+		return unique, true
+	}
+	return nil, false
+}
+
+// walkNames returns a walk over the documents named in the sorted slice names, for getPage.
+func (c *Collection) walkNames(names []string) func(start string, fn func(name string, file filejson.FileJson) bool) {
+	return func(start string, fn func(name string, file filejson.FileJson) bool) {
+		for _, name := range names[sort.SearchStrings(names, start):] {
+			node, exists := c.documents.Find(name)
+			if !exists {
+				continue
+			}
+			if !fn(name, node.GetVal()) {
+				return
+			}
+		}
+	}
+}
+
+// EncodeCursor returns the opaque cursor that continues a listing after the document docName.
+func EncodeCursor(docName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(docName))
+}
+
+// DecodeCursor returns the document name stored in a cursor made by EncodeCursor.
+func DecodeCursor(cursor string) (string, error) {
+	docName, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(docName) == 0 {
+		return "", errors.New("invalid cursor")
+	}
+	return string(docName), nil
 }
 
 // Delete removes a document from the collection and returns an marshaled message the status.
@@ -119,11 +304,12 @@ func (c *Collection) Delete(docName string) ([]byte, int) {
 		data, _ = json.Marshal("unable to delete docuement " + docName + ": does not exist")
 		status = http.StatusNotFound
 	} else {
-		_, success := c.documents.Delete(docName)
+		node, success := c.documents.Delete(docName)
 		if !success {
 			errMsg, _ := json.Marshal("Deleting document in collection failed")
 			return errMsg, http.StatusInternalServerError
 		}
+		c.reindex(docName, node.GetVal(), nil)
 		data, _ = json.Marshal("document successfully deleted")
 		status = http.StatusNoContent
 	}
@@ -134,7 +320,8 @@ func (c *Collection) Delete(docName string) ([]byte, int) {
 }
 
 // Post creates a new document with a randomly generated token name in the collection and returns the marshaled document URI, status, and token.
-func (c *Collection) Post(user string, r *http.Request) ([]byte, int, string) {
+// The document must conform to the schema of validator.
+func (c *Collection) Post(user string, r *http.Request, validator validation.Validator) ([]byte, int, string) {
 	var token string
 	var file filejson.FileJson
 
@@ -160,6 +347,10 @@ func (c *Collection) Post(user string, r *http.Request) ([]byte, int, string) {
 		return []byte{}, 0, ""
 	}
 	doc.AddTokenToPath(token)
+	if !validator.ValidateSchema(doc.GetDoc()) {
+		slog.Error("Invalid JSON data in document post")
+		return []byte{}, http.StatusBadRequest, ""
+	}
 	file = &doc
 	check := func(key string, currVal filejson.FileJson, exists bool) (newValue filejson.FileJson, err error) {
 		if !exists {
@@ -175,6 +366,7 @@ func (c *Collection) Post(user string, r *http.Request) ([]byte, int, string) {
 		errMsg, _ := json.Marshal("Post collection failed")
 		return errMsg, http.StatusInternalServerError, ""
 	}
+	c.reindex(token, nil, file)
 	uri := make(map[string]string)
 	uri["uri"] = "/v1/" + c.path + "/" + token
 	jsonUri, err := json.Marshal(uri)
@@ -195,6 +387,112 @@ func (c *Collection) Next(next string) (filejson.FileJson, int) {
 	return doc.GetVal(), http.StatusOK
 }
 
+// Range calls fn on every document in the collection in name order, stopping early if fn returns false.
+func (c *Collection) Range(fn func(name string, doc filejson.FileJson) bool) {
+	c.documents.Range(fn)
+}
+
+// CreateIndex declares a secondary index on the JSON pointer field and fills it from the documents
+// already in the collection. Returns the marshaled field and a status, which is 201 if the index was
+// created and 200 if it already existed. Callers must not change the collection while it runs.
+func (c *Collection) CreateIndex(field string) ([]byte, int) {
+	ix, err := index.New(field)
+	if err != nil {
+		errMsg, _ := json.Marshal("invalid index field: " + err.Error())
+		return errMsg, http.StatusBadRequest
+	}
+	created := false
+	check := func(key string, currVal *index.Index, exists bool) (*index.Index, error) {
+		if exists {
+			return currVal, nil
+		}
+		created = true
+		return ix, nil
+	}
+	success, _ := c.indexes.Upsert(ix.Field(), check)
+	if !success {
+		errMsg, _ := json.Marshal("Creating index failed")
+		return errMsg, http.StatusInternalServerError
+	}
+	data, _ := json.Marshal(map[string]string{"field": ix.Field()})
+	if !created {
+		return data, http.StatusOK
+	}
+	c.documents.Range(func(name string, doc filejson.FileJson) bool {
+		ix.Update(name, nil, body(doc))
+		return true
+	})
+	return data, http.StatusCreated
+}
+
+// DropIndex removes the secondary index on the JSON pointer field and returns a marshaled message and a status.
+func (c *Collection) DropIndex(field string) ([]byte, int) {
+	ix, err := index.New(field)
+	if err != nil {
+		errMsg, _ := json.Marshal("invalid index field: " + err.Error())
+		return errMsg, http.StatusBadRequest
+	}
+	_, success := c.indexes.Delete(ix.Field())
+	if !success {
+		errMsg, _ := json.Marshal("unable to delete index on " + ix.Field() + ": does not exist")
+		return errMsg, http.StatusNotFound
+	}
+	data, _ := json.Marshal("index successfully deleted")
+	return data, http.StatusNoContent
+}
+
+// Indexes returns the fields of the collection's secondary indexes in order.
+func (c *Collection) Indexes() []string {
+	fields := make([]string, 0)
+	c.indexes.Range(func(field string, ix *index.Index) bool {
+		fields = append(fields, field)
+		return true
+	})
+	return fields
+}
+
+// ACL returns the access control list of the collection, or nil if it has none.
+func (c *Collection) ACL() *acl.ACL {
+	return c.access.Load()
+}
+
+// SetACL replaces the access control list of the collection. A nil list removes it.
+func (c *Collection) SetACL(a *acl.ACL) {
+	c.access.Store(a)
+}
+
+// Schema returns the schema documents in the collection and below it must conform to,
+// or nil if the collection has none of its own.
+func (c *Collection) Schema() *validation.Validator {
+	return c.schema.Load()
+}
+
+// SetSchema replaces the schema of the collection. A nil schema removes it.
+// Documents already in the collection are not checked against the new schema.
+func (c *Collection) SetSchema(v *validation.Validator) {
+	c.schema.Store(v)
+}
+
+// reindex updates every secondary index after the document docName changed from old to new.
+// Either may be nil if the document was created or deleted.
+func (c *Collection) reindex(docName string, old filejson.FileJson, new filejson.FileJson) {
+	oldBody := body(old)
+	newBody := body(new)
+	c.indexes.Range(func(field string, ix *index.Index) bool {
+		ix.Update(docName, oldBody, newBody)
+		return true
+	})
+}
+
+// body returns the JSON body of file if it is a document, and nil otherwise.
+func body(file filejson.FileJson) []byte {
+	doc, ok := file.(*document.Document)
+	if !ok || doc == nil {
+		return nil
+	}
+	return doc.GetDoc()
+}
+
 // GetLastModifiedAt returns the last modified timestamp for the collection.
 func (c *Collection) GetLastModifiedAt() int64 {
 	return 0
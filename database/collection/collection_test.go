@@ -3,9 +3,16 @@ package collection
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filter"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
 )
 
 // Tests the creation of a new Collection object from an HTTP request.
@@ -28,7 +35,8 @@ func TestCollectionPost(t *testing.T) {
 
 	col := New(req)
 
-	jsonUri, status, token := col.Post("testUser", req)
+	validator, _ := validation.NewValidator("../schema.json")
+	jsonUri, status, token := col.Post("testUser", req, validator)
 
 	// Check token
 	if token == "" {
@@ -56,4 +64,148 @@ func TestCollectionPost(t *testing.T) {
 	}
 }
 
+// Test filtering the documents returned by GetQuery.
+func TestGetQueryFilter(t *testing.T) {
+	col := NewWithPath("db/")
+	for name, body := range map[string]string{"a": `{"n": 1}`, "b": `{"n": 2}`, "c": `{"n": 3}`} {
+		req := httptest.NewRequest(http.MethodPut, "/v1/db/"+name, bytes.NewBufferString(body))
+		doc, _ := document.New("testUser", req)
+		col.Restore(name, &doc)
+	}
+	filt, _ := filter.Parse("/n >= 2")
+	data, status, _ := col.GetQuery(context.Background(), Query{Filter: filt})
+	var docs []document.DocumentContent
+	json.Unmarshal(data, &docs)
+	if status != http.StatusOK || len(docs) != 2 || docs[0].Path != "/b" || docs[1].Path != "/c" {
+		t.Errorf("Expected documents b and c, got %d %s", status, string(data))
+	}
+
+	data, _, _ = col.GetQuery(context.Background(), Query{Low: "a", High: "b", Filter: filt})
+	json.Unmarshal(data, &docs)
+	if len(docs) != 1 || docs[0].Path != "/b" {
+		t.Errorf("Expected document b, got %s", string(data))
+	}
+}
+
+// Test walking a collection a page at a time while documents are inserted.
+func TestGetQueryPages(t *testing.T) {
+	col := NewWithPath("db/")
+	restore := func(name string) {
+		req := httptest.NewRequest(http.MethodPut, "/v1/db/"+name, bytes.NewBufferString(`{"n": 1}`))
+		doc, _ := document.New("testUser", req)
+		col.Restore(name, &doc)
+	}
+	for _, name := range []string{"a", "c", "e", "g"} {
+		restore(name)
+	}
+
+	seen := make([]string, 0)
+	after := ""
+	for pages := 0; pages < 10; pages++ {
+		data, status, next := col.GetQuery(context.Background(), Query{Limit: 2, After: after})
+		if status != http.StatusOK {
+			t.Fatalf("Expected status OK, got %d", status)
+		}
+		var docs []document.DocumentContent
+		json.Unmarshal(data, &docs)
+		for _, doc := range docs {
+			seen = append(seen, doc.Path)
+		}
+		// Insert before and after the cursor between pages
+		if pages == 0 {
+			restore("b")
+			restore("f")
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	expected := "/a /c /e /f /g"
+	if strings.Join(seen, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(seen, " "))
+	}
+
+	data, _, next := col.GetQuery(context.Background(), Query{Limit: 6})
+	if next != "" {
+		t.Errorf("Expected no next page, got %q for %s", next, string(data))
+	}
+}
+
+// Test that cursors round trip and reject garbage.
+func TestCursor(t *testing.T) {
+	name, err := DecodeCursor(EncodeCursor("doc/with?odd&chars"))
+	if err != nil || name != "doc/with?odd&chars" {
+		t.Errorf("Expected cursor to round trip, got %q, %v", name, err)
+	}
+	_, err = DecodeCursor("!!!")
+	if err == nil {
+		t.Errorf("Expected invalid cursor to fail")
+	}
+}
+
+// Test that indexes follow puts, posts and deletes and answer filtered queries.
+func TestIndex(t *testing.T) {
+	col := NewWithPath("db/")
+	validator, _ := validation.NewValidator("../schema.json")
+	put := func(name string, body string) {
+		req := httptest.NewRequest(http.MethodPut, "/v1/db/"+name, bytes.NewBufferString(body))
+		doc, _ := document.New("testUser", req)
+		col.Put(name, &doc, validator)
+	}
+	query := func(expr string) string {
+		filt, _ := filter.Parse(expr)
+		data, _, _ := col.GetQuery(context.Background(), Query{Filter: filt})
+		var docs []document.DocumentContent
+		json.Unmarshal(data, &docs)
+		paths := make([]string, 0)
+		for _, doc := range docs {
+			paths = append(paths, doc.Path)
+		}
+		return strings.Join(paths, " ")
+	}
+	put("a", `{"author": "alice", "n": 1}`)
+	put("b", `{"author": "bob", "n": 2}`)
+
+	_, status := col.CreateIndex("/author")
+	if status != http.StatusCreated {
+		t.Fatalf("Expected index to be created, got %d", status)
+	}
+	_, status = col.CreateIndex("/author")
+	if status != http.StatusOK {
+		t.Errorf("Expected existing index, got %d", status)
+	}
+	_, status = col.CreateIndex("author")
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected invalid field to fail, got %d", status)
+	}
+
+	put("c", `{"author": "alice", "n": 3}`)
+	put("b", `{"author": "alice", "n": 2}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/db/", bytes.NewBufferString(`{"author": "carol"}`))
+	col.Post("testUser", req, validator)
+	col.Delete("a")
+
+	if result := query(`/author == "alice"`); result != "/b /c" {
+		t.Errorf("Expected /b /c, got %s", result)
+	}
+	if result := query(`/author == "alice" && /n > 2`); result != "/c" {
+		t.Errorf("Expected /c, got %s", result)
+	}
+	if result := query(`/author > "bob"`); !strings.HasPrefix(result, "/") || strings.Contains(result, " ") {
+		t.Errorf("Expected only the posted document, got %s", result)
+	}
+	if fields := col.Indexes(); len(fields) != 1 || fields[0] != "/author" {
+		t.Errorf("Unexpected indexes %v", fields)
+	}
+
+	_, status = col.DropIndex("/author")
+	if status != http.StatusNoContent || len(col.Indexes()) != 0 {
+		t.Errorf("Expected index to be dropped, got %d", status)
+	}
+	if result := query(`/author == "alice"`); result != "/b /c" {
+		t.Errorf("Expected /b /c without the index, got %s", result)
+	}
+}
+
 // Remaining functions tested in system_test.go.
@@ -7,16 +7,19 @@ package document
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonpatch"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonvisit"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/objvisitor"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
@@ -46,11 +49,23 @@ type Metadata struct {
 
 // PatchResult represents the result of applying a patch to a document.
 type PatchResult struct {
-	Uri         string `json:"uri"`
-	PatchFailed bool   `json:"patchFailed"`
-	Message     string `json:"message"`
+	Uri         string     `json:"uri"`
+	PatchFailed bool       `json:"patchFailed"`
+	Message     string     `json:"message"`
+	Results     []OpResult `json:"results,omitempty"`
 }
 
+// OpResult represents the outcome of a single operation of a patch.
+type OpResult struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// notApplied is the message of the operations after the one that failed a patch.
+const notApplied = "not applied: an earlier operation failed"
+
 // New creates a new Document instance with the specified user and HTTP request.
 // It parses the request body and sets the document content and metadata.
 func New(user string, r *http.Request) (Document, error) {
@@ -94,6 +109,21 @@ func ReplaceNew(user string, r *http.Request, createdBy string, createdAt int64)
 	return Document{contents: content, collections: list}, nil
 }
 
+// Restore rebuilds a document from stored content, keeping its original metadata.
+// content.Path is the path below /v1/, including the database name.
+func Restore(content DocumentContent) Document {
+	var list skiplist.SkipList[string, filejson.FileJson]
+	list.MakeSkipList()
+	return Document{contents: content, collections: list}
+}
+
+// Update returns a copy of the document with new content and metadata that shares
+// the document's nested collections.
+func (d *Document) Update(doc json.RawMessage, meta Metadata) *Document {
+	return &Document{collections: d.collections,
+		contents: DocumentContent{Path: d.contents.Path, Doc: doc, Metadata: meta}}
+}
+
 // GetContent returns the DocumentContent field in Document.
 func (d *Document) GetContent() DocumentContent {
 	index := strings.Index(d.contents.Path, "/")
@@ -181,6 +211,11 @@ func (d *Document) Next(next string) (filejson.FileJson, int) {
 	return col.GetVal(), http.StatusOK
 }
 
+// Range calls fn on every collection in the document in name order, stopping early if fn returns false.
+func (d *Document) Range(fn func(name string, col filejson.FileJson) bool) {
+	d.collections.Range(fn)
+}
+
 // AddTokenToPath appends a token to the document path.
 func (d *Document) AddTokenToPath(token string) {
 	d.contents.Path = d.contents.Path + token
@@ -201,7 +236,24 @@ func (d *Document) GetCreatedBy() string {
 	return d.contents.Metadata.CreatedBy
 }
 
+// ETag returns the strong entity tag of the document, a quoted hash of its body and metadata.
+// It changes whenever the document's representation does.
+func (d *Document) ETag() string {
+	hash := sha256.New()
+	hash.Write(d.contents.Doc)
+	meta, _ := json.Marshal(d.contents.Metadata)
+	hash.Write(meta)
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// GetDoc returns the JSON body of the document.
+func (d *Document) GetDoc() json.RawMessage {
+	return d.contents.Doc
+}
+
 // Patch applies a JSON patch to the document and returns the updated document, marshaled response body, and status.
+// The patch is atomic: if any operation or the schema validation of the result fails, the document is
+// returned unchanged and the response has patchFailed set. The response reports the outcome of every operation.
 func (d *Document) Patch(user string, r *http.Request, createdAt int64, createdBy string, validator validation.Validator) (*Document, []byte, int) {
 	//read the array of jsonObjects
 	data, err := io.ReadAll(r.Body)
@@ -210,83 +262,176 @@ func (d *Document) Patch(user string, r *http.Request, createdAt int64, createdB
 	}
 	defer r.Body.Close()
 
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return d.ApplyPatch(user, mediaType, data, validator)
+}
+
+// ApplyPatch applies the patch in data, whose format is given by mediaType, to the document and
+// returns the updated document, marshaled response body, and status, like Patch. mediaType selects
+// a JSON Patch or a JSON Merge Patch, and any other value the ArrayAdd, ArrayRemove and ObjectAdd operations.
+func (d *Document) ApplyPatch(user string, mediaType string, data []byte, validator validation.Validator) (*Document, []byte, int) {
+	switch mediaType {
+	case jsonpatch.MediaType:
+		return d.jsonPatch(user, data, validator)
+	case jsonpatch.MergeMediaType:
+		return d.mergePatch(user, data, validator)
+	}
+
 	//unmarshal the input json object to three fields: op, path, and value.
 	var l []map[string]any
-	var op string
-	var path []string
-	var value any
-
-	err = json.Unmarshal(data, &l)
+	err := json.Unmarshal(data, &l)
 	//cannot unmarshal data
 	if err != nil {
-		data, _ := json.Marshal(err)
+		data, _ := json.Marshal("patch must be a JSON array of operations")
 		return nil, data, http.StatusBadRequest
 	}
+	var body any
+	err = json.Unmarshal(d.contents.Doc, &body)
+	if err != nil {
+		msg, _ := json.Marshal("Error in unmarshaling doc content")
+		return nil, msg, http.StatusInternalServerError
+	}
 
-	var newDoc = d
-	//finish each request
-	patchFailed := false
-	msg := "patch applied"
-	for _, v := range l {
-
-		op = v["op"].(string)
-		fmt.Println(op)
-		//op must be one of the following three operations
-		if op != "ArrayAdd" && op != "ArrayRemove" && op != "ObjectAdd" {
-			msg = "op must be ArrayAdd or ArrayRemove or ObjectAdd"
-			patchFailed = true
-			break
+	//apply each operation to the unmarshaled document, stopping at the first failure
+	results := make([]OpResult, len(l))
+	failed := false
+	for i, v := range l {
+		op, _ := v["op"].(string)
+		path, _ := v["path"].(string)
+		results[i] = OpResult{Op: op, Path: path}
+		if failed {
+			results[i].Message = notApplied
+			continue
 		}
-		path, err = SplitPath(v["path"].(string))
-		fmt.Println(path)
+		body, err = applyOp(body, op, path, v["value"])
 		if err != nil {
-			patchFailed = true
-			break
+			results[i].Message = err.Error()
+			failed = true
+			continue
 		}
-		value = v["value"]
+		results[i].Success = true
+	}
+	return d.patched(user, body, results, failed, validator)
+}
 
-		visitor := objvisitor.New(path, value, op)
-		fmt.Println(path)
+// applyOp applies one of the operations ArrayAdd, ArrayRemove and ObjectAdd to the unmarshaled
+// document body and returns the result.
+func applyOp(body any, op string, path string, value any) (any, error) {
+	//op must be one of the following three operations
+	if op != "ArrayAdd" && op != "ArrayRemove" && op != "ObjectAdd" {
+		return nil, errors.New("op must be ArrayAdd or ArrayRemove or ObjectAdd")
+	}
+	paths, err := SplitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return jsonvisit.Accept(body, objvisitor.New(paths, value, op))
+}
 
-		var c map[string]any
-		err = json.Unmarshal(newDoc.contents.Doc, &c)
-		if err != nil {
-			msg = "Error in unmarshaling doc content"
-			patchFailed = true
-			break
-		}
-		result, err := jsonvisit.Accept(c, visitor)
-		// Check result against json schema
-		if err != nil {
-			msg = "Error in accepting c"
-			patchFailed = true
-			break
-		}
-		docContent, err := json.Marshal(result)
-		if !validator.ValidateSchema(docContent) {
-			slog.Error("Invalid JSON data in document patch")
-			return nil, nil, http.StatusBadRequest
+// jsonPatch applies the RFC 6902 JSON Patch in data to the document and returns the updated document,
+// marshaled response body, and status. Like Patch, it is atomic and reports every operation.
+func (d *Document) jsonPatch(user string, data []byte, validator validation.Validator) (*Document, []byte, int) {
+	ops, err := jsonpatch.Decode(data)
+	if err != nil {
+		msg, _ := json.Marshal(err.Error())
+		return nil, msg, http.StatusBadRequest
+	}
+	var body any
+	err = json.Unmarshal(d.contents.Doc, &body)
+	if err != nil {
+		msg, _ := json.Marshal("Error in unmarshaling doc content")
+		return nil, msg, http.StatusInternalServerError
+	}
+
+	results := make([]OpResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		results[i] = OpResult{Op: op.Op, Path: op.Path}
+		if failed {
+			results[i].Message = notApplied
+			continue
 		}
+		body, err = op.Apply(body)
 		if err != nil {
-			msg = "Error in marhsaling request back"
-			patchFailed = true
-			break
+			results[i].Message = err.Error()
+			failed = true
+			continue
 		}
-		newDoc = &Document{collections: newDoc.collections,
-			contents: DocumentContent{Path: newDoc.contents.Path,
-				Doc: docContent,
-				Metadata: Metadata{CreatedAt: newDoc.contents.Metadata.CreatedAt,
-					CreatedBy:      newDoc.contents.Metadata.CreatedBy,
-					LastModifiedAt: time.Now().UnixMilli(),
-					LastModifiedBy: user,
-				}}}
+		results[i].Success = true
 	}
+	return d.patched(user, body, results, failed, validator)
+}
+
+// patched finishes a patch of the document whose operations produced body and results. Returns the
+// updated document, marshaled PatchResult, and status 200 OK. If an operation failed or body does
+// not conform to the schema, the patch is not applied: d itself is returned, still with 200 OK,
+// and the result has patchFailed set.
+func (d *Document) patched(user string, body any, results []OpResult, failed bool, validator validation.Validator) (*Document, []byte, int) {
+	response := PatchResult{Uri: "/v1/" + d.contents.Path, Message: "patch applied", Results: results}
+	if failed {
+		response.PatchFailed = true
+		response.Message = "patch not applied: an operation failed"
+		jsonresponse, _ := json.Marshal(response)
+		return d, jsonresponse, http.StatusOK
+	}
+	docContent, err := json.Marshal(body)
+	if err != nil || !validator.ValidateSchema(docContent) {
+		slog.Error("Invalid JSON data in document patch")
+		response.PatchFailed = true
+		response.Message = "patch not applied: patched document does not conform to the schema"
+		jsonresponse, _ := json.Marshal(response)
+		return d, jsonresponse, http.StatusOK
+	}
+	newDoc := d.Update(docContent, Metadata{CreatedAt: d.contents.Metadata.CreatedAt,
+		CreatedBy:      d.contents.Metadata.CreatedBy,
+		LastModifiedAt: time.Now().UnixMilli(),
+		LastModifiedBy: user,
+	})
+	jsonresponse, _ := json.Marshal(response)
+	return newDoc, jsonresponse, http.StatusOK
+}
 
-	responese := PatchResult{
-		Uri:         "/v1/" + d.contents.Path,
-		PatchFailed: patchFailed,
-		Message:     msg}
-	jsonresponse, _ := json.Marshal(responese)
+// MergePatch applies the RFC 7396 JSON Merge Patch in the request body to the document and returns
+// the updated document, marshaled response body, and status.
+func (d *Document) MergePatch(user string, r *http.Request, validator validation.Validator) (*Document, []byte, int) {
+	data, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Couldn't read request body")
+		msg, _ := json.Marshal("couldn't read request body")
+		return nil, msg, http.StatusBadRequest
+	}
+	return d.mergePatch(user, data, validator)
+}
+
+// mergePatch applies the JSON Merge Patch in data to the document, like MergePatch.
+func (d *Document) mergePatch(user string, data []byte, validator validation.Validator) (*Document, []byte, int) {
+	var patch any
+	err := json.Unmarshal(data, &patch)
+	if err != nil {
+		msg, _ := json.Marshal("merge patch must be valid JSON")
+		return nil, msg, http.StatusBadRequest
+	}
+	var body any
+	err = json.Unmarshal(d.contents.Doc, &body)
+	if err != nil {
+		msg, _ := json.Marshal("Error in unmarshaling doc content")
+		return nil, msg, http.StatusInternalServerError
+	}
+
+	docContent, err := json.Marshal(jsonpatch.Merge(body, patch))
+	if err != nil || !validator.ValidateSchema(docContent) {
+		slog.Error("Invalid JSON data in document merge patch")
+		msg, _ := json.Marshal("patched document does not conform to the schema")
+		return nil, msg, http.StatusBadRequest
+	}
+	newDoc := d.Update(docContent, Metadata{CreatedAt: d.contents.Metadata.CreatedAt,
+		CreatedBy:      d.contents.Metadata.CreatedBy,
+		LastModifiedAt: time.Now().UnixMilli(),
+		LastModifiedBy: user,
+	})
+	response := PatchResult{Uri: "/v1/" + d.contents.Path, Message: "patch applied"}
+	jsonresponse, _ := json.Marshal(response)
 	return newDoc, jsonresponse, http.StatusOK
 }
 
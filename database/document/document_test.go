@@ -4,9 +4,12 @@ package document
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
 	"reflect"
 	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
 )
 
 // Tests the creation of a new Document object from an HTTP request.
@@ -184,4 +187,93 @@ func TestSplitPath(t *testing.T) {
 	}
 }
 
+// Tests applying an RFC 6902 JSON Patch, selected by the request's content type.
+func TestJSONPatch(t *testing.T) {
+	validator, _ := validation.NewValidator("../schema.json")
+	doc := Restore(DocumentContent{Path: "db/doc", Doc: []byte(`{"a": [1], "b~": "x"}`),
+		Metadata: Metadata{CreatedBy: "creator", CreatedAt: 1, LastModifiedBy: "creator", LastModifiedAt: 1}})
+	patch := func(body string) (*Document, PatchResult, int) {
+		req, _ := http.NewRequest("PATCH", "/v1/db/doc", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json-patch+json; charset=utf-8")
+		newDoc, data, status := doc.Patch("patcher", req, 1, "creator", validator)
+		var result PatchResult
+		json.Unmarshal(data, &result)
+		return newDoc, result, status
+	}
+
+	newDoc, result, status := patch(`[{"op": "add", "path": "/a/-", "value": 2}, {"op": "move", "from": "/b~0", "path": "/c"}]`)
+	if status != http.StatusOK || result.PatchFailed {
+		t.Fatalf("Expected patch to apply, got %d %v", status, result)
+	}
+	if string(newDoc.GetDoc()) != `{"a":[1,2],"c":"x"}` {
+		t.Errorf("Unexpected patched document %s", string(newDoc.GetDoc()))
+	}
+	meta := newDoc.GetContent().Metadata
+	if meta.CreatedBy != "creator" || meta.LastModifiedBy != "patcher" {
+		t.Errorf("Unexpected metadata %v", meta)
+	}
+
+	newDoc, result, status = patch(`[{"op": "add", "path": "/d", "value": 1}, {"op": "test", "path": "/a/0", "value": 5}]`)
+	if status != http.StatusOK || !result.PatchFailed || newDoc != &doc {
+		t.Errorf("Expected failed patch to leave the document unchanged, got %d %v", status, result)
+	}
+
+	_, _, status = patch(`[{"op": "add", "path": "/d"}]`)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed patch, got %d", status)
+	}
+
+	// Without the content type the original operations are used
+	req, _ := http.NewRequest("PATCH", "/v1/db/doc", bytes.NewBufferString(`[{"op": "ArrayAdd", "path": "/a", "value": 3}]`))
+	newDoc, _, _ = doc.Patch("patcher", req, 1, "creator", validator)
+	if string(newDoc.GetDoc()) != `{"a":[1,3],"b~":"x"}` {
+		t.Errorf("Unexpected document after ArrayAdd %s", string(newDoc.GetDoc()))
+	}
+}
+
+// Tests that a patch is applied completely or not at all and reports every operation.
+func TestPatchAtomic(t *testing.T) {
+	validator, _ := validation.NewValidator("../schema.json")
+	doc := Restore(DocumentContent{Path: "db/doc", Doc: []byte(`{"a": [1]}`)})
+	body := `[{"op": "ArrayAdd", "path": "/a", "value": 2}, {"op": "ArrayAdd", "path": "/missing/x", "value": 3}, {"op": "ObjectAdd", "path": "/b", "value": 4}]`
+	req, _ := http.NewRequest("PATCH", "/v1/db/doc", bytes.NewBufferString(body))
+	newDoc, data, status := doc.Patch("patcher", req, 0, "", validator)
+	var result PatchResult
+	json.Unmarshal(data, &result)
+	if status != http.StatusOK || newDoc != &doc || !result.PatchFailed {
+		t.Fatalf("Expected patch to fail, got %d %s", status, string(data))
+	}
+	if len(result.Results) != 3 || !result.Results[0].Success || result.Results[1].Success || result.Results[1].Message == "" ||
+		result.Results[2].Success || result.Results[2].Message != notApplied {
+		t.Errorf("Unexpected operation results %s", string(data))
+	}
+	if string(doc.GetDoc()) != `{"a": [1]}` {
+		t.Errorf("Document changed by failed patch: %s", string(doc.GetDoc()))
+	}
+
+	req, _ = http.NewRequest("PATCH", "/v1/db/doc", bytes.NewBufferString(`[{"path": "/a", "value": 2}]`))
+	_, data, status = doc.Patch("patcher", req, 0, "", validator)
+	json.Unmarshal(data, &result)
+	if status != http.StatusOK || !result.PatchFailed {
+		t.Errorf("Expected an operation without op to fail, got %d %s", status, string(data))
+	}
+}
+
+// Tests that the entity tag changes with the body and metadata of a Document.
+func TestETag(t *testing.T) {
+	meta := Metadata{CreatedBy: "testUser", CreatedAt: 1, LastModifiedBy: "testUser", LastModifiedAt: 1}
+	doc := Restore(DocumentContent{Path: "db/doc", Doc: []byte(`{"a": 1}`), Metadata: meta})
+	same := Restore(DocumentContent{Path: "db/doc", Doc: []byte(`{"a": 1}`), Metadata: meta})
+	if doc.ETag() != same.ETag() || len(doc.ETag()) < 3 || doc.ETag()[0] != '"' {
+		t.Errorf("Expected equal quoted ETags, got %s and %s", doc.ETag(), same.ETag())
+	}
+	if doc.Update([]byte(`{"a": 2}`), meta).ETag() == doc.ETag() {
+		t.Errorf("Expected ETag to change with the body")
+	}
+	meta.LastModifiedAt = 2
+	if doc.Update([]byte(`{"a": 1}`), meta).ETag() == doc.ETag() {
+		t.Errorf("Expected ETag to change with the metadata")
+	}
+}
+
 // Remaining functions tested in system_test.go.
@@ -0,0 +1,413 @@
+// Package filter parses and evaluates filter expressions over JSON documents.
+//
+// A filter compares values at JSON pointer paths inside a document with JSON literals:
+//
+//	/author == "alice" && /priority > 3
+//	/status in ["open", "blocked"] || !exists(/closedAt)
+//
+// The comparison operators are ==, !=, <, <=, > and >=. Ordering comparisons only
+// match numbers against numbers and strings against strings. A path that does not
+// exist in the document never matches a comparison or in. Expressions are combined
+// with && (or "and"), || (or "or"), ! and parentheses, where && binds tighter than ||.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonpointer"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonvisit"
+)
+
+// Filter is a parsed filter expression.
+type Filter struct {
+	expr string
+	root node
+}
+
+// node is a part of a parsed filter expression.
+type node interface {
+	match(doc any) bool
+}
+
+// andNode matches when both sides match.
+type andNode struct {
+	left, right node
+}
+
+// orNode matches when either side matches.
+type orNode struct {
+	left, right node
+}
+
+// notNode matches when its operand does not.
+type notNode struct {
+	operand node
+}
+
+// existsNode matches when the path exists.
+type existsNode struct {
+	path []string
+}
+
+// compareNode matches when the value at path compares to value with op.
+type compareNode struct {
+	path  []string
+	op    string
+	value any
+}
+
+// inNode matches when the value at path equals one of values.
+type inNode struct {
+	path   []string
+	values []any
+}
+
+// Parse parses a filter expression.
+func Parse(expr string) (*Filter, error) {
+	p := parser{input: expr}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether the JSON document doc matches the filter.
+// Documents that are not valid JSON never match.
+func (f *Filter) Match(doc []byte) bool {
+	var value any
+	err := json.Unmarshal(doc, &value)
+	if err != nil {
+		return false
+	}
+	return f.MatchValue(value)
+}
+
+// MatchValue reports whether the unmarshaled JSON document doc matches the filter.
+func (f *Filter) MatchValue(doc any) bool {
+	return f.root.match(doc)
+}
+
+// Condition is a comparison of the value at Path, a JSON pointer, that a document must satisfy
+// to match a filter. Op is a comparison operator or "in", and Values holds the single value
+// compared against or the values of the in list.
+type Condition struct {
+	Path   string
+	Op     string
+	Values []any
+}
+
+// Conditions returns the comparisons and in lists joined by && at the top level of the filter.
+// Every document matching the filter satisfies all of them, so they can be answered with an index.
+func (f *Filter) Conditions() []Condition {
+	return conditions(f.root, make([]Condition, 0))
+}
+
+// conditions appends the top level conditions of n to conds.
+func conditions(n node, conds []Condition) []Condition {
+	switch n := n.(type) {
+	case andNode:
+		conds = conditions(n.left, conds)
+		conds = conditions(n.right, conds)
+	case compareNode:
+		conds = append(conds, Condition{Path: jsonpointer.Format(n.path), Op: n.op, Values: []any{n.value}})
+	case inNode:
+		conds = append(conds, Condition{Path: jsonpointer.Format(n.path), Op: "in", Values: n.values})
+	}
+	return conds
+}
+
+func (n andNode) match(doc any) bool {
+	return n.left.match(doc) && n.right.match(doc)
+}
+
+func (n orNode) match(doc any) bool {
+	return n.left.match(doc) || n.right.match(doc)
+}
+
+func (n notNode) match(doc any) bool {
+	return !n.operand.match(doc)
+}
+
+func (n existsNode) match(doc any) bool {
+	_, exists := jsonpointer.Get(doc, n.path)
+	return exists
+}
+
+func (n compareNode) match(doc any) bool {
+	value, exists := jsonpointer.Get(doc, n.path)
+	if !exists {
+		return false
+	}
+	switch n.op {
+	case "==":
+		return jsonvisit.Equal(value, n.value)
+	case "!=":
+		return !jsonvisit.Equal(value, n.value)
+	}
+	cmp, ok := Compare(value, n.value)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func (n inNode) match(doc any) bool {
+	value, exists := jsonpointer.Get(doc, n.path)
+	if !exists {
+		return false
+	}
+	for _, v := range n.values {
+		if jsonvisit.Equal(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare orders two JSON values of the same type, which must be numbers or strings.
+// Returns a negative number, zero, or a positive number, and whether the values are comparable.
+func Compare(a any, b any) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+// parser is a recursive descent parser over a filter expression.
+type parser struct {
+	input string
+	pos   int
+}
+
+// errorf returns a parse error at the current position.
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid filter at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skipSpace advances past whitespace.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept advances past any of the given tokens if one is next and returns it.
+// Word tokens must not be followed by another letter.
+func (p *parser) accept(tokens ...string) string {
+	p.skipSpace()
+	for _, token := range tokens {
+		if !strings.HasPrefix(p.input[p.pos:], token) {
+			continue
+		}
+		end := p.pos + len(token)
+		if unicode.IsLetter(rune(token[0])) && end < len(p.input) && unicode.IsLetter(rune(p.input[end])) {
+			continue
+		}
+		p.pos = end
+		return token
+	}
+	return ""
+}
+
+// expect advances past token or returns an error.
+func (p *parser) expect(token string) error {
+	if p.accept(token) == "" {
+		return p.errorf("expected %q", token)
+	}
+	return nil
+}
+
+// parseOr parses a disjunction.
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||", "or") != "" {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses a conjunction.
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&", "and") != "" {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseUnary parses a negation, a parenthesized expression, exists, or a comparison.
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!=") != "" {
+		return nil, p.errorf("expected an expression")
+	}
+	if p.accept("!") != "" {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	if p.accept("(") != "" {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	if p.accept("exists") != "" {
+		err := p.expect("(")
+		if err != nil {
+			return nil, err
+		}
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return existsNode{path: path}, p.expect(")")
+	}
+
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("in") != "" {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{path: path, values: values}, nil
+	}
+	op := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if op == "" {
+		return nil, p.errorf("expected a comparison operator or in")
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{path: path, op: op, value: value}, nil
+}
+
+// parsePath parses a JSON pointer, which ends at whitespace or an operator.
+func (p *parser) parsePath() ([]string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '/' {
+		return nil, p.errorf("expected a path starting with a forward slash")
+	}
+	start := p.pos
+	for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) && !strings.ContainsRune("()=!<>[],&|", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return jsonpointer.Parse(p.input[start:p.pos])
+}
+
+// parseList parses a JSON array of literals.
+func (p *parser) parseList() ([]any, error) {
+	err := p.expect("[")
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, 0)
+	if p.accept("]") != "" {
+		return values, nil
+	}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if p.accept("]") != "" {
+			return values, nil
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseValue parses a JSON string, number, true, false or null.
+func (p *parser) parseValue() (any, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		p.pos++
+		for p.pos < len(p.input) && p.input[p.pos] != '"' {
+			if p.input[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		p.pos++
+	} else {
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || strings.ContainsRune("+-.0123456789", rune(p.input[p.pos]))) {
+			p.pos++
+		}
+	}
+	if p.pos > len(p.input) || p.pos == start {
+		p.pos = start
+		return nil, p.errorf("expected a JSON string, number, true, false or null")
+	}
+	literal := p.input[start:p.pos]
+	var value any
+	err := json.Unmarshal([]byte(literal), &value)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid value %q", literal)
+	}
+	return value, nil
+}
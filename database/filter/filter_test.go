@@ -0,0 +1,98 @@
+// Test cases for filter.
+package filter
+
+import (
+	"testing"
+)
+
+// testDoc is the document the filters in the tests are matched against.
+var testDoc = []byte(`{"author": "alice", "priority": 5, "tags": ["a", "b"], "meta": {"done": false, "a/b": 1}, "note": null}`)
+
+// Tests that filters match or reject the test document as expected.
+func TestMatch(t *testing.T) {
+	tests := map[string]bool{
+		`/author == "alice"`:                            true,
+		`/author == "bob"`:                              false,
+		`/author != "bob"`:                              true,
+		`/missing != "bob"`:                             false,
+		`/priority > 3`:                                 true,
+		`/priority >= 5`:                                true,
+		`/priority < 5`:                                 false,
+		`/priority <= 5.0`:                              true,
+		`/priority > "3"`:                               false,
+		`/author < "bob"`:                               true,
+		`/tags/0 == "a"`:                                true,
+		`/meta/done == false`:                           true,
+		`/meta/a~1b == 1`:                               true,
+		`/note == null`:                                 true,
+		`exists(/meta/done)`:                            true,
+		`exists(/meta/missing)`:                         false,
+		`!exists(/meta/missing)`:                        true,
+		`/author in ["bob", "alice"]`:                   true,
+		`/priority in [1, 2]`:                           false,
+		`/author in []`:                                 false,
+		`/author == "alice" && /priority > 9`:           false,
+		`/author == "alice" and /priority > 3`:          true,
+		`/author == "bob" || /priority > 3`:             true,
+		`/author == "bob" or /priority > 9`:             false,
+		`/author == "bob" && /x == 1 || /priority==5`:   true,
+		`/author == "bob" && (/x == 1 || /priority==5)`: false,
+		`!(/author == "bob")`:                           true,
+		`/author=="alice"&&/priority!=4`:                true,
+	}
+	for expr, expected := range tests {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", expr, err)
+			continue
+		}
+		if f.Match(testDoc) != expected {
+			t.Errorf("expected %q to match: %t", expr, expected)
+		}
+	}
+}
+
+// Tests that malformed filters are rejected.
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`author == "alice"`,
+		`/author = "alice"`,
+		`/author == alice`,
+		`/author == "alice`,
+		`/author == "alice" &&`,
+		`(/author == "alice"`,
+		`/author in ["a",]`,
+		`/author in "a"`,
+		`exists(/a`,
+		`/a == 1 extra`,
+	} {
+		_, err := Parse(expr)
+		if err == nil {
+			t.Errorf("expected an error parsing %q", expr)
+		}
+	}
+}
+
+// Tests that documents that are not valid JSON never match.
+func TestMatchInvalid(t *testing.T) {
+	f, _ := Parse(`!exists(/a)`)
+	if f.Match([]byte(`{`)) {
+		t.Error("invalid JSON should not match")
+	}
+}
+
+// Tests that only comparisons joined by && at the top level are reported as conditions.
+func TestConditions(t *testing.T) {
+	f, _ := Parse(`/a~1b == 1 && (/c in ["x", "y"] && !(/d > 2)) && (/e == 1 || /f == 2)`)
+	conds := f.Conditions()
+	if len(conds) != 2 {
+		t.Fatalf("expected 2 conditions, got %v", conds)
+	}
+	if conds[0].Path != "/a~1b" || conds[0].Op != "==" || len(conds[0].Values) != 1 || conds[0].Values[0] != 1.0 {
+		t.Errorf("unexpected first condition %v", conds[0])
+	}
+	if conds[1].Path != "/c" || conds[1].Op != "in" || len(conds[1].Values) != 2 {
+		t.Errorf("unexpected second condition %v", conds[1])
+	}
+}
@@ -3,3 +3,5 @@ module github.com/RICE-COMP318-FALL23/owldb-p1group06
 go 1.21.0
 
 require github.com/santhosh-tekuri/jsonschema/v5 v5.3.1 // direct
+
+require golang.org/x/crypto v0.33.0
@@ -0,0 +1,200 @@
+// Package index provides secondary indexes over a field of a collection's documents.
+//
+// An index maps the value at a JSON pointer inside each document to the document's name.
+// Entries are kept in a concurrent skip list under composite keys made of an order
+// preserving encoding of the value followed by the document name, so that documents
+// with equal values sort by name and range comparisons become range scans.
+// Only strings, numbers, booleans and null are indexed. Documents whose field is
+// missing or holds an array or object have no entry.
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonpointer"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
+)
+
+// Type tags that start every encoded value, in the order the types sort.
+const (
+	tagNull   = "0"
+	tagBool   = "1"
+	tagNumber = "2"
+	tagString = "3"
+)
+
+// Index is a secondary index on one field of a collection's documents.
+type Index struct {
+	field   string
+	tokens  []string
+	entries skiplist.SkipList[string, string] // composite key -> document name
+}
+
+// New creates an empty index on field, which must be a non-empty JSON pointer.
+func New(field string) (*Index, error) {
+	if field == "" {
+		return nil, errors.New("index field must be a JSON pointer starting with a forward slash")
+	}
+	tokens, err := jsonpointer.Parse(field)
+	if err != nil {
+		return nil, err
+	}
+	var entries skiplist.SkipList[string, string]
+	entries.MakeSkipList()
+	return &Index{field: jsonpointer.Format(tokens), tokens: tokens, entries: entries}, nil
+}
+
+// Field returns the JSON pointer the index is on, in canonical form.
+func (ix *Index) Field() string {
+	return ix.field
+}
+
+// Update moves the entry of the document docName from its old body to its new body.
+// A nil body means the document did not exist before or no longer exists.
+func (ix *Index) Update(docName string, oldDoc []byte, newDoc []byte) {
+	oldKey, hadKey := ix.key(docName, oldDoc)
+	newKey, hasKey := ix.key(docName, newDoc)
+	if hadKey && hasKey && oldKey == newKey {
+		return
+	}
+	if hadKey {
+		ix.entries.Delete(oldKey)
+	}
+	if hasKey {
+		ix.entries.Upsert(newKey, func(key string, currVal string, exists bool) (string, error) {
+			return docName, nil
+		})
+	}
+}
+
+// Lookup calls fn with the name of every document whose field compares to values with op,
+// in index order, until fn returns false. op is ==, <, <=, >, >= with a single value, or in.
+// Follows the rules of package filter, so ordering comparisons only match values of the same
+// type, which must be numbers or strings. Returns false if the index cannot answer op.
+func (ix *Index) Lookup(op string, values []any, fn func(docName string) bool) bool {
+	switch op {
+	case "==", "in":
+		for _, value := range values {
+			prefix, ok := encode(value)
+			if !ok {
+				continue
+			}
+			more := ix.scan(prefix, func(key string) bool {
+				return strings.HasPrefix(key, prefix)
+			}, func(key string) bool {
+				return true
+			}, fn)
+			if !more {
+				return true
+			}
+		}
+		return true
+	case "<", "<=", ">", ">=":
+		if len(values) != 1 {
+			return false
+		}
+		bound, ok := encode(values[0])
+		if !ok {
+			return true
+		}
+		tag := bound[:1]
+		if tag != tagNumber && tag != tagString {
+			return true
+		}
+		inType := func(key string) bool {
+			return strings.HasPrefix(key, tag)
+		}
+		switch op {
+		case "<":
+			ix.scan(tag, func(key string) bool {
+				return key < bound
+			}, inType, fn)
+		case "<=":
+			ix.scan(tag, func(key string) bool {
+				return key < bound || strings.HasPrefix(key, bound)
+			}, inType, fn)
+		case ">":
+			ix.scan(bound, inType, func(key string) bool {
+				return !strings.HasPrefix(key, bound)
+			}, fn)
+		case ">=":
+			ix.scan(bound, inType, inType, fn)
+		}
+		return true
+	}
+	return false
+}
+
+// scan walks the entries from start while more holds, calling fn for the entries that match.
+// Returns false if fn asked to stop.
+func (ix *Index) scan(start string, more func(key string) bool, match func(key string) bool, fn func(docName string) bool) bool {
+	stopped := false
+	ix.entries.RangeFrom(start, func(key string, docName string) bool {
+		if !more(key) {
+			return false
+		}
+		if match(key) && !fn(docName) {
+			stopped = true
+			return false
+		}
+		return true
+	})
+	return !stopped
+}
+
+// key returns the composite key of the document docName with body doc, and whether it has one.
+func (ix *Index) key(docName string, doc []byte) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	var body any
+	err := json.Unmarshal(doc, &body)
+	if err != nil {
+		return "", false
+	}
+	value, exists := jsonpointer.Get(body, ix.tokens)
+	if !exists {
+		return "", false
+	}
+	encoded, ok := encode(value)
+	if !ok {
+		return "", false
+	}
+	return encoded + docName, true
+}
+
+// encode returns the order preserving encoding of an unmarshaled JSON scalar.
+// Encoded values of different lengths never prefix each other, so a document name may follow directly.
+func encode(value any) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return tagNull, true
+	case bool:
+		if v {
+			return tagBool + "1", true
+		}
+		return tagBool + "0", true
+	case float64:
+		if v == 0 {
+			// Negative zero equals zero
+			v = 0
+		}
+		// Flip the sign bit of positive numbers and every bit of negative ones,
+		// so that the bits sort in the same order as the numbers
+		bits := math.Float64bits(v)
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return fmt.Sprintf("%s%016x", tagNumber, bits), true
+	case string:
+		// Escape zero bytes so that the terminator sorts before any continuation
+		return tagString + strings.ReplaceAll(v, "\x00", "\x00\xff") + "\x00\x01", true
+	}
+	return "", false
+}
@@ -0,0 +1,93 @@
+// Test cases for index.
+package index
+
+import (
+	"strings"
+	"testing"
+)
+
+// lookup returns the document names Lookup finds, joined by spaces.
+func lookup(ix *Index, op string, values ...any) string {
+	names := make([]string, 0)
+	ix.Lookup(op, values, func(docName string) bool {
+		names = append(names, docName)
+		return true
+	})
+	return strings.Join(names, " ")
+}
+
+// Tests equality, in and range lookups over mixed value types.
+func TestLookup(t *testing.T) {
+	ix, err := New("/n")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	docs := map[string]string{
+		"a": `{"n": -2.5}`,
+		"b": `{"n": 10}`,
+		"c": `{"n": 2}`,
+		"d": `{"n": "2"}`,
+		"e": `{"n": "ab"}`,
+		"f": `{"n": "a"}`,
+		"g": `{"n": true}`,
+		"h": `{"n": null}`,
+		"i": `{"n": [1]}`,
+		"j": `{"m": 1}`,
+		"k": `{"n": 2}`,
+		"l": `{"n": -0}`,
+	}
+	for name, doc := range docs {
+		ix.Update(name, nil, []byte(doc))
+	}
+
+	tests := []struct {
+		op       string
+		values   []any
+		expected string
+	}{
+		{"==", []any{2.0}, "c k"},
+		{"==", []any{"2"}, "d"},
+		{"==", []any{0.0}, "l"},
+		{"==", []any{nil}, "h"},
+		{"==", []any{true}, "g"},
+		{"in", []any{"a", 10.0}, "f b"},
+		{"<", []any{2.0}, "a l"},
+		{"<=", []any{2.0}, "a l c k"},
+		{">", []any{2.0}, "b"},
+		{">=", []any{-2.5}, "a l c k b"},
+		{">", []any{"a"}, "e"},
+		{"<", []any{"ab"}, "d f"},
+		{"<", []any{true}, ""},
+	}
+	for _, test := range tests {
+		result := lookup(ix, test.op, test.values...)
+		if result != test.expected {
+			t.Errorf("%s %v: expected %q but received %q", test.op, test.values, test.expected, result)
+		}
+	}
+	if ix.Lookup("!=", []any{1.0}, func(string) bool { return true }) {
+		t.Errorf("Expected != to be unsupported")
+	}
+}
+
+// Tests that updates move and remove entries.
+func TestUpdate(t *testing.T) {
+	ix, _ := New("/a~1b")
+	if ix.Field() != "/a~1b" {
+		t.Errorf("Unexpected field %s", ix.Field())
+	}
+	ix.Update("x", nil, []byte(`{"a/b": "one"}`))
+	ix.Update("x", []byte(`{"a/b": "one"}`), []byte(`{"a/b": "two"}`))
+	if lookup(ix, "==", "one") != "" || lookup(ix, "==", "two") != "x" {
+		t.Errorf("Expected entry to move from one to two")
+	}
+	ix.Update("x", []byte(`{"a/b": "two"}`), nil)
+	if lookup(ix, ">=", "") != "" {
+		t.Errorf("Expected entry to be removed")
+	}
+
+	_, err := New("")
+	if err == nil {
+		t.Errorf("Expected an error for an empty field")
+	}
+}
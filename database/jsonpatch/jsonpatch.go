@@ -0,0 +1,282 @@
+// Package jsonpatch implements RFC 6902 JSON Patch and RFC 7396 JSON Merge Patch over
+// unmarshaled JSON values.
+//
+// A JSON Patch is a JSON array of operations, each of which is one of add, remove, replace,
+// move, copy or test, and whose paths are RFC 6901 JSON Pointers. Operations are applied
+// in order, and a patch either applies completely or not at all.
+//
+// A merge patch is a partial document: its members replace those of the target, members
+// set to null are removed, and nested objects are merged recursively.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonpointer"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonvisit"
+)
+
+// MediaType is the content type of JSON Patch documents.
+const MediaType = "application/json-patch+json"
+
+// MergeMediaType is the content type of JSON Merge Patch documents.
+const MergeMediaType = "application/merge-patch+json"
+
+// Operation is a single JSON Patch operation. Value is only used by add, replace and test,
+// and From only by move and copy.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Decode parses a JSON Patch document and checks that every operation is well formed.
+func Decode(data []byte) ([]Operation, error) {
+	var ops []Operation
+	err := json.Unmarshal(data, &ops)
+	if err != nil {
+		return nil, errors.New("patch must be a JSON array of operations")
+	}
+	for i, op := range ops {
+		err = op.check()
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return ops, nil
+}
+
+// Apply applies ops to doc in order and returns the patched document.
+// doc may be modified even if an operation fails, so callers that need the
+// original on failure must pass a copy.
+func Apply(doc any, ops []Operation) (any, error) {
+	var err error
+	for i, op := range ops {
+		doc, err = op.Apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// Apply applies the single operation op to doc and returns the patched document.
+func (op Operation) Apply(doc any) (any, error) {
+	err := op.check()
+	if err != nil {
+		return nil, err
+	}
+	path, err := jsonpointer.Parse(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		var value any
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, errors.New("invalid value")
+		}
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+		current, exists := jsonpointer.Get(doc, path)
+		if !exists {
+			return nil, errors.New("path does not exist")
+		}
+		if !jsonvisit.Equal(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	case "remove":
+		return remove(doc, path)
+	case "move", "copy":
+		from, err := jsonpointer.Parse(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, exists := jsonpointer.Get(doc, from)
+		if !exists {
+			return nil, errors.New("from does not exist")
+		}
+		if op.Op == "copy" {
+			return add(doc, path, deepCopy(value))
+		}
+		if len(path) > len(from) && slices.Equal(path[:len(from)], from) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		doc, err = remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// Merge applies the merge patch to target and returns the merged document.
+// target may be modified.
+func Merge(target any, patch any) any {
+	members, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]any)
+	if !ok {
+		doc = make(map[string]any)
+	}
+	for key, value := range members {
+		if value == nil {
+			delete(doc, key)
+		} else {
+			doc[key] = Merge(doc[key], value)
+		}
+	}
+	return doc
+}
+
+// check returns an error if op is missing a member its kind of operation requires.
+func (op Operation) check() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return fmt.Errorf("%s requires a value", op.Op)
+		}
+	case "move", "copy":
+		_, err := jsonpointer.Parse(op.From)
+		if err != nil {
+			return fmt.Errorf("%s requires a valid from: %w", op.Op, err)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("op must be add, remove, replace, move, copy or test, not %q", op.Op)
+	}
+	_, err := jsonpointer.Parse(op.Path)
+	return err
+}
+
+// add adds value at path, inserting into arrays and replacing object members.
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[token] = value
+			return p, nil
+		case []any:
+			idx, err := jsonpointer.Index(token, len(p))
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(p, idx, value), nil
+		}
+		return nil, errors.New("parent is not an object or array")
+	})
+}
+
+// remove removes the value at path, which must exist.
+func remove(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			_, exists := p[token]
+			if !exists {
+				return nil, errors.New("path does not exist")
+			}
+			delete(p, token)
+			return p, nil
+		case []any:
+			idx, err := jsonpointer.Index(token, len(p))
+			if err != nil || idx == len(p) {
+				return nil, errors.New("path does not exist")
+			}
+			return slices.Delete(p, idx, idx+1), nil
+		}
+		return nil, errors.New("path does not exist")
+	})
+}
+
+// replace replaces the value at path, which must exist.
+func replace(doc any, path []string, value any) (any, error) {
+	_, exists := jsonpointer.Get(doc, path)
+	if !exists {
+		return nil, errors.New("path does not exist")
+	}
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[token] = value
+		case []any:
+			idx, _ := jsonpointer.Index(token, len(p))
+			p[idx] = value
+		}
+		return parent, nil
+	})
+}
+
+// update walks doc to the parent of the last token of path, which must not be empty, and
+// replaces the parent with the result of change. Returns the updated document.
+func update(doc any, path []string, change func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	switch d := doc.(type) {
+	case map[string]any:
+		child, exists := d[path[0]]
+		if !exists {
+			return nil, errors.New("path does not exist")
+		}
+		child, err := update(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = child
+		return d, nil
+	case []any:
+		idx, err := jsonpointer.Index(path[0], len(d))
+		if err != nil || idx == len(d) {
+			return nil, errors.New("path does not exist")
+		}
+		child, err := update(d[idx], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		d[idx] = child
+		return d, nil
+	}
+	return nil, errors.New("path does not exist")
+}
+
+// deepCopy returns a copy of an unmarshaled JSON value that shares no objects or arrays with it.
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, val := range v {
+			c[key] = deepCopy(val)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, val := range v {
+			c[i] = deepCopy(val)
+		}
+		return c
+	}
+	return value
+}
@@ -0,0 +1,124 @@
+// Test cases for jsonpatch, mostly from the examples in RFC 6902 appendix A.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonvisit"
+)
+
+// patch decodes and applies patch to doc and returns the result marshaled.
+func patch(t *testing.T, doc string, patch string) (string, error) {
+	var value any
+	err := json.Unmarshal([]byte(doc), &value)
+	if err != nil {
+		t.Fatalf("invalid test document %s", doc)
+	}
+	ops, err := Decode([]byte(patch))
+	if err != nil {
+		return "", err
+	}
+	result, err := Apply(value, ops)
+	if err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(result)
+	return string(data), nil
+}
+
+// Tests patches that succeed.
+func TestApply(t *testing.T) {
+	tests := []struct {
+		doc, patch, expected string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		{`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`, `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		{`{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`, `{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}, {"op": "replace", "path": "/~1", "value": null}]`, `{"/": null, "~1": 10}`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		{`{"a": {"b": [1]}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/b/-", "value": 2}]`, `{"a": {"b": [1]}, "c": {"b": [1, 2]}}`},
+		{`{"a": 1}`, `[{"op": "replace", "path": "", "value": [1]}]`, `[1]`},
+		{`{"a": 1}`, `[]`, `{"a": 1}`},
+	}
+	for _, test := range tests {
+		result, err := patch(t, test.doc, test.patch)
+		if err != nil {
+			t.Errorf("%s on %s: unexpected error %v", test.patch, test.doc, err)
+			continue
+		}
+		var got, expected any
+		json.Unmarshal([]byte(result), &got)
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !jsonvisit.Equal(got, expected) {
+			t.Errorf("%s on %s: expected %s but received %s", test.patch, test.doc, test.expected, result)
+		}
+	}
+}
+
+// Tests patches that must fail.
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`},
+		{`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/2", "value": 1}]`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/01", "value": 1}]`},
+		{`{"foo": ["bar"]}`, `[{"op": "remove", "path": "/foo/-"}]`},
+		{`{"foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`},
+		{`{"foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": 1}]`},
+		{`{"a": {"b": 1}}`, `[{"op": "move", "from": "/a", "path": "/a/c"}]`},
+		{`{"a": 1}`, `[{"op": "copy", "from": "/b", "path": "/c"}]`},
+		{`{"a": 1}`, `[{"op": "add", "path": "/b"}]`},
+		{`{"a": 1}`, `[{"op": "move", "path": "/b"}]`},
+		{`{"a": 1}`, `[{"op": "ArrayAdd", "path": "/b", "value": 1}]`},
+		{`{"a": 1}`, `[{"op": "add", "path": "b", "value": 1}]`},
+		{`{"a": 1}`, `{"op": "add", "path": "/b", "value": 1}`},
+	}
+	for _, test := range tests {
+		result, err := patch(t, test.doc, test.patch)
+		if err == nil {
+			t.Errorf("%s on %s: expected an error but received %s", test.patch, test.doc, result)
+		}
+	}
+}
+
+// Tests merge patches, from the examples in RFC 7396 appendix A.
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		target, patch, expected string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"a": "foo"}`, `null`, `null`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+	for _, test := range tests {
+		var target, patch, expected any
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		json.Unmarshal([]byte(test.expected), &expected)
+		result := Merge(target, patch)
+		if !jsonvisit.Equal(result, expected) {
+			data, _ := json.Marshal(result)
+			t.Errorf("%s on %s: expected %s but received %s", test.patch, test.target, test.expected, string(data))
+		}
+	}
+}
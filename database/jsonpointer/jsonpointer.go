@@ -0,0 +1,80 @@
+// Package jsonpointer implements RFC 6901 JSON Pointers over unmarshaled JSON values.
+package jsonpointer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Parse splits pointer into its unescaped reference tokens.
+// The empty pointer refers to the whole document and has no tokens.
+func Parse(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("JSON pointer must be empty or start with a forward slash")
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		// ~1 must be replaced before ~0, so that "~01" becomes "~1" and not "/"
+		token = strings.ReplaceAll(token, "~1", "/")
+		token = strings.ReplaceAll(token, "~0", "~")
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+// Format joins tokens into a JSON pointer, escaping them as needed.
+func Format(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		token = strings.ReplaceAll(token, "~", "~0")
+		token = strings.ReplaceAll(token, "/", "~1")
+		b.WriteString("/")
+		b.WriteString(token)
+	}
+	return b.String()
+}
+
+// Get returns the value tokens refer to inside doc and whether it exists.
+func Get(doc any, tokens []string) (any, bool) {
+	cur := doc
+	for _, token := range tokens {
+		switch val := cur.(type) {
+		case map[string]any:
+			next, exists := val[token]
+			if !exists {
+				return nil, false
+			}
+			cur = next
+		case []any:
+			idx, err := Index(token, len(val))
+			if err != nil || idx == len(val) {
+				return nil, false
+			}
+			cur = val[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Index converts an array reference token into an index for an array of length n.
+// The token "-" refers to the position after the last element and is returned as n.
+func Index(token string, n int) (int, error) {
+	if token == "-" {
+		return n, nil
+	}
+	// Leading zeros and signs are not allowed
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.IndexFunc(token, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+		return 0, errors.New("invalid array index " + strconv.Quote(token))
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx > n {
+		return 0, errors.New("array index " + token + " out of bounds")
+	}
+	return idx, nil
+}
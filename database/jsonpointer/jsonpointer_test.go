@@ -0,0 +1,73 @@
+// Test cases for jsonpointer.
+package jsonpointer
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Tests parsing pointers, including escaped characters.
+func TestParse(t *testing.T) {
+	tests := map[string][]string{
+		"":         {},
+		"/":        {""},
+		"/a/b":     {"a", "b"},
+		"/a~1b":    {"a/b"},
+		"/m~0n":    {"m~n"},
+		"/~01":     {"~1"},
+		"/arr/0/x": {"arr", "0", "x"},
+	}
+	for pointer, expected := range tests {
+		tokens, err := Parse(pointer)
+		if err != nil || !reflect.DeepEqual(tokens, expected) {
+			t.Errorf("Parse(%q) = %v, %v, expected %v", pointer, tokens, err, expected)
+		}
+		if Format(tokens) != pointer {
+			t.Errorf("Format(%v) = %q, expected %q", tokens, Format(tokens), pointer)
+		}
+	}
+	_, err := Parse("a/b")
+	if err == nil {
+		t.Error("expected an error for a pointer without a leading slash")
+	}
+}
+
+// Tests looking up values in objects and arrays.
+func TestGet(t *testing.T) {
+	var doc any
+	json.Unmarshal([]byte(`{"a": {"b": [1, {"c": "x"}]}, "a/b": true}`), &doc)
+	tests := map[string]any{
+		"/a/b/0":   float64(1),
+		"/a/b/1/c": "x",
+		"/a~1b":    true,
+	}
+	for pointer, expected := range tests {
+		tokens, _ := Parse(pointer)
+		value, exists := Get(doc, tokens)
+		if !exists || !reflect.DeepEqual(value, expected) {
+			t.Errorf("Get(%q) = %v, %v, expected %v", pointer, value, exists, expected)
+		}
+	}
+	for _, pointer := range []string{"/missing", "/a/b/2", "/a/b/-", "/a/b/01", "/a/b/0/c"} {
+		tokens, _ := Parse(pointer)
+		_, exists := Get(doc, tokens)
+		if exists {
+			t.Errorf("Get(%q) should not exist", pointer)
+		}
+	}
+}
+
+// Tests converting array reference tokens to indexes.
+func TestIndex(t *testing.T) {
+	idx, err := Index("-", 3)
+	if err != nil || idx != 3 {
+		t.Errorf("expected - to refer to index 3, got %d, %v", idx, err)
+	}
+	for _, token := range []string{"", "01", "-1", "+1", "4", "a"} {
+		_, err = Index(token, 3)
+		if err == nil {
+			t.Errorf("expected an error for index %q", token)
+		}
+	}
+}
@@ -9,9 +9,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/system"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
 )
 
 func main() {
@@ -21,22 +26,53 @@ func main() {
 
 	// Your code goes here.
 
-	var tokens string
-	var schema string
+	var config system.Config
+	var syncPolicy string
+	var queuePolicy string
+	var admins string
 
-	//get port, tokens, and schema
+	//get port, tokens, schema, and data directory
 	flag.IntVar(&port, "p", 3318, "Port number to listen on")
-	flag.StringVar(&tokens, "t", "", "Path to the file of string tokens")
-	flag.StringVar(&schema, "s", "", "Path to the JSON Schema file")
+	flag.StringVar(&config.Tokens, "t", "", "Path to the file of string tokens")
+	flag.StringVar(&config.Schema, "s", "", "Path to the JSON Schema file")
+	flag.StringVar(&config.DataDir, "d", "", "Directory to store data in, data is kept in memory only if empty")
+	flag.StringVar(&syncPolicy, "sync", "always", "When to sync the log to disk: always, batch, or never")
+	flag.DurationVar(&config.SnapshotInterval, "snapshot", 10*time.Minute, "How often to snapshot the data directory, 0 to disable")
+	flag.IntVar(&config.QueueSize, "queue", subscription.DefaultQueueSize, "Number of events queued for each subscriber")
+	flag.StringVar(&queuePolicy, "queue-policy", "drop-oldest", "What to do when a subscriber's queue is full: drop-oldest, disconnect, or coalesce")
+	flag.StringVar(&admins, "admins", "", "Comma-separated users allowed to use the admin API, whose accounts only admins can register")
+	flag.StringVar(&config.Auth, "auth", "store", "Token backend: store, or signed for HMAC-signed tokens")
+	flag.StringVar(&config.KeyFile, "key", "", "Path to the key of signed tokens")
+	flag.DurationVar(&config.TokenLifetime, "token-lifetime", authentication.DefaultLifetimes.Absolute, "How long session tokens are valid at most")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", authentication.DefaultLifetimes.Idle, "How long session tokens stay valid without being used, 0 to disable")
+	flag.DurationVar(&config.RefreshLifetime, "refresh-lifetime", authentication.DefaultLifetimes.Refresh, "How long refresh tokens are valid")
+	flag.DurationVar(&config.SweepInterval, "sweep", time.Minute, "How often to remove expired tokens, close subscriptions whose token expired and forget paths without subscribers, 0 to disable")
 	flag.Parse()
 
+	config.Sync, err = wal.ParseSyncPolicy(syncPolicy)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	config.QueuePolicy, err = subscription.ParsePolicy(queuePolicy)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if admins != "" {
+		config.Admins = strings.Split(admins, ",")
+	}
+
 	// Set the handler
 	server.Addr = fmt.Sprintf(":%d", port)
-	server.Handler, err = system.New(tokens, schema)
+	handler, err := system.NewServer(config)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
+	server.Handler = handler
+	defer handler.Close()
 
 	// The following code should go last and remain unchanged.
 	// Note that you must actually initialize 'server' and 'port'
@@ -60,7 +60,8 @@ func (list *SkipList[K, V]) Find(key K) (*Node[K, V], bool) {
 
 // Inserts a node at key K into the skip list called on, or if the node already
 // exists either updated it or ignores it based on the function check passed
-// by the caller. The value of the given node is also passed in with check.
+// by the caller. The current value of the given node is also passed in with check,
+// and check is called while the node is locked.
 func (list *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (bool, error) {
 	level := GetLevel()
 	var oldVal V
@@ -111,14 +112,12 @@ func (list *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (bool, error)
 				prev = nil
 			} else { // Insert the node
 				node := succs[0]
-				newVal, err := check(key, oldVal, exists)
-				if err != nil {
-					// Return an error if update fails
-					return false, err
+				newVal, err := check(key, node.value, exists)
+				if err == nil {
+					// Update value and time field
+					node.value = newVal
+					node.time.Store(time.Now().UnixMilli())
 				}
-				// Update time field
-				node.value = newVal
-				node.time.Store(time.Now().UnixMilli())
 				// Unlock all predecessors and current node
 				prev = nil
 				for _, pred := range preds {
@@ -129,6 +128,10 @@ func (list *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (bool, error)
 				}
 				prev = nil
 				succs[0].Unlock()
+				if err != nil {
+					// Return an error if update fails
+					return false, err
+				}
 				return true, nil
 			}
 		} else {
@@ -166,6 +169,13 @@ func (list *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (bool, error)
 			} else { // Insert the node
 				newVal, err := check(key, oldVal, exists)
 				if err != nil {
+					prev = nil
+					for idx, pred := range preds {
+						if pred != prev && idx <= level {
+							pred.Unlock()
+						}
+						prev = pred
+					}
 					return false, err
 				}
 				// Construct node ot be inserted
@@ -345,6 +355,34 @@ func (list *SkipList[K, V]) queryHelper(start K, end K) ([]*Node[K, V], bool) {
 	return first, true
 }
 
+// Calls fn on every key value pair in the skip list in key order, stopping
+// early if fn returns false. Nodes inserted or deleted during the walk may
+// or may not be visited.
+func (list *SkipList[K, V]) Range(fn func(key K, value V) bool) {
+	list.walk(list.head.next[0].Load(), fn)
+}
+
+// Calls fn on every key value pair with a key of at least start in key order,
+// stopping early if fn returns false. Like Range, nodes inserted or deleted
+// during the walk may or may not be visited, but every other node is visited
+// exactly once.
+func (list *SkipList[K, V]) RangeFrom(start K, fn func(key K, value V) bool) {
+	_, succs, _ := list.getPredSucc(start)
+	list.walk(succs[0], fn)
+}
+
+// Helper function to Range and RangeFrom that walks the bottom level from node
+func (list *SkipList[K, V]) walk(node *Node[K, V], fn func(key K, value V) bool) {
+	for node != list.tail {
+		if node.fullyLinked.Load() && !node.marked.Load() {
+			if !fn(node.key, node.value) {
+				return
+			}
+		}
+		node = node.next[0].Load()
+	}
+}
+
 // Randomly generates and returns a level for a new node based on
 // a weighted probability
 func GetLevel() int {
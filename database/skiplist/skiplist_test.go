@@ -4,6 +4,7 @@ package skiplist
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"sort"
 	"sync"
 	"testing"
@@ -486,6 +487,41 @@ func TestQuery(t *testing.T) {
 	}
 }
 
+// Tests that Upsert passes the current value to check and releases its locks when check fails.
+func TestUpsertCurrentValue(t *testing.T) {
+	var list SkipList[string, int]
+	list.MakeSkipList()
+	increment := func(key string, currVal int, exists bool) (int, error) {
+		return currVal + 1, nil
+	}
+	for i := 0; i < 3; i++ {
+		list.Upsert("counter", increment)
+	}
+	node, _ := list.Find("counter")
+	if node.GetVal() != 3 {
+		t.Errorf("Expected counter 3 but received %d", node.GetVal())
+	}
+
+	fail := func(key string, currVal int, exists bool) (int, error) {
+		return 0, errors.New("rejected")
+	}
+	success, err := list.Upsert("counter", fail)
+	if success || err == nil {
+		t.Errorf("Expected failed update but received: %t, %v", success, err)
+	}
+	success, err = list.Upsert("other", fail)
+	if success || err == nil {
+		t.Errorf("Expected failed insert but received: %t, %v", success, err)
+	}
+	// Would deadlock if the failed upserts left nodes locked
+	list.Upsert("counter", increment)
+	list.Upsert("other", increment)
+	node, _ = list.Find("counter")
+	if node.GetVal() != 4 {
+		t.Errorf("Expected counter 4 but received %d", node.GetVal())
+	}
+}
+
 // Generates a random string to be used as a key for the skip list.
 func getRandomKey() string {
 	bytes := make([]byte, 5)
@@ -0,0 +1,220 @@
+// Package snapshot reads and writes point-in-time copies of the whole database tree.
+//
+// A snapshot file holds a header line, one wal.Record per database, collection
+// and document (parents before children), and a footer line with a record
+// count and checksum, so a snapshot cut short by a crash is never loaded.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// Version is the version of the snapshot format written by Write.
+const Version = 1
+
+// format identifies snapshot files in their header.
+const format = "owldb-snapshot"
+
+// ext is the file extension of snapshot files.
+const ext = ".snap"
+
+// header is the first line of a snapshot file.
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Seq     uint64 `json:"seq"`
+}
+
+// footer is the last line of a snapshot file.
+type footer struct {
+	End      bool   `json:"end"`
+	Count    int    `json:"count"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// Write durably stores records as the snapshot of the tree after log record seq.
+// The snapshot only becomes visible once it is completely written.
+// Returns the path of the new snapshot file.
+func Write(dir string, seq uint64, records []wal.Record) (string, error) {
+	path := filepath.Join(dir, fileName(seq))
+	tmp, err := os.CreateTemp(dir, "snapshot-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	checksum := crc32.NewIEEE()
+	line, _ := json.Marshal(header{Format: format, Version: Version, Seq: seq})
+	writer.Write(append(line, '\n'))
+	for _, rec := range records {
+		line, err = json.Marshal(rec)
+		if err != nil {
+			return "", err
+		}
+		line = append(line, '\n')
+		checksum.Write(line)
+		writer.Write(line)
+	}
+	line, _ = json.Marshal(footer{End: true, Count: len(records), Checksum: checksum.Sum32()})
+	_, err = writer.Write(append(line, '\n'))
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+// Load applies the records of the newest valid snapshot in dir and returns the
+// sequence number of the last log record it covers. Snapshots that are corrupt
+// or of an unknown version are skipped. Returns 0 if there is no valid snapshot.
+func Load(dir string, apply func(wal.Record) error) (uint64, error) {
+	names, err := list(dir)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, names[i])
+		_, err = read(path, nil)
+		if err != nil {
+			slog.Warn("Skipping invalid snapshot", "file", path, "error", err)
+			continue
+		}
+		return read(path, apply)
+	}
+	return 0, nil
+}
+
+// Prune deletes all but the newest keep snapshots in dir.
+func Prune(dir string, keep int) error {
+	names, err := list(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-keep; i++ {
+		err = os.Remove(filepath.Join(dir, names[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read checks the snapshot file at path and, if apply is not nil, passes each of its records to apply.
+// Returns the sequence number stored in the header.
+func read(path string, apply func(wal.Record) error) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return 0, errors.New("missing header")
+	}
+	var head header
+	err = json.Unmarshal(line, &head)
+	if err != nil || head.Format != format {
+		return 0, errors.New("invalid header")
+	}
+	if head.Version != Version {
+		return 0, fmt.Errorf("unsupported version %d", head.Version)
+	}
+
+	checksum := crc32.NewIEEE()
+	count := 0
+	for {
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF {
+			return 0, errors.New("missing footer")
+		}
+		if err != nil {
+			return 0, err
+		}
+		var foot footer
+		if json.Unmarshal(line, &foot) == nil && foot.End {
+			if foot.Count != count || foot.Checksum != checksum.Sum32() {
+				return 0, errors.New("checksum mismatch")
+			}
+			return head.Seq, nil
+		}
+		checksum.Write(line)
+		count++
+		if apply == nil {
+			continue
+		}
+		var rec wal.Record
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return 0, err
+		}
+		err = apply(rec)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// list returns the names of the snapshot files in dir, oldest first.
+func list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "snapshot-") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		_, err = strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "snapshot-"), ext), 10, 64)
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+	// Names are zero padded, so lexical order is sequence order
+	sort.Strings(names)
+	return names, nil
+}
+
+// fileName returns the name of the snapshot covering the log up to seq.
+func fileName(seq uint64) string {
+	return fmt.Sprintf("snapshot-%020d%s", seq, ext)
+}
+
+// syncDir fsyncs dir so that a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,100 @@
+// Test cases for snapshot.
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// testRecords returns the records of a small tree.
+func testRecords() []wal.Record {
+	return []wal.Record{
+		{Op: wal.OpPut, Path: "db"},
+		{Op: wal.OpPut, Path: "db/doc", Doc: []byte(`{"a":1}`), Meta: &document.Metadata{CreatedBy: "user1"}},
+	}
+}
+
+// load loads the newest snapshot in dir and returns its sequence number and records.
+func load(t *testing.T, dir string) (uint64, []wal.Record) {
+	records := make([]wal.Record, 0)
+	seq, err := Load(dir, func(rec wal.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error loading snapshot: %v", err)
+	}
+	return seq, records
+}
+
+// Tests that a written snapshot is loaded back with the same records.
+func TestWriteLoad(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Write(dir, 7, testRecords())
+	if err != nil {
+		t.Fatalf("unexpected error writing snapshot: %v", err)
+	}
+	seq, records := load(t, dir)
+	if seq != 7 {
+		t.Errorf("expected sequence 7, got %d", seq)
+	}
+	if len(records) != 2 || records[1].Path != "db/doc" || records[1].Meta.CreatedBy != "user1" {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
+
+// Tests that Load returns 0 when there is no snapshot.
+func TestLoadEmpty(t *testing.T) {
+	seq, records := load(t, t.TempDir())
+	if seq != 0 || len(records) != 0 {
+		t.Errorf("expected no snapshot, got %d with %d records", seq, len(records))
+	}
+}
+
+// Tests that a truncated or tampered snapshot is skipped in favor of an older valid one.
+func TestLoadSkipsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	Write(dir, 3, testRecords())
+	path, _ := Write(dir, 5, testRecords())
+
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-10], 0644)
+	seq, _ := load(t, dir)
+	if seq != 3 {
+		t.Errorf("expected the truncated snapshot to be skipped, got %d", seq)
+	}
+
+	data[len(data)/2] ^= 1
+	os.WriteFile(path, data, 0644)
+	seq, _ = load(t, dir)
+	if seq != 3 {
+		t.Errorf("expected the tampered snapshot to be skipped, got %d", seq)
+	}
+}
+
+// Tests that snapshots of an unknown version are skipped.
+func TestLoadUnknownVersion(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, fileName(9)), []byte(`{"format":"owldb-snapshot","version":99,"seq":9}`+"\n"+`{"end":true,"count":0,"checksum":0}`+"\n"), 0644)
+	seq, _ := load(t, dir)
+	if seq != 0 {
+		t.Errorf("expected the unknown version to be skipped, got %d", seq)
+	}
+}
+
+// Tests that Prune keeps only the newest snapshots.
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	for _, seq := range []uint64{1, 2, 3} {
+		Write(dir, seq, testRecords())
+	}
+	Prune(dir, 1)
+	names, _ := list(dir)
+	if len(names) != 1 || names[0] != fileName(3) {
+		t.Errorf("expected only the newest snapshot to remain, got %v", names)
+	}
+}
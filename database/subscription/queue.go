@@ -0,0 +1,157 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is the number of messages queued for a subscriber when no size is configured.
+const DefaultQueueSize = 256
+
+// Policy determines what happens when a message is sent to a subscriber whose queue is full.
+type Policy int
+
+const (
+	DropOldest Policy = iota // drop the oldest queued message
+	Disconnect               // disconnect the subscriber
+	Coalesce                 // keep only the latest message for each changed path, then drop the oldest
+)
+
+// ErrTooSlow is the error of subscriptions that were disconnected because their queue was full.
+var ErrTooSlow = errors.New("subscriber disconnected: too many undelivered events")
+
+// ErrExpired is the error of subscriptions that were closed by Expire because their token expired.
+var ErrExpired = errors.New("subscriber disconnected: token expired")
+
+// ErrForbidden is the error of subscriptions that were closed by Revoke because they may no longer see their path.
+var ErrForbidden = errors.New("subscriber disconnected: permission denied")
+
+// ParsePolicy converts the -queue-policy flag value (drop-oldest, disconnect or coalesce) into a Policy.
+func ParsePolicy(policy string) (Policy, error) {
+	switch policy {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "coalesce":
+		return Coalesce, nil
+	}
+	return DropOldest, fmt.Errorf("unknown queue policy %q: must be drop-oldest, disconnect or coalesce", policy)
+}
+
+// Metrics counts the messages sent to subscribers.
+type Metrics struct {
+	Subscribers  int64  `json:"subscribers"`  // current subscriptions
+	Queued       uint64 `json:"queued"`       // messages queued for delivery
+	Dropped      uint64 `json:"dropped"`      // messages dropped from full queues
+	Coalesced    uint64 `json:"coalesced"`    // messages replaced by a later message for the same path
+	Disconnected uint64 `json:"disconnected"` // subscriptions disconnected because their queue was full
+}
+
+// counters holds the running counts behind Metrics.
+type counters struct {
+	subscribers  atomic.Int64
+	queued       atomic.Uint64
+	dropped      atomic.Uint64
+	coalesced    atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// queued is a message waiting to be delivered to a subscriber.
+type queued struct {
+	msg Message
+	key string // path of the change, empty if the message must not be coalesced
+}
+
+// Metrics returns the current counts of s.
+func (s *Subscribers) Metrics() Metrics {
+	return Metrics{
+		Subscribers:  s.counters.subscribers.Load(),
+		Queued:       s.counters.queued.Load(),
+		Dropped:      s.counters.dropped.Load(),
+		Coalesced:    s.counters.coalesced.Load(),
+		Disconnected: s.counters.disconnected.Load(),
+	}
+}
+
+// Ready returns a channel that receives a value when messages are waiting in the queue of sub.
+func (sub *Subscription) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Drain removes and returns the messages waiting in the queue of sub, oldest first.
+func (sub *Subscription) Drain() []Message {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	msgs := make([]Message, len(sub.queue))
+	for i, q := range sub.queue {
+		msgs[i] = q.msg
+	}
+	sub.queue = nil
+	return msgs
+}
+
+// Err returns ErrTooSlow if sub was disconnected because its queue was full, or nil.
+func (sub *Subscription) Err() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.err
+}
+
+// enqueue adds msgs about the change at key to the queue of sub without waiting for the subscriber,
+// applying the policy of s when the queue is full.
+func (s *Subscribers) enqueue(sub *Subscription, msgs []Message, key string) {
+	if len(msgs) == 0 {
+		return
+	}
+	sub.mu.Lock()
+	if sub.err != nil {
+		sub.mu.Unlock()
+		return
+	}
+	for _, msg := range msgs {
+		if len(sub.queue) >= s.queueSize {
+			switch s.policy {
+			case Disconnect:
+				sub.err = ErrTooSlow
+				sub.mu.Unlock()
+				s.counters.disconnected.Add(1)
+				s.Unsubscribe(sub)
+				return
+			case Coalesce:
+				sub.coalesce(key, s.counters)
+			}
+		}
+		if len(sub.queue) >= s.queueSize {
+			sub.queue = sub.queue[1:]
+			s.counters.dropped.Add(1)
+		}
+		sub.queue = append(sub.queue, queued{msg: msg, key: key})
+		s.counters.queued.Add(1)
+	}
+	sub.mu.Unlock()
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+		// the subscriber has not yet been told about earlier messages
+	}
+}
+
+// coalesce removes the queued messages about the change at key, which a new message replaces.
+// The caller must hold sub.mu.
+func (sub *Subscription) coalesce(key string, c *counters) {
+	if key == "" {
+		return
+	}
+	kept := sub.queue[:0]
+	for _, q := range sub.queue {
+		if q.key == key {
+			c.coalesced.Add(1)
+			continue
+		}
+		kept = append(kept, q)
+	}
+	sub.queue = kept
+}
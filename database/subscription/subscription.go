@@ -7,17 +7,21 @@
 package subscription
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
-	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
 	"log/slog"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filter"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
 )
 
 // writeFlusher combines http.ResponseWriter and http.Flusher interfaces.
@@ -27,62 +31,398 @@ type writeFlusher interface {
 	http.Flusher
 }
 
+// historyLength is the number of recent events kept for each subscribed path,
+// which reconnecting subscribers can replay.
+const historyLength = 256
+
+// keepAliveInterval is how often an idle stream is written to, so that the connection stays open.
+var keepAliveInterval = 15 * time.Second
+
+// HistoryRetention is how long the recent events of a path are kept once it has no subscribers,
+// so that subscribers reconnecting within that time can replay them.
+const HistoryRetention = 10 * time.Minute
+
 // Subscribers type manages the skip list of subscribers.
-// It contains a skip list mapping URLs to channels.
+// It contains a skip list mapping URLs to their subscribers and recent events.
 type Subscribers struct {
 	// key: the url
-	// value: the struct containing channel mapping to range
-	content skiplist.SkipList[string, map[chan string]string]
+	// value: the subscribers of the url and its recent events
+	content skiplist.SkipList[string, *topic]
+	// lastID is the ID of the most recent event. IDs start from the time the Subscribers
+	// were created in microseconds, so that IDs from before a restart are older than any new one.
+	lastID *atomic.Uint64
+
+	queueSize int    // number of messages queued for each subscriber
+	policy    Policy // what to do when a subscriber's queue is full
+	counters  *counters
+}
+
+// Options holds what a subscriber asked to be notified about.
+type Options struct {
+	Bound  string         // range of document names, such as "[a,b]"
+	Filter *filter.Filter // filter documents must match, nil for all documents
+	// Subtree subscribers are notified of changes anywhere beneath the subscribed path,
+	// including the path itself, with the changed path in a Change.
+	Subtree bool
+	// Token is the bearer token the subscriber authenticated with, which Expire checks.
+	// Subscriptions without a token never expire.
+	Token string
+	// Allowed reports whether the subscriber may see the change at path, which starts with /v1/.
+	// It is checked for every event, so that subtree subscribers are not sent changes they cannot
+	// read, and by Revoke. It is called while the notifier holds whatever lock guards the change.
+	// Subscriptions without it are sent every change.
+	Allowed func(path string) bool
+}
+
+// Change is the data of the events sent to subtree subscribers.
+type Change struct {
+	Path string          `json:"path"` // path of the changed file starting with /v1/
+	Data json.RawMessage `json:"data"`
+}
+
+// event is a change that was sent to the subscribers of a path.
+type event struct {
+	id    uint64
+	name  string
+	data  []byte
+	path  string // path where the change occurred
+	check bool   // whether subscribers' bounds and filters apply to data
+	db    bool   // whether data is a list of documents
+	// subtree events are changes beneath the path, sent to subtree subscribers only
+	subtree bool
+}
+
+// Message is a notification sent to a subscriber.
+type Message struct {
+	Event string // type of the event, such as "update" or "delete"
+	Data  []byte // JSON data of the event
+	ID    uint64
+}
+
+// EventStream formats m as a server-sent event.
+func (m Message) EventStream() string {
+	return fmt.Sprintf("event: %s\ndata: %s\nid: %d\n\n", m.Event, string(m.Data), m.ID)
+}
+
+// Subscription is a subscriber registered with Subscribe. Its messages are queued, so that
+// sending never waits for the subscriber, and taken with Drain whenever Ready receives,
+// until the subscription is passed to Unsubscribe or disconnected because it is too slow.
+type Subscription struct {
+	mu    sync.Mutex
+	queue []queued
+	err   error
+	ready chan struct{}
+	done  chan struct{}
+	path  string
+	opts  Options
+}
+
+// Done returns a channel that is closed once s is unsubscribed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// topic holds the subscribers of a path and a ring buffer of its most recent events.
+type topic struct {
+	mu      sync.Mutex
+	subs    map[*Subscription]bool
+	events  []event // oldest event at index start once full
+	start   int
+	since   uint64    // events with IDs up to since may be missing from events
+	idle    time.Time // when the last subscriber left
+	removed bool      // whether Prune removed the topic, which must then be created again
 }
 
 // New creates and initializes a new Subscribers object.
 // Returns a new instance of the Subscribers type.
 func New() Subscribers {
-	var list skiplist.SkipList[string, map[chan string]string]
+	return NewWithQueue(DefaultQueueSize, DropOldest)
+}
+
+// NewWithQueue creates a new Subscribers object that queues up to size messages for each
+// subscriber and applies policy when a queue is full. A size of zero uses DefaultQueueSize.
+func NewWithQueue(size int, policy Policy) Subscribers {
+	var list skiplist.SkipList[string, *topic]
 	list.MakeSkipList()
+	lastID := new(atomic.Uint64)
+	lastID.Store(uint64(time.Now().UnixMicro()))
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
 	return Subscribers{
-		content: list,
+		content:   list,
+		lastID:    lastID,
+		queueSize: size,
+		policy:    policy,
+		counters:  new(counters),
 	}
 }
 
+// topic returns the topic of path, creating it if it does not exist.
+func (s *Subscribers) topic(path string) *topic {
+	var t *topic
+	check := func(key string, currVal *topic, exists bool) (*topic, error) {
+		if exists {
+			t = currVal
+		} else {
+			t = &topic{subs: make(map[*Subscription]bool), since: s.lastID.Load()}
+		}
+		return t, nil
+	}
+	success, _ := s.content.Upsert(path, check)
+	if !success {
+		slog.Error("Adding channel map failed")
+	}
+	return t
+}
+
+// record adds e to the history of t, replacing the oldest event once the history is full.
+// The caller must hold t.mu.
+func (t *topic) record(e event) {
+	if len(t.events) < historyLength {
+		t.events = append(t.events, e)
+		return
+	}
+	t.since = t.events[t.start].id
+	t.events[t.start] = e
+	t.start = (t.start + 1) % historyLength
+}
+
+// after returns the recorded events with IDs greater than id, oldest first.
+// The caller must hold t.mu.
+func (t *topic) after(id uint64) []event {
+	var events []event
+	for i := range t.events {
+		e := t.events[(t.start+i)%len(t.events)]
+		if e.id > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Subscribe registers a subscriber to the changes at path, which starts with /v1/ and ends
+// in a slash for databases and collections, as described by opts. If lastEventID is not empty,
+// the messages after that ID are returned to be sent first, or a reset message if they are no
+// longer available. The subscription is registered and the missed messages collected at once,
+// so that none is lost or sent twice.
+func (s *Subscribers) Subscribe(path string, opts Options, lastEventID string) (*Subscription, []Message) {
+	sub := &Subscription{ready: make(chan struct{}, 1), done: make(chan struct{}), path: path, opts: opts}
+	s.counters.subscribers.Add(1)
+
+	t := s.topic(path)
+	t.mu.Lock()
+	for t.removed {
+		t.mu.Unlock()
+		t = s.topic(path)
+		t.mu.Lock()
+	}
+	defer t.mu.Unlock()
+	var replay []Message
+	t.subs[sub] = true
+	if lastEventID != "" {
+		lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+		latest := s.lastID.Load()
+		if err != nil || lastID < t.since || lastID > latest {
+			data, _ := json.Marshal("events since the last event ID are no longer available")
+			replay = append(replay, Message{Event: "reset", Data: data, ID: latest})
+		} else {
+			for _, e := range t.after(lastID) {
+				replay = append(replay, messages(e, sub.opts)...)
+			}
+		}
+	}
+	return sub, replay
+}
+
+// Unsubscribe stops sending messages to sub.
+func (s *Subscribers) Unsubscribe(sub *Subscription) {
+	node, exists := s.content.Find(sub.path)
+	if !exists {
+		return
+	}
+	t := node.GetVal()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subs[sub] {
+		delete(t.subs, sub)
+		close(sub.done)
+		s.counters.subscribers.Add(-1)
+		if len(t.subs) == 0 {
+			t.idle = time.Now()
+		}
+	}
+}
+
+// Prune removes the paths that have had no subscribers for longer than idle, along with their
+// recent events, so that paths nobody subscribes to any more are not kept forever. Subscribers
+// reconnecting to a removed path with a last event ID are sent a reset event.
+// Returns the number of paths removed.
+func (s *Subscribers) Prune(idle time.Duration) int {
+	paths := make([]string, 0)
+	s.content.Range(func(path string, t *topic) bool {
+		paths = append(paths, path)
+		return true
+	})
+	removed := 0
+	for _, path := range paths {
+		node, exists := s.content.Find(path)
+		if !exists {
+			continue
+		}
+		t := node.GetVal()
+		t.mu.Lock()
+		// Subscribe waits for the lock and creates the topic again once it is marked removed
+		if len(t.subs) == 0 && time.Since(t.idle) > idle {
+			t.removed = true
+			s.content.Delete(path)
+			removed++
+		}
+		t.mu.Unlock()
+	}
+	return removed
+}
+
+// Expire closes the subscriptions whose token is no longer valid, as reported by valid,
+// which is called without holding any lock. Their streams end with an expired event.
+// Returns the number of subscriptions closed.
+func (s *Subscribers) Expire(valid func(token string) bool) int {
+	subs := make([]*Subscription, 0)
+	s.content.Range(func(path string, t *topic) bool {
+		t.mu.Lock()
+		for sub := range t.subs {
+			if sub.opts.Token != "" {
+				subs = append(subs, sub)
+			}
+		}
+		t.mu.Unlock()
+		return true
+	})
+	expired := 0
+	for _, sub := range subs {
+		if valid(sub.opts.Token) {
+			continue
+		}
+		sub.mu.Lock()
+		if sub.err == nil {
+			sub.err = ErrExpired
+		}
+		sub.mu.Unlock()
+		s.Unsubscribe(sub)
+		expired++
+	}
+	return expired
+}
+
+// Revoke closes the subscriptions to prefix and the paths beneath it that may no longer see
+// their path, as reported by their Allowed, such as after the permissions on prefix changed.
+// It must be called while holding the lock that Allowed expects. Their streams end with a
+// forbidden event. Returns the number of subscriptions closed.
+func (s *Subscribers) Revoke(prefix string) int {
+	subs := make([]*Subscription, 0)
+	s.content.Range(func(path string, t *topic) bool {
+		if !strings.HasPrefix(path, prefix) {
+			return true
+		}
+		t.mu.Lock()
+		for sub := range t.subs {
+			if sub.opts.Allowed != nil {
+				subs = append(subs, sub)
+			}
+		}
+		t.mu.Unlock()
+		return true
+	})
+	revoked := 0
+	for _, sub := range subs {
+		if sub.opts.Allowed(sub.path) {
+			continue
+		}
+		sub.mu.Lock()
+		if sub.err == nil {
+			sub.err = ErrForbidden
+		}
+		sub.mu.Unlock()
+		s.Unsubscribe(sub)
+		revoked++
+	}
+	return revoked
+}
+
 // Serve manages the subscription process and set up channel to listen.
 // w is the HTTP response writer.
 // r is the incoming HTTP request.
 // wg is a wait group that helps manage goroutines.
 // bound specifies the range for which the subscription should occur.
+// Only documents matching the request's filter query parameter, if any, are sent, and an
+// invalid filter is answered with 400 Bad Request.
+// With the depth=all query parameter, changes anywhere beneath the path are sent.
+// If the request has a Last-Event-ID header, the events after that ID are replayed first,
+// or a reset event is sent if they are no longer available.
 func (s *Subscribers) Serve(w http.ResponseWriter, r *http.Request, wg *sync.WaitGroup, bound string) {
-	// create channel
-	channel := make(chan string)
-	defer close(channel)
+	var filt *filter.Filter
+	if r.URL.Query().Has("filter") {
+		var err error
+		filt, err = filter.Parse(r.URL.Query().Get("filter"))
+		if err != nil {
+			data, _ := json.Marshal(err.Error())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(data)
+			if wg != nil {
+				wg.Done()
+			}
+			return
+		}
+	}
+	opts := Options{Bound: bound, Filter: filt, Subtree: r.URL.Query().Get("depth") == "all"}
+	sub, replay := s.Subscribe(r.URL.Path, opts, r.Header.Get("Last-Event-ID"))
+	s.stream(w, r, sub, replay, wg)
+}
 
-	path := r.URL.Path
+// Stream sends the initial messages and then the messages of sub as server-sent events,
+// until the client closes the connection or sub is disconnected. sub is unsubscribed when
+// Stream returns.
+func (s *Subscribers) Stream(w http.ResponseWriter, r *http.Request, sub *Subscription, initial []Message) {
+	s.stream(w, r, sub, initial, nil)
+}
 
-	var chanRangeNew map[chan string]string
-	val, exists := s.content.Find(path)
-	if exists {
-		chanRangeNew = val.GetVal()
-		chanRangeNew[channel] = bound
+// Snapshot returns the current state of the path of sub as update messages, given data, the
+// response to a GET of the path: the document, or the documents of a database or collection.
+// The messages have the ID of the most recent event, so that the snapshot can be taken
+// atomically with Subscribe.
+func (s *Subscribers) Snapshot(sub *Subscription, data []byte) []Message {
+	id := s.lastID.Load()
+	if !strings.HasSuffix(sub.path, "/") {
+		return []Message{snapshotMessage(sub, sub.path, data, id)}
 	}
-
-	check := func(key string, currVal map[chan string]string, exists bool) (newValue map[chan string]string, err error) {
-		if !exists {
-			// add map to skiplist
-			chanRange := make(map[chan string]string)
-			chanRange[channel] = bound
-			return chanRange, nil
+	var docs []document.DocumentContent
+	err := json.Unmarshal(data, &docs)
+	if err != nil {
+		slog.Error("Failed to unmarshal documents", "error", err)
+	}
+	msgs := make([]Message, 0, len(docs))
+	for _, d := range docs {
+		content, err := json.Marshal(d)
+		if err != nil {
+			slog.Error("Failed to marshal document", "error", err)
 		}
-		return chanRangeNew, nil
+		msgs = append(msgs, snapshotMessage(sub, sub.path+filepath.Base(d.Path), content, id))
 	}
-	success, _ := s.content.Upsert(path, check)
-	if !success {
-		slog.Error("Adding channel map failed")
+	return msgs
+}
+
+// snapshotMessage returns the update message for sub about the document at path with content data.
+func snapshotMessage(sub *Subscription, path string, data []byte, id uint64) Message {
+	if sub.opts.Subtree {
+		data, _ = json.Marshal(Change{Path: path, Data: data})
 	}
+	return Message{Event: "update", Data: data, ID: id}
+}
 
-	defer func() {
-		val, _ := s.content.Find(path)
-		chanRange := val.GetVal()
-		delete(chanRange, channel)
-	}()
+// stream implements Stream, calling wg.Done, if wg is not nil, once the initial messages were sent.
+func (s *Subscribers) stream(w http.ResponseWriter, r *http.Request, sub *Subscription, initial []Message, wg *sync.WaitGroup) {
+	defer s.Unsubscribe(sub)
 
 	// Convert ResponseWriter to a writeFlusher
 	wf, ok := w.(writeFlusher)
@@ -103,12 +443,16 @@ func (s *Subscribers) Serve(w http.ResponseWriter, r *http.Request, wg *sync.Wai
 	wf.Flush()
 
 	slog.Info("Sent headers")
+	for _, msg := range initial {
+		wf.Write([]byte(msg.EventStream()))
+	}
+	wf.Flush()
 	var first bool = true
-	ticker := time.NewTicker(15 * time.Second)
+	ticker := time.NewTicker(keepAliveInterval)
 	defer ticker.Stop()
 	// Run forever
 	for {
-		if first {
+		if first && wg != nil {
 			wg.Done()
 			first = false
 		}
@@ -122,13 +466,30 @@ func (s *Subscribers) Serve(w http.ResponseWriter, r *http.Request, wg *sync.Wai
 			// client closed connection
 			slog.Info("Client closed connection")
 			return
-		case upd := <-channel:
+		case <-sub.Done():
+			// disconnected for being too slow, because the token expired or because access was revoked
+			slog.Info("Subscriber disconnected", "error", sub.Err())
+			if errors.Is(sub.Err(), ErrExpired) {
+				// Deliver what was queued before the token expired
+				for _, msg := range sub.Drain() {
+					wf.Write([]byte(msg.EventStream()))
+				}
+				data, _ := json.Marshal("token expired")
+				wf.Write([]byte(fmt.Sprintf("event: expired\ndata: %s\n\n", data)))
+				wf.Flush()
+			}
+			if errors.Is(sub.Err(), ErrForbidden) {
+				data, _ := json.Marshal("permission denied")
+				wf.Write([]byte(fmt.Sprintf("event: forbidden\ndata: %s\n\n", data)))
+				wf.Flush()
+			}
+			return
+		case <-sub.Ready():
 			// send updates
-			var evt bytes.Buffer
-			evt.WriteString(upd)
 			slog.Info("Sending msg")
-			// Send event
-			wf.Write(evt.Bytes())
+			for _, msg := range sub.Drain() {
+				wf.Write([]byte(msg.EventStream()))
+			}
 			wf.Flush()
 		}
 	}
@@ -144,13 +505,7 @@ func (s *Subscribers) Notify(notifyPath string, event string, data []byte) {
 	if strings.HasSuffix(urlPath, "/") {
 		node, exist := s.content.Find(urlPath)
 		if exist {
-			val := node.GetVal()
-			if strings.HasPrefix(string(data), "\"/") {
-				s.send(event, data, urlPath, val, false, false)
-			} else {
-				s.send(event, data, urlPath, val, false, true)
-			}
-
+			s.send(event, data, urlPath, node.GetVal(), false, !strings.HasPrefix(string(data), "\"/"), false)
 		}
 
 	} else {
@@ -161,65 +516,140 @@ func (s *Subscribers) Notify(notifyPath string, event string, data []byte) {
 		colPath = strings.ReplaceAll(colPath, "\\", "/")
 		node1, existColSub := s.content.Find(colPath)
 		if existColSub {
-			val := node1.GetVal()
-			s.send(event, data, urlPath, val, true, false)
+			s.send(event, data, urlPath, node1.GetVal(), true, false, false)
 		}
 
 		// check if the document has subsribers:
 		node2, existDocSub := s.content.Find(urlPath)
 		if existDocSub {
-			val := node2.GetVal()
-			s.send(event, data, urlPath, val, false, false)
+			s.send(event, data, urlPath, node2.GetVal(), false, false, false)
 		}
 
 	}
+	s.notifySubtree(urlPath, event, data)
 	return
 }
 
-// send is an internal function responsible for sending notifications to the subscribers.
-// event is a string indicating the type of the event.
+// notifySubtree sends the change at urlPath to the subtree subscribers of urlPath and its ancestors.
+// The contents of a database or collection, which are sent when it is created or subscribed to,
+// are only sent to the subscribers of its ancestors.
+func (s *Subscribers) notifySubtree(urlPath string, event string, data []byte) {
+	listing := strings.HasSuffix(urlPath, "/") && !strings.HasPrefix(string(data), "\"/")
+	paths := strings.Split(strings.Trim(strings.TrimPrefix(urlPath, "/v1/"), "/"), "/")
+	for i := 1; i <= len(paths); i++ {
+		if i == len(paths) && listing {
+			break
+		}
+		// databases and collections are at odd depths
+		key := "/v1/" + strings.Join(paths[:i], "/")
+		if i%2 == 1 {
+			key += "/"
+		}
+		node, exist := s.content.Find(key)
+		if exist {
+			s.send(event, data, urlPath, node.GetVal(), false, false, true)
+		}
+	}
+}
+
+// send is an internal function responsible for recording an event and sending notifications to the subscribers.
+// name is a string indicating the type of the event.
 // data contains the data that is associated with the event.
 // path indicates the path where the change occurred.
-// chanRange is a map from channels to their associated ranges.
+// t is the topic of the subscribed path.
 // check is a flag that determines if the range should be checked before sending a notification.
 // db is a flag that indicates if the data contains database entries or documents.
-func (s *Subscribers) send(event string, data []byte, path string, chanRange map[chan string]string, check bool, db bool) {
-	id := time.Now().UnixMilli()
-	for subsChan := range chanRange {
-		// check if the document is within subscription bound
-		if check {
-			bound := chanRange[subsChan]
-			low := bound[1:strings.Index(bound, ",")]
-			fmt.Println(low)
-			up := bound[strings.Index(bound, ",")+1 : len(bound)-1]
-			fmt.Println(up)
-			pathTrimmed := strings.Trim(path, "/")
-			paths := strings.Split(pathTrimmed, "/")
-			fileName := paths[len(paths)-1]
-			fmt.Println(paths)
-			fmt.Println(fileName)
-			if (low == "" || strings.Compare(fileName, low) >= 0) && (up == "" || strings.Compare(fileName, up) <= 0) {
-				subsChan <- fmt.Sprintf("event: %s\ndata: %s\nid: %d\n\n", event, string(data), id)
-			}
-		} else if db {
-			// divide db to several docs
-			var dat []document.DocumentContent
+// subtree is a flag that indicates if the change is sent to subtree subscribers instead.
+func (s *Subscribers) send(name string, data []byte, path string, t *topic, check bool, db bool, subtree bool) {
+	// IDs are taken under the lock so that each topic records them in increasing order
+	t.mu.Lock()
+	e := event{id: s.lastID.Add(1), name: name, data: data, path: path, check: check, db: db, subtree: subtree}
+	t.record(e)
+	subs := make([]*Subscription, 0, len(t.subs))
+	for sub := range t.subs {
+		subs = append(subs, sub)
+	}
+	t.mu.Unlock()
 
-			err := json.Unmarshal([]byte(data), &dat)
-			if err != nil {
-				slog.Error("error:", err)
-			}
+	// Messages are queued, so that the writer never waits for a subscriber
+	key := path
+	if db {
+		key = ""
+	}
+	for _, sub := range subs {
+		s.enqueue(sub, messages(e, sub.opts), key)
+	}
+}
 
-			for _, d := range dat {
-				content, err := json.Marshal(d)
-				if err != nil {
-					slog.Error("error:", err)
-				}
-				subsChan <- fmt.Sprintf("event: %s\ndata: %s\nid: %d\n\n", event, string(content), id)
+// messages returns the messages that a subscriber with opts receives for e.
+func messages(e event, opts Options) []Message {
+	var msgs []Message
+	if e.subtree != opts.Subtree {
+		return nil
+	}
+	if opts.Allowed != nil && !opts.Allowed(e.path) {
+		return nil
+	}
+	if e.subtree {
+		if !matches(opts.Filter, e.data) {
+			return nil
+		}
+		content, err := json.Marshal(Change{Path: e.path, Data: e.data})
+		if err != nil {
+			slog.Error("Failed to marshal change", "error", err)
+		}
+		return append(msgs, Message{Event: e.name, Data: content, ID: e.id})
+	}
+	// check if the document is within subscription bound
+	if e.check {
+		if !matches(opts.Filter, e.data) {
+			return nil
+		}
+		bound := opts.Bound
+		low := bound[1:strings.Index(bound, ",")]
+		up := bound[strings.Index(bound, ",")+1 : len(bound)-1]
+		pathTrimmed := strings.Trim(e.path, "/")
+		paths := strings.Split(pathTrimmed, "/")
+		fileName := paths[len(paths)-1]
+		if (low == "" || strings.Compare(fileName, low) >= 0) && (up == "" || strings.Compare(fileName, up) <= 0) {
+			msgs = append(msgs, Message{Event: e.name, Data: e.data, ID: e.id})
+		}
+	} else if e.db {
+		// divide db to several docs
+		var dat []document.DocumentContent
+
+		err := json.Unmarshal(e.data, &dat)
+		if err != nil {
+			slog.Error("Failed to unmarshal documents", "error", err)
+		}
+
+		for _, d := range dat {
+			if opts.Filter != nil && !opts.Filter.Match(d.Doc) {
+				continue
 			}
-		} else {
-			// send content directly
-			subsChan <- fmt.Sprintf("event: %s\ndata: %s\nid: %d\n\n", event, string(data), id)
+			content, err := json.Marshal(d)
+			if err != nil {
+				slog.Error("Failed to marshal document", "error", err)
+			}
+			msgs = append(msgs, Message{Event: e.name, Data: content, ID: e.id})
 		}
+	} else if matches(opts.Filter, e.data) {
+		// send content directly
+		msgs = append(msgs, Message{Event: e.name, Data: e.data, ID: e.id})
+	}
+	return msgs
+}
+
+// matches reports whether the document in data matches filt.
+// Data that is not a document, such as the path sent when a document is deleted, always matches.
+func matches(filt *filter.Filter, data []byte) bool {
+	if filt == nil {
+		return true
+	}
+	var content document.DocumentContent
+	err := json.Unmarshal(data, &content)
+	if err != nil || content.Doc == nil {
+		return true
 	}
+	return filt.Match(content.Doc)
 }
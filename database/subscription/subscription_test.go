@@ -3,14 +3,97 @@ package subscription
 
 import (
 	"context"
-	"io"
+	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
+// recorder is a response writer for streams that can be read while they are written.
+type recorder struct {
+	mu      sync.Mutex
+	header  http.Header
+	body    strings.Builder
+	written chan struct{} // receives after each write
+}
+
+// newRecorder creates an empty recorder.
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header), written: make(chan struct{}, 1)}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.body.Write(data)
+	select {
+	case r.written <- struct{}{}:
+	default:
+	}
+	return len(data), nil
+}
+
+func (r *recorder) WriteHeader(status int) {}
+
+func (r *recorder) Flush() {}
+
+// Body returns what was written so far.
+func (r *recorder) Body() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.body.String()
+}
+
+// waitFor waits until the body contains every string in expected and returns it, or fails the test.
+func (r *recorder) waitFor(t *testing.T, expected ...string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		body := r.Body()
+		missing := false
+		for _, e := range expected {
+			missing = missing || !strings.Contains(body, e)
+		}
+		if !missing {
+			return body
+		}
+		select {
+		case <-r.written:
+		case <-timeout:
+			t.Fatalf("Expected %q in %s", expected, body)
+		}
+	}
+}
+
+// serve streams the events of req to a new recorder with Serve, once the subscriber is registered.
+// The returned function ends the stream and waits for Serve to return, which also happens when
+// the test ends.
+func serve(t *testing.T, subscribers *Subscribers, req *http.Request, bound string) (*recorder, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	w := newRecorder()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		subscribers.Serve(w, req.WithContext(ctx), wg, bound)
+		close(done)
+	}()
+	wg.Wait()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return w, stop
+}
+
 // TestNew checks if a new subscriber instance is created.
 func TestNew(t *testing.T) {
 	subscribers := New()
@@ -25,25 +108,12 @@ func TestNew(t *testing.T) {
 func TestServeAndNotify(t *testing.T) {
 	subscribers := New()
 	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w := httptest.NewRecorder()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	go subscribers.Serve(w, req, wg, "[,]")
-	wg.Wait()
+	w, _ := serve(t, &subscribers, req, "[,]")
 
 	testData := []byte(`{"key":"value"}`)
 	subscribers.Notify(req.URL.Path+"testData", "test-event", testData)
 
-	time.Sleep(1 * time.Second)
-
-	response := w.Result()
-	defer response.Body.Close()
-
-	body, _ := io.ReadAll(response.Body)
-	if !strings.Contains(string(body), `{"key":"value"}`) {
-		t.Fatal("Expected notification data not found in the response")
-	}
+	w.waitFor(t, `{"key":"value"}`)
 }
 
 // TestNotifyWithNoSubscriber ensures the system handles notifications when no subscribers are present.
@@ -57,89 +127,45 @@ func TestNotifyWithNoSubscriber(t *testing.T) {
 func TestNotifyDocumentRange(t *testing.T) {
 	subscribers := New()
 	req := httptest.NewRequest("PUT", "/v1/testcollection?mode=subscribe", nil)
-	w := httptest.NewRecorder()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	go subscribers.Serve(w, req, wg, "[doc1,doc5]")
-	wg.Wait()
+	w, _ := serve(t, &subscribers, req, "[doc1,doc5]")
 
 	testData := []byte(`{"docKey":"doc3"}`)
 	subscribers.Notify(req.URL.Path, "test-event", testData)
 
-	time.Sleep(1 * time.Second)
-
-	response := w.Result()
-	defer response.Body.Close()
-
-	body, _ := io.ReadAll(response.Body)
-
-	if !strings.Contains(string(body), `{"docKey":"doc3"}`) {
-		t.Fatal("Expected notification data for doc3 not found in the response")
-	}
+	w.waitFor(t, `{"docKey":"doc3"}`)
 }
 
 // TestMultipleSubscribersForSingleDocument ensures all subscribers receive notifications for a shared document.
 func TestMultipleSubscribersForSingleDocument(t *testing.T) {
 	subscribers := New()
 
-	// create two subscribers
-	// one subscribing to doc
-	req1 := httptest.NewRequest("PUT", "/v1/testpath/doc1?mode=subscribe", nil)
-	w1 := httptest.NewRecorder()
-	wg1 := &sync.WaitGroup{}
-	wg1.Add(1)
-
-	// one subscribing to db
-	req2 := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w2 := httptest.NewRecorder()
-	wg2 := &sync.WaitGroup{}
-	wg2.Add(1)
-
-	go subscribers.Serve(w1, req1, wg1, "[,]")
-	go subscribers.Serve(w2, req2, wg2, "[,]")
-
-	wg1.Wait()
-	wg2.Wait()
+	// one subscribing to doc and one to db
+	w1, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/doc1?mode=subscribe", nil), "[,]")
+	w2, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[,]")
 
 	// send one notification
 	testData := []byte(`{"key":"value"}`)
 	go subscribers.Notify("/v1/testpath/doc1", "test-event", testData)
 
-	time.Sleep(1 * time.Second)
-
 	// check if both subscribers received the notification
-	body1, _ := io.ReadAll(w1.Result().Body)
-	body2, _ := io.ReadAll(w2.Result().Body)
-
-	if !strings.Contains(string(body1), `{"key":"value"}`) || !strings.Contains(string(body2), `{"key":"value"}`) {
-		t.Fatal("One or both subscribers did not receive the expected notification")
-	}
+	w1.waitFor(t, `{"key":"value"}`)
+	w2.waitFor(t, `{"key":"value"}`)
 }
 
 // TestBoundaryRangeTest ensures notifications are received only for documents within the range.
 func TestBoundaryRangeTest(t *testing.T) {
 	subscribers := New()
-	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w := httptest.NewRecorder()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	go subscribers.Serve(w, req, wg, "[doc1,doc5]")
-	wg.Wait()
+	w, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[doc1,doc5]")
 
 	outRangeData := []byte(`{"docKey":"doc6"}`)
 	subscribers.Notify("/v1/testpath/doc6", "test-event", outRangeData)
 	rangeData := []byte(`{"docKey":"doc4"}`)
 	subscribers.Notify("/v1/testpath/doc4", "test-event", rangeData)
 
-	time.Sleep(1 * time.Second)
-
-	response := w.Result()
-	body, _ := io.ReadAll(response.Body)
-
-	if strings.Contains(string(body), `{"docKey":"doc6"}`) || !strings.Contains(string(body), `{"docKey":"doc4"}`) {
-		t.Fatal("Received notification for a document outside of the subscription range or not received for in range document")
+	// Events arrive in order, so doc6 would have arrived before doc4
+	body := w.waitFor(t, `{"docKey":"doc4"}`)
+	if strings.Contains(body, `{"docKey":"doc6"}`) {
+		t.Fatal("Received notification for a document outside of the subscription range")
 	}
 }
 
@@ -148,143 +174,344 @@ func TestOverlappingSubscriptions(t *testing.T) {
 	subscribers := New()
 
 	// two overlapping ranges: [doc1,doc4] and [doc3,doc6]
-	req1 := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w1 := httptest.NewRecorder()
-	wg1 := &sync.WaitGroup{}
-	wg1.Add(1)
-
-	req2 := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w2 := httptest.NewRecorder()
-	wg2 := &sync.WaitGroup{}
-	wg2.Add(1)
-
-	go subscribers.Serve(w1, req1, wg1, "[doc1,doc4]")
-	go subscribers.Serve(w2, req2, wg2, "[doc3,doc6]")
-
-	wg1.Wait()
-	wg2.Wait()
+	w1, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[doc1,doc4]")
+	w2, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[doc3,doc6]")
 
 	// notify a document in the overlap
 	overlapData := []byte(`{"docKey":"doc4"}`)
 	go subscribers.Notify("/v1/testpath/doc4", "test-event", overlapData)
 
-	time.Sleep(1 * time.Second)
-
 	// check if both subscribers received the notification
-	body1, _ := io.ReadAll(w1.Result().Body)
-	body2, _ := io.ReadAll(w2.Result().Body)
-
-	if !strings.Contains(string(body1), `{"docKey":"doc4"}`) || !strings.Contains(string(body2), `{"docKey":"doc4"}`) {
-		t.Fatal("One or both subscribers did not receive the expected notification for overlapping ranges")
-	}
+	w1.waitFor(t, `{"docKey":"doc4"}`)
+	w2.waitFor(t, `{"docKey":"doc4"}`)
 }
 
 // TestNonOverlappingSubscriptions verifies that notifications are correctly sent to subscribers based on their non-overlapping subscription ranges.
 func TestNonOverlappingSubscriptions(t *testing.T) {
 	subscribers := New()
+	w1, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[doc1,doc4]")
+	w2, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[doc3,doc6]")
 
-	req1 := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w1 := httptest.NewRecorder()
-	wg1 := &sync.WaitGroup{}
-	wg1.Add(1)
-
-	req2 := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w2 := httptest.NewRecorder()
-	wg2 := &sync.WaitGroup{}
-	wg2.Add(1)
+	nonoverlapData := []byte(`{"docKey":"doc5"}`)
+	subscribers.Notify("/v1/testpath/doc5", "test-event", nonoverlapData)
+	subscribers.Notify("/v1/testpath/doc2", "test-event", []byte(`{"docKey":"doc2"}`))
 
-	go subscribers.Serve(w1, req1, wg1, "[doc1,doc4]")
-	go subscribers.Serve(w2, req2, wg2, "[doc3,doc6]")
+	w2.waitFor(t, `{"docKey":"doc5"}`)
+	// Events arrive in order, so doc5 would have arrived before doc2
+	if body := w1.waitFor(t, `{"docKey":"doc2"}`); strings.Contains(body, `{"docKey":"doc5"}`) {
+		t.Fatal("Received notification for a document outside of the subscription range")
+	}
+}
 
-	wg1.Wait()
-	wg2.Wait()
+// TestTicker ensures that subscribers receive periodic "ticker" messages.
+func TestTicker(t *testing.T) {
+	interval := keepAliveInterval
+	keepAliveInterval = 10 * time.Millisecond
+	// Cleanups run last first, so this runs once the stream has ended
+	t.Cleanup(func() { keepAliveInterval = interval })
+	subscribers := New()
+	w, _ := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[,]")
 
-	nonoverlapData := []byte(`{"docKey":"doc5"}`)
-	go subscribers.Notify("/v1/testpath/doc5", "test-event", nonoverlapData)
+	w.waitFor(t, `15 sec`)
+}
 
-	time.Sleep(1 * time.Second)
+// TestServeAndNotifyDB checks if the notification structure matches the expected format.
+func TestServeAndNotifyDB(t *testing.T) {
+	subscribers := New()
+	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
+	w, _ := serve(t, &subscribers, req, "[,]")
 
-	body1, _ := io.ReadAll(w1.Result().Body)
-	body2, _ := io.ReadAll(w2.Result().Body)
+	testData := []byte(`[{"path": "string","doc": {"additionalProp1": "string","additionalProp2": "string","additionalProp3": "string"},"meta": {"createdAt": 0,"createdBy": "string","lastModifiedAt": 0,"lastModifiedBy": "string"}}]`)
+	subscribers.Notify(req.URL.Path, "test-event", testData)
 
-	if strings.Contains(string(body1), `{"docKey":"doc5"}`) || !strings.Contains(string(body2), `{"docKey":"doc5"}`) {
-		t.Fatal("One or both subscribers did not receive the expected notification for overlapping ranges")
+	body := w.waitFor(t, `{"path"`)
+	if strings.Contains(body, `[`) {
+		t.Fatal("Document is returned in a slice")
 	}
 }
 
-// TestTicker ensures that subscribers receive periodic "ticker" messages.
-func TestTicker(t *testing.T) {
+// TestCloseChannel ensures the system correctly closes a subscriber's communication channel upon context cancellation.
+func TestCloseChannel(t *testing.T) {
 	subscribers := New()
-	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	w := httptest.NewRecorder()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	w, stop := serve(t, &subscribers, httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil), "[,]")
 
-	go subscribers.Serve(w, req, wg, "[,]")
-	wg.Wait()
+	// stop returns once Serve has returned
+	stop()
 
-	time.Sleep(16 * time.Second)
+	if w.Body() != "" {
+		t.Fatal("Close channel wrong")
+	}
+	if m := subscribers.Metrics(); m.Subscribers != 0 {
+		t.Errorf("Expected the subscriber to be removed, got %d", m.Subscribers)
+	}
+}
 
-	response := w.Result()
-	defer response.Body.Close()
+// TestFilteredSubscription ensures a subscriber with a filter only receives matching documents.
+func TestFilteredSubscription(t *testing.T) {
+	subscribers := New()
+	req := httptest.NewRequest("GET", `/v1/testpath/?mode=subscribe&filter=%2Fauthor%20%3D%3D%20%22alice%22`, nil)
+	w, _ := serve(t, &subscribers, req, "[,]")
 
-	body, _ := io.ReadAll(response.Body)
-	if !strings.Contains(string(body), `15 sec`) {
-		t.Fatal("Expected ticker comment not found in the response")
+	subscribers.Notify("/v1/testpath/doc1", "update", []byte(`{"path":"/doc1","doc":{"author":"bob"}}`))
+	subscribers.Notify("/v1/testpath/doc2", "update", []byte(`{"path":"/doc2","doc":{"author":"alice"}}`))
+	subscribers.Notify("/v1/testpath/doc1", "delete", []byte(`"/doc1"`))
+
+	// Delete events are not filtered, and arrive last
+	body := w.waitFor(t, `"/doc1"`)
+	if strings.Contains(body, `"bob"`) || !strings.Contains(body, `"alice"`) {
+		t.Fatal("Received a document that does not match the filter or missed one that does")
 	}
 }
 
-// TestServeAndNotifyDB checks if the notification structure matches the expected format.
-func TestServeAndNotifyDB(t *testing.T) {
+// TestInvalidFilterSubscription ensures a subscription with an invalid filter is rejected instead of receiving every event.
+func TestInvalidFilterSubscription(t *testing.T) {
 	subscribers := New()
-	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
+	req := httptest.NewRequest("GET", `/v1/testpath/?mode=subscribe&filter=%2Fauthor%20%3D%3D`, nil)
 	w := httptest.NewRecorder()
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	go subscribers.Serve(w, req, wg, "[,]")
+	subscribers.Serve(w, req, wg, "[,]")
 	wg.Wait()
 
-	testData := []byte(`[{"path": "string","doc": {"additionalProp1": "string","additionalProp2": "string","additionalProp3": "string"},"meta": {"createdAt": 0,"createdBy": "string","lastModifiedAt": 0,"lastModifiedBy": "string"}}]`)
-	subscribers.Notify(req.URL.Path, "test-event", testData)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid filter, got %d", w.Code)
+	}
+	if m := subscribers.Metrics(); m.Subscribers != 0 {
+		t.Errorf("Expected no subscriber to be registered, got %d", m.Subscribers)
+	}
+}
 
-	time.Sleep(1 * time.Second)
+// TestLastEventIDReplay checks that a reconnecting subscriber receives the events it missed,
+// and a reset event when its last event ID is no longer in the history.
+func TestLastEventIDReplay(t *testing.T) {
+	subscribers := New()
+	w, stop := serve(t, &subscribers, httptest.NewRequest("GET", "/v1/testpath/?mode=subscribe", nil), "[,]")
+
+	subscribers.Notify("/v1/testpath/doc1", "update", []byte(`{"path":"/doc1","doc":1}`))
+	subscribers.Notify("/v1/testpath/doc2", "update", []byte(`{"path":"/doc2","doc":2}`))
+	w.waitFor(t, `"doc":2`)
+	stop()
+	subscribers.Notify("/v1/testpath/doc3", "update", []byte(`{"path":"/doc3","doc":3}`))
+
+	body := w.Body()
+	first := strings.Index(body, "id: ")
+	if first == -1 {
+		t.Fatalf("Expected events with IDs, got %s", body)
+	}
+	id := strings.Fields(body[first+4:])[0]
+
+	// Replayed events are written before the subscriber is registered
+	replay := func(lastID string) string {
+		req := httptest.NewRequest("GET", "/v1/testpath/?mode=subscribe", nil)
+		req.Header.Set("Last-Event-ID", lastID)
+		w, stop := serve(t, &subscribers, req, "[,]")
+		stop()
+		return w.Body()
+	}
 
-	response := w.Result()
-	defer response.Body.Close()
+	missed := replay(id)
+	if strings.Contains(missed, `"doc":1`) || !strings.Contains(missed, `"doc":2`) || !strings.Contains(missed, `"doc":3`) {
+		t.Errorf("Expected only the events after %s, got %s", id, missed)
+	}
+	if strings.Index(missed, `"doc":2`) > strings.Index(missed, `"doc":3`) {
+		t.Errorf("Replayed events out of order: %s", missed)
+	}
+	if reset := replay("1"); !strings.Contains(reset, "event: reset") || strings.Contains(reset, `"doc"`) {
+		t.Errorf("Expected a reset event for an expired ID, got %s", reset)
+	}
+}
 
-	body, _ := io.ReadAll(response.Body)
-	if !strings.Contains(string(body), `{"path"`) {
-		t.Fatal("Expected notification data not found in the response")
+// TestSubtreeSubscription checks that a depth=all subscriber receives changes anywhere beneath its path,
+// tagged with the changed path, while a plain subscriber to the same path does not.
+func TestSubtreeSubscription(t *testing.T) {
+	subscribers := New()
+	subtree, _ := serve(t, &subscribers, httptest.NewRequest("GET", "/v1/ws/?mode=subscribe&depth=all", nil), "[,]")
+	plain, _ := serve(t, &subscribers, httptest.NewRequest("GET", "/v1/ws/?mode=subscribe", nil), "[,]")
+
+	subscribers.Notify("/v1/ws/chan1", "update", []byte(`{"path":"/chan1","doc":{"name":"general"}}`))
+	subscribers.Notify("/v1/ws/chan1/posts/p1", "update", []byte(`{"path":"/chan1/posts/p1","doc":{"text":"hi"}}`))
+	subscribers.Notify("/v1/ws/chan1/posts/p1", "delete", []byte(`"/chan1/posts/p1"`))
+	subscribers.Notify("/v1/other/doc", "update", []byte(`{"path":"/doc","doc":{"text":"elsewhere"}}`))
+	subscribers.Notify("/v1/ws/", "update", []byte(`[{"path":"/chan1","doc":{}}]`))
+	// Both subscribers receive this last, once every earlier event has arrived
+	subscribers.Notify("/v1/ws/chan2", "update", []byte(`{"path":"/chan2","doc":{"name":"last"}}`))
+
+	body := subtree.waitFor(t,
+		`{"path":"/v1/ws/chan1","data":{"path":"/chan1","doc":{"name":"general"}}}`,
+		`{"path":"/v1/ws/chan1/posts/p1","data":{"path":"/chan1/posts/p1","doc":{"text":"hi"}}}`,
+		`event: delete`+"\n"+`data: {"path":"/v1/ws/chan1/posts/p1","data":"/chan1/posts/p1"}`,
+		`"last"`,
+	)
+	if strings.Contains(body, "elsewhere") || strings.Contains(body, `[`) {
+		t.Errorf("Received an event outside the subtree or a listing: %s", body)
 	}
 
-	if strings.Contains(string(body), `[`) {
-		t.Fatal("Document is returned in a slice")
+	body = plain.waitFor(t, `"general"`, `"last"`)
+	if strings.Contains(body, `"hi"`) {
+		t.Errorf("Plain subscriber should only receive changes to direct children: %s", body)
 	}
 }
 
-// TestCloseChannel ensures the system correctly closes a subscriber's communication channel upon context cancellation.
-func TestCloseChannel(t *testing.T) {
+// TestQueuePolicies checks what happens to a subscriber that does not keep up under each policy.
+func TestQueuePolicies(t *testing.T) {
+	notify := func(subscribers *Subscribers) {
+		subscribers.Notify("/v1/db/doc1", "update", []byte(`{"path":"/doc1","doc":1}`))
+		subscribers.Notify("/v1/db/doc2", "update", []byte(`{"path":"/doc2","doc":2}`))
+		subscribers.Notify("/v1/db/doc1", "update", []byte(`{"path":"/doc1","doc":3}`))
+	}
+	docs := func(msgs []Message) string {
+		var result []string
+		for _, msg := range msgs {
+			result = append(result, string(msg.Data[len(msg.Data)-2]))
+		}
+		return strings.Join(result, ",")
+	}
+
+	subscribers := NewWithQueue(2, DropOldest)
+	sub, _ := subscribers.Subscribe("/v1/db/", Options{Bound: "[,]"}, "")
+	notify(&subscribers)
+	if got := docs(sub.Drain()); got != "2,3" {
+		t.Errorf("drop-oldest: expected 2,3, got %s", got)
+	}
+	if m := subscribers.Metrics(); m.Dropped != 1 || m.Queued != 3 || m.Subscribers != 1 {
+		t.Errorf("drop-oldest: unexpected metrics %+v", m)
+	}
+
+	subscribers = NewWithQueue(2, Coalesce)
+	sub, _ = subscribers.Subscribe("/v1/db/", Options{Bound: "[,]"}, "")
+	notify(&subscribers)
+	if got := docs(sub.Drain()); got != "2,3" {
+		t.Errorf("coalesce: expected 2,3, got %s", got)
+	}
+	if m := subscribers.Metrics(); m.Coalesced != 1 || m.Dropped != 0 {
+		t.Errorf("coalesce: unexpected metrics %+v", m)
+	}
+
+	subscribers = NewWithQueue(2, Disconnect)
+	sub, _ = subscribers.Subscribe("/v1/db/", Options{Bound: "[,]"}, "")
+	notify(&subscribers)
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatalf("disconnect: expected the subscription to end")
+	}
+	if sub.Err() != ErrTooSlow {
+		t.Errorf("disconnect: expected ErrTooSlow, got %v", sub.Err())
+	}
+	if m := subscribers.Metrics(); m.Disconnected != 1 || m.Subscribers != 0 {
+		t.Errorf("disconnect: unexpected metrics %+v", m)
+	}
+}
+
+// TestExpire ensures that only subscriptions with an invalid token are closed, and that their
+// streams deliver the queued messages and end with an expired event.
+func TestExpire(t *testing.T) {
 	subscribers := New()
-	ctx, cancel := context.WithCancel(context.Background())
-	req := httptest.NewRequest("PUT", "/v1/testpath/?mode=subscribe", nil)
-	req = req.WithContext(ctx)
-	w := httptest.NewRecorder()
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	expiring, _ := subscribers.Subscribe("/v1/testpath/", Options{Bound: "[,]", Token: "old"}, "")
+	valid, _ := subscribers.Subscribe("/v1/testpath/", Options{Bound: "[,]", Token: "new"}, "")
+	untokened, _ := subscribers.Subscribe("/v1/testpath/", Options{Bound: "[,]"}, "")
+	subscribers.Notify("/v1/testpath/doc", "update", []byte(`{"key":"value"}`))
 
-	go subscribers.Serve(w, req, wg, "[,]")
-	wg.Wait()
+	req := httptest.NewRequest("GET", "/v1/testpath/?mode=subscribe", nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		// Messages are only taken once ready is drained, so the queued update is still waiting
+		<-expiring.Ready()
+		subscribers.Stream(w, req, expiring, nil)
+		close(done)
+	}()
+
+	if closed := subscribers.Expire(func(token string) bool { return token == "new" }); closed != 1 {
+		t.Errorf("Expected 1 subscription to expire, got %d", closed)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to end")
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `{"key":"value"}`) || !strings.HasSuffix(body, "event: expired\ndata: \"token expired\"\n\n") {
+		t.Errorf("Expected the queued update and an expired event, got %q", body)
+	}
+	select {
+	case <-valid.Done():
+		t.Error("Expected a subscription with a valid token to stay open")
+	case <-untokened.Done():
+		t.Error("Expected a subscription without a token to stay open")
+	default:
+	}
+}
 
-	cancel()
-	time.Sleep(1 * time.Second)
+// TestPrune ensures that paths without subscribers are removed once idle for long enough, and that
+// subscribers reconnecting to a removed path are sent a reset event.
+func TestPrune(t *testing.T) {
+	subscribers := New()
+	left, _ := subscribers.Subscribe("/v1/left/", Options{Bound: "[,]"}, "")
+	stayed, _ := subscribers.Subscribe("/v1/stayed/", Options{Bound: "[,]"}, "")
+	subscribers.Notify("/v1/left/doc", "update", []byte(`{"key":"value"}`))
+	lastID := left.Drain()[0].ID
+	subscribers.Unsubscribe(left)
+
+	if removed := subscribers.Prune(time.Hour); removed != 0 {
+		t.Errorf("Expected a recently left path to be kept, removed %d", removed)
+	}
+	if removed := subscribers.Prune(0); removed != 1 {
+		t.Errorf("Expected only the path without subscribers to be removed, removed %d", removed)
+	}
+	if _, exists := subscribers.content.Find("/v1/left/"); exists {
+		t.Error("Expected the path without subscribers to be removed")
+	}
+	subscribers.Unsubscribe(left)
+	subscribers.Unsubscribe(stayed)
+	if _, exists := subscribers.content.Find("/v1/left/"); exists {
+		t.Error("Expected Unsubscribe not to create a path")
+	}
 
-	response := w.Result()
-	defer response.Body.Close()
+	_, replay := subscribers.Subscribe("/v1/left/", Options{Bound: "[,]"}, strconv.FormatUint(lastID-1, 10))
+	if len(replay) != 1 || replay[0].Event != "reset" {
+		t.Errorf("Expected a reset event for a removed path, got %v", replay)
+	}
+}
 
-	body, _ := io.ReadAll(response.Body)
+// TestAllowedAndRevoke ensures that subscribers are only sent the changes they are allowed to see,
+// and that Revoke closes the subscriptions beneath a path that may no longer see their path.
+func TestAllowedAndRevoke(t *testing.T) {
+	subscribers := New()
+	var mu sync.Mutex
+	hidden := "/v1/db/doc/secret/"
+	allowed := func(path string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !strings.HasPrefix(path, hidden)
+	}
+	subtree, _ := subscribers.Subscribe("/v1/db/", Options{Bound: "[,]", Subtree: true, Allowed: allowed}, "")
+	child, _ := subscribers.Subscribe("/v1/db/doc/public/", Options{Bound: "[,]", Allowed: allowed}, "")
+	subscribers.Notify("/v1/db/doc/secret/a", "update", []byte(`{"key":"secret"}`))
+	subscribers.Notify("/v1/db/doc/public/b", "update", []byte(`{"key":"public"}`))
+	msgs := subtree.Drain()
+	if len(msgs) != 1 || !strings.Contains(string(msgs[0].Data), "public") {
+		t.Errorf("Expected only the allowed change, got %v", msgs)
+	}
 
-	if !(string(body) == "") {
-		t.Fatal("Close channel wrong")
+	mu.Lock()
+	hidden = "/v1/db/doc/public/"
+	mu.Unlock()
+	if revoked := subscribers.Revoke("/v1/db/doc/public/"); revoked != 1 {
+		t.Errorf("Expected 1 subscription to be revoked, got %d", revoked)
+	}
+	select {
+	case <-child.Done():
+	default:
+		t.Fatal("Expected the subscription to be closed")
+	}
+	if child.Err() != ErrForbidden {
+		t.Errorf("Expected ErrForbidden, got %v", child.Err())
+	}
+	select {
+	case <-subtree.Done():
+		t.Error("Expected a subscription outside the path to stay open")
+	default:
 	}
 }
@@ -0,0 +1,195 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+)
+
+// handleACL handles requests with mode=acl on a database or collection. GET returns the access
+// control list, PUT replaces it with the list in the body and DELETE removes it. Subscriptions
+// to the collection and beneath it that lose read access by the change are closed.
+func (sys *System) handleACL(w http.ResponseWriter, r *http.Request, relPath string, subscribers *subscription.Subscribers) {
+	paths := strings.Split(relPath, "/")
+	if relPath == "" || len(paths)%2 == 0 {
+		data, _ := json.Marshal("access control lists can only be set on databases and collections")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	var updated *acl.ACL
+	switch r.Method {
+	case http.MethodGet:
+		unlock := sys.rlockDatabase(paths[0])
+		defer unlock()
+	case http.MethodPut:
+		updated = new(acl.ACL)
+		err := json.NewDecoder(r.Body).Decode(updated)
+		defer r.Body.Close()
+		if err != nil {
+			data, _ := json.Marshal("invalid access control list: " + err.Error())
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	case http.MethodDelete:
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	default:
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, status := sys.lookup(paths)
+	col, ok := file.(*collection.Collection)
+	if status != http.StatusOK || !ok {
+		data, _ := json.Marshal("unable to retrive collection: " + relPath)
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		current := col.ACL()
+		if current == nil {
+			current = &acl.ACL{}
+		}
+		data, _ := json.Marshal(current)
+		WriteJsonResponse(w, data, http.StatusOK)
+		return
+	}
+
+	err := sys.setACL(col, relPath, updated)
+	if err != nil {
+		slog.Error("Error when writing to the write-ahead log", "error", err)
+		data, _ := json.Marshal("unable to persist change")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	subscribers.Revoke("/v1/" + relPath + "/")
+	if updated == nil {
+		data, _ := json.Marshal("access control list successfully deleted")
+		WriteJsonResponse(w, data, http.StatusNoContent)
+		return
+	}
+	data, _ := json.Marshal(updated)
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// setACL replaces the access control list of col, the collection at path, with a and logs it.
+// The old list is put back if the change cannot be logged. The caller must hold the write lock
+// on the database.
+func (sys *System) setACL(col *collection.Collection, path string, a *acl.ACL) error {
+	old := col.ACL()
+	col.SetACL(a)
+	err := sys.logACL(path, a)
+	if err != nil {
+		col.SetACL(old)
+	}
+	return err
+}
+
+// permission returns the permission of who on the file at paths below /v1/, which need not exist.
+// Permissions granted on a database or collection are inherited by everything below it, unless a
+// collection below has an access control list of its own. Paths without any access control list
+// that grants permissions are open to every user. The caller must hold a lock on the database.
+func (sys *System) permission(who acl.Principal, paths []string) acl.Permission {
+	granted, restricted := sys.granted(who, paths)
+	if !restricted {
+		return acl.Admin
+	}
+	return granted
+}
+
+// granted returns the permission granted to who by the nearest collection along paths whose
+// access control list grants permissions, and whether there is one. The nearest list replaces
+// those above it, so that a collection can be restricted to fewer users than its database.
+// The caller must hold a lock on the database.
+func (sys *System) granted(who acl.Principal, paths []string) (acl.Permission, bool) {
+	var file filejson.FileJson = sys
+	restricted := false
+	granted := acl.None
+	for _, name := range paths {
+		next, status := file.Next(name)
+		if status != http.StatusOK {
+			break
+		}
+		file = next
+		if col, ok := file.(*collection.Collection); ok && col.ACL().Restricts() {
+			restricted = true
+			granted = col.ACL().Permission(who)
+		}
+	}
+	return granted, restricted
+}
+
+// readable returns the Allowed option of the subscriptions of who, which may see the changes
+// at the paths they have read access to. Subscribers call it with a lock on the database held.
+func (sys *System) readable(who acl.Principal) func(path string) bool {
+	return func(path string) bool {
+		return sys.permission(who, strings.Split(relativePath(path), "/")) >= acl.Read
+	}
+}
+
+// mayModify reports whether who may replace, patch or delete target, the file at paths in parent,
+// under the rules of parent. Only the creator of a document in a collection with the owner-write
+// rule and users granted admin access may change it. The caller must hold the write lock on the database.
+func (sys *System) mayModify(who acl.Principal, paths []string, parent filejson.FileJson, target filejson.FileJson) bool {
+	col, ok := parent.(*collection.Collection)
+	doc, isDoc := target.(*document.Document)
+	if !ok || !isDoc || !col.ACL().HasRule(acl.OwnerWrite) {
+		return true
+	}
+	granted, _ := sys.granted(who, paths)
+	return doc.GetCreatedBy() == who.User || granted >= acl.Admin
+}
+
+// allowed reports whether who has at least the permission need on the file at relPath.
+func (sys *System) allowed(who acl.Principal, relPath string, need acl.Permission) bool {
+	paths := strings.Split(relPath, "/")
+	unlock := sys.rlockDatabase(paths[0])
+	defer unlock()
+	return sys.permission(who, paths) >= need
+}
+
+// authorize checks that who has at least the permission need on the file at relPath.
+// If not, a 403 response is written and false is returned.
+func (sys *System) authorize(w http.ResponseWriter, who acl.Principal, relPath string, need acl.Permission) bool {
+	if sys.allowed(who, relPath, need) {
+		return true
+	}
+	data, _ := json.Marshal(forbidden(need))
+	WriteJsonResponse(w, data, http.StatusForbidden)
+	return false
+}
+
+// forbidden returns the message of responses to requests that lack the permission need.
+func forbidden(need acl.Permission) string {
+	return "permission denied: requires " + need.String() + " access"
+}
+
+// requiredPermission returns the permission needed for a request with method and mode on the file at relPath.
+// Reads need read access and changes need write access, except that deleting a database and changing its
+// access control lists or indexes need admin access.
+func requiredPermission(method string, mode string, relPath string) acl.Permission {
+	read := method == http.MethodGet || method == "'GET'"
+	switch {
+	case mode == "acl" || mode == "index" || mode == "schema":
+		if read {
+			return acl.Read
+		}
+		return acl.Admin
+	case mode == "export" || read:
+		return acl.Read
+	case (method == http.MethodDelete || method == "'DELETE'") && !strings.Contains(relPath, "/"):
+		return acl.Admin
+	}
+	return acl.Write
+}
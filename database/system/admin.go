@@ -0,0 +1,172 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+)
+
+// serviceTokenRequest is the body of requests for service tokens. Lifetime is a duration such as
+// 720h, and defaults to authentication.ServiceTokenLifetime.
+type serviceTokenRequest struct {
+	Username string `json:"username"`
+	Lifetime string `json:"lifetime,omitempty"`
+}
+
+// serviceToken is the response to requests for service tokens.
+type serviceToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// authenticateAdmin checks the bearer token in the Authorization header of r and returns the user
+// it belongs to, who must be one of the admins the server was started with. If the token is missing
+// or invalid, a 401 response is written, if the user is not an admin a 403 response, and false is returned.
+func (sys *System) authenticateAdmin(w http.ResponseWriter, r *http.Request, auth authentication.Backend) (string, bool) {
+	user, ok := authenticate(w, r, auth)
+	if !ok {
+		return "", false
+	}
+	if !sys.isAdmin(user) {
+		message, _ := json.Marshal("permission denied: requires an admin")
+		WriteJsonResponse(w, message, http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
+
+// handleSnapshot handles POST /admin/snapshot, which takes a snapshot of the data directory
+// and truncates the write-ahead log it covers.
+func (sys *System) handleSnapshot(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	_, ok := sys.authenticateAdmin(w, r, auth)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	if sys.log == nil {
+		data, _ := json.Marshal("snapshots need a data directory, start the server with -d")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	seq, err := sys.snapshot()
+	if err != nil {
+		slog.Error("Error when taking snapshot", "error", err)
+		data, _ := json.Marshal("unable to take snapshot")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(map[string]uint64{"seq": seq})
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// handleMetrics handles GET /admin/metrics, which reports the subscriber queue counts,
+// including the events dropped for slow subscribers.
+func (sys *System) handleMetrics(w http.ResponseWriter, r *http.Request, auth authentication.Backend, subscribers *subscription.Subscribers) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	_, ok := sys.authenticateAdmin(w, r, auth)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := json.Marshal(subscribers.Metrics())
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// handleTokens handles /admin/tokens. GET lists the unexpired tokens with their users and expiry,
+// showing only the first characters of each token. POST creates a long-lived service token.
+func (sys *System) handleTokens(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	_, ok := sys.authenticateAdmin(w, r, auth)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, _ := json.Marshal(auth.Sessions())
+		WriteJsonResponse(w, data, http.StatusOK)
+	case http.MethodPost:
+		var req serviceTokenRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		defer r.Body.Close()
+		if err != nil {
+			data, _ := json.Marshal("body must have a username")
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+		var lifetime time.Duration
+		if req.Lifetime != "" {
+			lifetime, err = time.ParseDuration(req.Lifetime)
+			if err != nil {
+				data, _ := json.Marshal("lifetime must be a duration such as 720h")
+				WriteJsonResponse(w, data, http.StatusBadRequest)
+				return
+			}
+		}
+		tok, expires, err := auth.MapServiceToken(req.Username, lifetime)
+		if err != nil {
+			data, _ := json.Marshal(err.Error())
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(serviceToken{Token: tok, ExpiresAt: expires})
+		WriteJsonResponse(w, data, http.StatusCreated)
+	default:
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSessions handles DELETE /admin/users/{user}/sessions, which revokes every token of the user,
+// including service tokens.
+func (sys *System) handleSessions(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	_, ok := sys.authenticateAdmin(w, r, auth)
+	if !ok {
+		return
+	}
+	user, found := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/sessions")
+	if !found || user == "" || strings.Contains(user, "/") {
+		data, _ := json.Marshal("path must be /admin/users/{user}/sessions")
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := json.Marshal(map[string]int{"revoked": auth.RevokeUser(user)})
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// isAdmin reports whether user is one of the admins the server was started with.
+func (sys *System) isAdmin(user string) bool {
+	return slices.Contains(sys.admins, user)
+}
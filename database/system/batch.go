@@ -0,0 +1,86 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+)
+
+// handleBatch handles POST /v1/_batch, which applies a JSON array of PUT, PATCH and DELETE
+// operations in order, for bulk loads. Unlike a transaction, each operation is applied and
+// logged on its own, so operations may span databases and a failure does not undo earlier
+// operations. Paths start with the database, and documents are validated against the schema.
+// Operations cannot create or delete databases, which must be done with PUT or DELETE on
+// /v1/{db}, or POST documents, since the name of every document must be given; such operations
+// fail with 400 Bad Request. With stopOnError=true, the operations after the first failure are
+// not applied. Responds with a result for every operation, in the order of the request.
+func (sys *System) handleBatch(w http.ResponseWriter, r *http.Request, who acl.Principal, subscribers *subscription.Subscribers) {
+	if r.Method != http.MethodPost {
+		data, _ := json.Marshal("batch only supports POST")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	var ops []txnOp
+	err := json.NewDecoder(r.Body).Decode(&ops)
+	defer r.Body.Close()
+	if err != nil {
+		data, _ := json.Marshal("batch must be a JSON array of operations")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	stopOnError := r.URL.Query().Get("stopOnError") == "true"
+
+	results := make([]txnResult, len(ops))
+	stopped := false
+	for i, op := range ops {
+		results[i] = txnResult{Method: op.Method, Path: op.Path}
+		if stopped {
+			results[i].Message = "not applied: an earlier operation failed"
+			continue
+		}
+		results[i].Status, results[i].Message = sys.applyBatchOp(who, op, subscribers)
+		stopped = stopOnError && results[i].Status >= 300
+	}
+	data, _ := json.Marshal(results)
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// applyBatchOp applies and logs a single operation of a batch and notifies subscribers.
+// Returns the status of the operation, with a message if it failed.
+func (sys *System) applyBatchOp(who acl.Principal, op txnOp, subscribers *subscription.Subscribers) (int, string) {
+	if strings.ToUpper(op.Method) == http.MethodPost {
+		return http.StatusBadRequest, "batch operations cannot POST: use PUT with the name of the document"
+	}
+	dbName, rest, found := strings.Cut(strings.TrimPrefix(op.Path, "/"), "/")
+	if !strings.HasPrefix(op.Path, "/") || dbName == "" {
+		return http.StatusBadRequest, "path must start with a database"
+	}
+	if !found || strings.Trim(rest, "/") == "" {
+		return http.StatusBadRequest, "batch operations cannot create or delete databases: use PUT or DELETE on /v1/" + dbName
+	}
+	if isReserved(dbName) {
+		return http.StatusForbidden, "reserved database: " + dbName
+	}
+	op.Path = "/" + rest
+
+	unlock := sys.lockDatabase(dbName)
+	change, status, message := sys.applyTxnOp(dbName, who, op)
+	if status < 300 && sys.log != nil {
+		_, err := sys.log.Append(change.rec)
+		if err != nil {
+			slog.Error("Error when writing to the write-ahead log", "error", err)
+			sys.rollback([]txnChange{change})
+			status, message = http.StatusInternalServerError, "unable to persist change"
+		}
+	}
+	// Subscribers are notified before other changes, so that they see changes in order
+	if status < 300 {
+		sys.notify(subscribers, change.urlPath, change.event)
+	}
+	unlock()
+	return status, message
+}
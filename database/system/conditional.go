@@ -0,0 +1,73 @@
+package system
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+)
+
+// hasPreconditions reports whether r carries an If-Match or If-None-Match header.
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers of r against target,
+// the current file at the request path, which is nil if it does not exist.
+// Reports whether the request may proceed.
+func checkPreconditions(r *http.Request, target filejson.FileJson) bool {
+	return preconditionsHold(r.Header.Get("If-Match"), r.Header.Get("If-None-Match"), target)
+}
+
+// preconditionsHold evaluates If-Match and If-None-Match header values, either of which may be
+// empty, against target, which is nil if it does not exist. Only documents have entity tags,
+// so other files only match "*". Reports whether the change may proceed.
+func preconditionsHold(ifMatch string, ifNoneMatch string, target filejson.FileJson) bool {
+	etag := ""
+	if doc, ok := target.(*document.Document); ok {
+		etag = doc.ETag()
+	}
+	if ifMatch != "" && (target == nil || !matchETag(ifMatch, etag)) {
+		return false
+	}
+	if ifNoneMatch != "" && target != nil && matchETag(ifNoneMatch, etag) {
+		return false
+	}
+	return true
+}
+
+// matchETag reports whether the header value, "*" or a comma separated list of entity tags,
+// matches the existing file with entity tag etag. Tags are compared strongly, so weak tags never match.
+func matchETag(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the If-None-Match header of r, a GET of doc, matches doc, so that
+// the client's copy is current. Unlike for changes, tags are compared weakly, as GET allows.
+func notModified(r *http.Request, doc *document.Document) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == doc.ETag() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// group is the document of a group in groupsDB.
+type group struct {
+	Members []string `json:"members"`
+	Owner   string   `json:"owner,omitempty"` // user who may change the group besides the admins
+}
+
+// handleGroup handles /groups/{name}. GET returns the members of the group, PUT replaces them with
+// the members in the body, creating the group if needed, and DELETE removes the group. Since access
+// control lists grant permissions to groups by name, only admins may create groups, including groups
+// that were deleted, and only the owner of a group or an admin may change or remove it. The owner is
+// the user who created the group unless the body names another.
+func (sys *System) handleGroup(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	user, ok := authenticate(w, r, auth)
+	if !ok {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+	if name == "" || strings.Contains(name, "/") {
+		data, _ := json.Marshal("invalid group name")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var g group
+		unlock := sys.rlockDatabase(groupsDB)
+		err := sys.getReserved(groupsDB, name, &g)
+		unlock()
+		if err != nil {
+			data, _ := json.Marshal("unable to retrive group: " + name)
+			WriteJsonResponse(w, data, http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(g)
+		WriteJsonResponse(w, data, http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	var updated group
+	if r.Method == http.MethodPut {
+		err := json.NewDecoder(r.Body).Decode(&updated)
+		defer r.Body.Close()
+		if err != nil || updated.Members == nil {
+			data, _ := json.Marshal("body must have the list of members")
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := sys.lockDatabase(groupsDB)
+	defer unlock()
+	var g group
+	exists := sys.getReserved(groupsDB, name, &g) == nil
+	if !exists && !sys.isAdmin(user) && r.Method == http.MethodPut {
+		data, _ := json.Marshal("permission denied: only admins may create groups")
+		WriteJsonResponse(w, data, http.StatusForbidden)
+		return
+	}
+	if exists && !sys.isAdmin(user) && g.Owner != user {
+		data, _ := json.Marshal("permission denied: only the owner of group " + name + " or an admin may change it")
+		WriteJsonResponse(w, data, http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !exists {
+			data, _ := json.Marshal("unable to delete group " + name + ": does not exist")
+			WriteJsonResponse(w, data, http.StatusNotFound)
+			return
+		}
+		file, _ := sys.Next(groupsDB)
+		old, _ := file.Next(name)
+		file.Delete(name)
+		err := sys.logChange(wal.OpDelete, groupsDB+"/"+name)
+		if err != nil {
+			slog.Error("Error when writing to the write-ahead log", "error", err)
+			sys.rollback([]txnChange{{undo: txnUndo{parent: file, name: name, old: old}}})
+			data, _ := json.Marshal("unable to persist change")
+			WriteJsonResponse(w, data, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if updated.Owner == "" {
+		updated.Owner = g.Owner
+	}
+	if updated.Owner == "" {
+		updated.Owner = user
+	}
+	err := sys.putReserved(groupsDB, name, user, updated)
+	if err != nil {
+		slog.Error("Error when saving group", "error", err)
+		data, _ := json.Marshal("unable to save group")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(updated)
+	if exists {
+		WriteJsonResponse(w, data, http.StatusOK)
+	} else {
+		WriteJsonResponse(w, data, http.StatusCreated)
+	}
+}
+
+// principal returns user and the groups user is a member of.
+// The caller must not hold a lock on any database, since groups are read under their own lock.
+func (sys *System) principal(user string) acl.Principal {
+	who := acl.Principal{User: user}
+	unlock := sys.rlockDatabase(groupsDB)
+	defer unlock()
+	file, status := sys.Next(groupsDB)
+	if status != http.StatusOK {
+		return who
+	}
+	file.(*collection.Collection).Range(func(name string, doc filejson.FileJson) bool {
+		var g group
+		if json.Unmarshal(doc.(*document.Document).GetDoc(), &g) == nil && slices.Contains(g.Members, user) {
+			who.Groups = append(who.Groups, name)
+		}
+		return true
+	})
+	return who
+}
@@ -0,0 +1,82 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// handleIndex handles requests with mode=index on a database or collection. PUT declares a
+// secondary index on the JSON pointer in the field parameter, DELETE removes it, and GET lists
+// the indexed fields. Filters on indexed fields are then answered with range lookups.
+func (sys *System) handleIndex(w http.ResponseWriter, r *http.Request, relPath string) {
+	paths := strings.Split(relPath, "/")
+	if relPath == "" || len(paths)%2 == 0 {
+		data, _ := json.Marshal("indexes can only be declared on databases and collections")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	field := r.URL.Query().Get("field")
+	if r.Method != http.MethodGet && field == "" {
+		data, _ := json.Marshal("missing field parameter")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	var op string
+	switch r.Method {
+	case http.MethodGet:
+		unlock := sys.rlockDatabase(paths[0])
+		defer unlock()
+	case http.MethodPut:
+		op = wal.OpIndex
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	case http.MethodDelete:
+		op = wal.OpDropIndex
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	default:
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, status := sys.lookup(paths)
+	col, ok := file.(*collection.Collection)
+	if status != http.StatusOK || !ok {
+		data, _ := json.Marshal("unable to retrive collection: " + relPath)
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	switch r.Method {
+	case http.MethodGet:
+		data, _ = json.Marshal(col.Indexes())
+		status = http.StatusOK
+	case http.MethodPut:
+		data, status = col.CreateIndex(field)
+	case http.MethodDelete:
+		data, status = col.DropIndex(field)
+	}
+	// Creating an index that already exists changes nothing
+	if op != "" && (status == http.StatusCreated || status == http.StatusNoContent) {
+		err := sys.logIndex(op, relPath, field)
+		if err != nil {
+			slog.Error("Error when writing to the write-ahead log", "error", err)
+			if op == wal.OpIndex {
+				col.DropIndex(field)
+			} else {
+				col.CreateIndex(field)
+			}
+			data, _ = json.Marshal("unable to persist change")
+			status = http.StatusInternalServerError
+		}
+	}
+	WriteJsonResponse(w, data, status)
+}
@@ -0,0 +1,38 @@
+package system
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+)
+
+// sweepLoop calls sweep every interval until done is closed.
+func sweepLoop(interval time.Duration, auth authentication.Backend, subscribers *subscription.Subscribers, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sweep(auth, subscribers)
+		}
+	}
+}
+
+// sweep closes the subscriptions whose token expired and removes expired tokens, which are
+// otherwise only removed when they are presented again, and the recent events of paths that
+// have had no subscribers for longer than subscription.HistoryRetention.
+func sweep(auth authentication.Backend, subscribers *subscription.Subscribers) {
+	// An open stream uses its token, so only revoked tokens and absolute expiry close it
+	closed := subscribers.Expire(func(token string) bool {
+		return auth.CheckStream(token) != ""
+	})
+	pruned := auth.Prune()
+	if closed > 0 || pruned > 0 {
+		slog.Info("Swept expired tokens", "tokens", pruned, "subscriptions", closed)
+	}
+	subscribers.Prune(subscription.HistoryRetention)
+}
@@ -0,0 +1,385 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/snapshot"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// lockStripes is the number of locks database names are hashed onto.
+const lockStripes = 64
+
+// lockTable serializes the changes made within a database, so that they are
+// written to the log in the same order they are applied to the tree.
+type lockTable struct {
+	stripes [lockStripes]sync.RWMutex
+}
+
+// stripe returns the lock guarding the database dbName.
+func (t *lockTable) stripe(dbName string) *sync.RWMutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(dbName))
+	return &t.stripes[hash.Sum32()%lockStripes]
+}
+
+// lockDatabase locks the database dbName for writing and returns the function that unlocks it.
+// The returned function may safely be called more than once.
+func (s *System) lockDatabase(dbName string) func() {
+	lock := s.locks.stripe(dbName)
+	lock.Lock()
+	return sync.OnceFunc(lock.Unlock)
+}
+
+// rlockDatabase locks the database dbName for reading and returns the function that unlocks it.
+// While it is held, no change to the database is applied.
+func (s *System) rlockDatabase(dbName string) func() {
+	lock := s.locks.stripe(dbName)
+	lock.RLock()
+	return sync.OnceFunc(lock.RUnlock)
+}
+
+// lockAll locks every database for writing and returns the function that unlocks them.
+func (s *System) lockAll() func() {
+	for i := range s.locks.stripes {
+		s.locks.stripes[i].Lock()
+	}
+	return sync.OnceFunc(func() {
+		for i := range s.locks.stripes {
+			s.locks.stripes[i].Unlock()
+		}
+	})
+}
+
+// openLog loads the newest snapshot in dir, replays the write-ahead log after it,
+// and keeps the log open for the changes that follow.
+func (s *System) openLog(dir string, policy wal.SyncPolicy) error {
+	log, err := wal.Open(dir, policy)
+	if err != nil {
+		return err
+	}
+	snapSeq, err := snapshot.Load(dir, s.replay)
+	if err != nil {
+		log.Close()
+		return err
+	}
+	if log.Seq() < snapSeq {
+		log.Close()
+		return fmt.Errorf("write-ahead log ends at %d, before snapshot at %d", log.Seq(), snapSeq)
+	}
+	next := snapSeq + 1
+	err = log.Replay(snapSeq, func(rec wal.Record) error {
+		if rec.Seq != next {
+			return fmt.Errorf("write-ahead log is missing record %d", next)
+		}
+		next++
+		return s.replay(rec)
+	})
+	if err != nil {
+		log.Close()
+		return err
+	}
+	s.log = log
+	s.dataDir = dir
+	s.snapSeq = snapSeq
+	slog.Info("Loaded data directory", "dir", dir, "snapshot", snapSeq, "seq", log.Seq())
+	return nil
+}
+
+// snapshot writes a snapshot of the whole tree and truncates the log it covers.
+// Returns the sequence number of the last log record the snapshot covers.
+func (s *System) snapshot() (uint64, error) {
+	if s.log == nil {
+		return 0, errors.New("snapshots need a data directory")
+	}
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	// Documents are never modified in place, so holding on to them is
+	// enough to keep this view consistent once the locks are released
+	unlock := s.lockAll()
+	seq, err := s.log.Rotate()
+	if err != nil {
+		unlock()
+		return 0, err
+	}
+	records := s.dump()
+	unlock()
+
+	_, err = snapshot.Write(s.dataDir, seq, records)
+	if err != nil {
+		return 0, err
+	}
+	s.snapSeq = seq
+	err = s.log.Truncate(seq)
+	if err != nil {
+		return seq, err
+	}
+	return seq, snapshot.Prune(s.dataDir, 1)
+}
+
+// snapshotLoop takes a snapshot every interval, if anything changed, until done is closed.
+func (s *System) snapshotLoop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.snapMu.Lock()
+			changed := s.log.Seq() != s.snapSeq
+			s.snapMu.Unlock()
+			if !changed {
+				continue
+			}
+			seq, err := s.snapshot()
+			if err != nil {
+				slog.Error("Error when taking snapshot", "error", err)
+			} else {
+				slog.Info("Took snapshot", "seq", seq)
+			}
+		}
+	}
+}
+
+// dump returns the records that rebuild the whole tree, parents before children.
+func (s *System) dump() []wal.Record {
+	records := make([]wal.Record, 0)
+	s.system.Range(func(name string, db filejson.FileJson) bool {
+		records = dumpFile(records, name, db)
+		return true
+	})
+	return records
+}
+
+// dumpFile appends the records that rebuild file and everything below it to records.
+func dumpFile(records []wal.Record, path string, file filejson.FileJson) []wal.Record {
+	switch f := file.(type) {
+	case *collection.Collection:
+		records = append(records, wal.Record{Op: wal.OpPut, Path: path})
+		for _, field := range f.Indexes() {
+			records = append(records, wal.Record{Op: wal.OpIndex, Path: path, Field: field})
+		}
+		if a := f.ACL(); a != nil {
+			records = append(records, wal.Record{Op: wal.OpACL, Path: path, ACL: a})
+		}
+		if v := f.Schema(); v != nil {
+			records = append(records, wal.Record{Op: wal.OpSchema, Path: path, Schema: v.Source()})
+		}
+		f.Range(func(name string, doc filejson.FileJson) bool {
+			records = dumpFile(records, path+"/"+name, doc)
+			return true
+		})
+	case *document.Document:
+		content := f.GetContent()
+		records = append(records, wal.Record{Op: wal.OpPut, Path: path, Doc: content.Doc, Meta: &content.Metadata})
+		f.Range(func(name string, col filejson.FileJson) bool {
+			records = dumpFile(records, path+"/"+name, col)
+			return true
+		})
+	}
+	return records
+}
+
+// replay applies a logged record during startup. A record that cannot be applied is
+// reported and skipped so that one bad record does not make the rest of the data unreachable.
+func (s *System) replay(rec wal.Record) error {
+	err := s.applyRecord(rec)
+	if err != nil {
+		slog.Warn("Skipping write-ahead log record", "seq", rec.Seq, "op", rec.Op, "path", rec.Path, "error", err)
+	}
+	return nil
+}
+
+// applyRecord applies a single logged change to the tree.
+func (s *System) applyRecord(rec wal.Record) error {
+	if rec.Op == wal.OpTxn {
+		// Apply as much of the transaction as possible, reporting the first failure
+		var first error
+		for _, op := range rec.Ops {
+			err := s.applyRecord(op)
+			if err != nil && first == nil {
+				first = fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+			}
+		}
+		return first
+	}
+	paths := strings.Split(strings.Trim(rec.Path, "/"), "/")
+	parent, status := s.lookup(paths[:len(paths)-1])
+	if status != http.StatusOK {
+		return errors.New("parent does not exist")
+	}
+	name := paths[len(paths)-1]
+	isCollection := len(paths)%2 == 1
+
+	switch rec.Op {
+	case wal.OpPut:
+		if isCollection {
+			// Recreate the collection empty, exactly as the original PUT did
+			parent.Delete(name)
+			col := collection.NewWithPath(rec.Path)
+			_, status = parent.Put(name, &col, s.validator)
+			if status != http.StatusCreated {
+				return fmt.Errorf("unable to create collection, status %d", status)
+			}
+			return nil
+		}
+		col, ok := parent.(*collection.Collection)
+		if !ok || rec.Meta == nil {
+			return errors.New("invalid document record")
+		}
+		doc := document.Restore(document.DocumentContent{Path: rec.Path, Doc: rec.Doc, Metadata: *rec.Meta})
+		if !col.Restore(name, &doc) {
+			return errors.New("unable to restore document")
+		}
+	case wal.OpPatch:
+		col, ok := parent.(*collection.Collection)
+		if !ok || rec.Meta == nil {
+			return errors.New("invalid patch record")
+		}
+		file, status := col.Next(name)
+		if status != http.StatusOK {
+			return errors.New("patched document does not exist")
+		}
+		doc := file.(*document.Document).Update(rec.Doc, *rec.Meta)
+		if !col.Restore(name, doc) {
+			return errors.New("unable to restore document")
+		}
+	case wal.OpDelete:
+		_, status = parent.Delete(name)
+		if status != http.StatusNoContent {
+			return fmt.Errorf("unable to delete, status %d", status)
+		}
+	case wal.OpIndex, wal.OpDropIndex:
+		file, _ := parent.Next(name)
+		col, ok := file.(*collection.Collection)
+		if !ok {
+			return errors.New("indexed collection does not exist")
+		}
+		if rec.Op == wal.OpIndex {
+			_, status = col.CreateIndex(rec.Field)
+		} else {
+			_, status = col.DropIndex(rec.Field)
+		}
+		if status >= 300 {
+			return fmt.Errorf("unable to change index, status %d", status)
+		}
+	case wal.OpACL:
+		file, _ := parent.Next(name)
+		col, ok := file.(*collection.Collection)
+		if !ok {
+			return errors.New("collection of access control list does not exist")
+		}
+		col.SetACL(rec.ACL)
+	case wal.OpSchema:
+		file, _ := parent.Next(name)
+		col, ok := file.(*collection.Collection)
+		if !ok {
+			return errors.New("collection of schema does not exist")
+		}
+		if len(rec.Schema) == 0 {
+			col.SetSchema(nil)
+			return nil
+		}
+		v, err := validation.NewValidatorFromBytes(rec.Schema)
+		if err != nil {
+			return fmt.Errorf("invalid schema: %w", err)
+		}
+		col.SetSchema(&v)
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return nil
+}
+
+// logChange appends a record of a successful change at path to the write-ahead log.
+// For document puts and patches the stored content is read back from the tree.
+func (s *System) logChange(op string, path string) error {
+	if s.log == nil {
+		return nil
+	}
+	rec, err := s.changeRecord(op, path)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Append(rec)
+	return err
+}
+
+// changeRecord returns the record of a successful change at path, reading the content
+// of put and patched documents back from the tree.
+func (s *System) changeRecord(op string, path string) (wal.Record, error) {
+	path = strings.Trim(path, "/")
+	rec := wal.Record{Op: op, Path: path}
+	paths := strings.Split(path, "/")
+	if op != wal.OpDelete && len(paths)%2 == 0 {
+		file, status := s.lookup(paths)
+		if status != http.StatusOK {
+			return rec, errors.New("changed document no longer exists")
+		}
+		doc, ok := file.(*document.Document)
+		if !ok {
+			return rec, errors.New("changed path is not a document")
+		}
+		content := doc.GetContent()
+		rec.Doc = content.Doc
+		rec.Meta = &content.Metadata
+	}
+	return rec, nil
+}
+
+// logIndex appends a record of a secondary index on field being created or dropped
+// in the collection at path to the write-ahead log.
+func (s *System) logIndex(op string, path string, field string) error {
+	if s.log == nil {
+		return nil
+	}
+	_, err := s.log.Append(wal.Record{Op: op, Path: strings.Trim(path, "/"), Field: field})
+	return err
+}
+
+// logACL appends a record of the access control list of the collection at path
+// being replaced by a, or removed if a is nil, to the write-ahead log.
+func (s *System) logACL(path string, a *acl.ACL) error {
+	if s.log == nil {
+		return nil
+	}
+	_, err := s.log.Append(wal.Record{Op: wal.OpACL, Path: strings.Trim(path, "/"), ACL: a})
+	return err
+}
+
+// logSchema appends a record of the schema of the collection at path being replaced
+// by schema, or removed if schema is empty, to the write-ahead log.
+func (s *System) logSchema(path string, schema []byte) error {
+	if s.log == nil {
+		return nil
+	}
+	_, err := s.log.Append(wal.Record{Op: wal.OpSchema, Path: strings.Trim(path, "/"), Schema: schema})
+	return err
+}
+
+// lookup walks the tree from the system along paths and returns the file at the end.
+func (s *System) lookup(paths []string) (filejson.FileJson, int) {
+	var curFile filejson.FileJson = s
+	status := http.StatusOK
+	for _, file := range paths {
+		curFile, status = curFile.Next(file)
+		if status != http.StatusOK {
+			return nil, status
+		}
+	}
+	return curFile, status
+}
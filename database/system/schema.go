@@ -0,0 +1,127 @@
+package system
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
+)
+
+// handleSchema handles requests with mode=schema on a database or collection. GET returns the
+// JSON schema of the collection itself, PUT replaces it with the schema in the body and DELETE
+// removes it. Documents already stored are not checked against a new schema.
+func (sys *System) handleSchema(w http.ResponseWriter, r *http.Request, relPath string) {
+	paths := strings.Split(relPath, "/")
+	if relPath == "" || len(paths)%2 == 0 {
+		data, _ := json.Marshal("schemas can only be set on databases and collections")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	var updated *validation.Validator
+	switch r.Method {
+	case http.MethodGet:
+		unlock := sys.rlockDatabase(paths[0])
+		defer unlock()
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			data, _ := json.Marshal("Failed to read request body")
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+		v, err := validation.NewValidatorFromBytes(body)
+		if err != nil {
+			data, _ := json.Marshal("invalid schema: " + err.Error())
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+		updated = &v
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	case http.MethodDelete:
+		unlock := sys.lockDatabase(paths[0])
+		defer unlock()
+	default:
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, status := sys.lookup(paths)
+	col, ok := file.(*collection.Collection)
+	if status != http.StatusOK || !ok {
+		data, _ := json.Marshal("unable to retrive collection: " + relPath)
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		current := col.Schema()
+		if current == nil {
+			data, _ := json.Marshal("no schema set on: " + relPath)
+			WriteJsonResponse(w, data, http.StatusNotFound)
+			return
+		}
+		WriteJsonResponse(w, current.Source(), http.StatusOK)
+		return
+	}
+
+	err := sys.setSchema(col, relPath, updated)
+	if err != nil {
+		slog.Error("Error when writing to the write-ahead log", "error", err)
+		data, _ := json.Marshal("unable to persist change")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	if updated == nil {
+		data, _ := json.Marshal("schema successfully deleted")
+		WriteJsonResponse(w, data, http.StatusNoContent)
+		return
+	}
+	WriteJsonResponse(w, updated.Source(), http.StatusOK)
+}
+
+// setSchema replaces the schema of col, the collection at path, with v and logs it.
+// The old schema is put back if the change cannot be logged. The caller must hold the write
+// lock on the database.
+func (sys *System) setSchema(col *collection.Collection, path string, v *validation.Validator) error {
+	old := col.Schema()
+	col.SetSchema(v)
+	var source []byte
+	if v != nil {
+		source = v.Source()
+	}
+	err := sys.logSchema(path, source)
+	if err != nil {
+		col.SetSchema(old)
+	}
+	return err
+}
+
+// validatorFor returns the validator for documents at paths below /v1/, which need not exist:
+// the schema of the nearest collection along paths that has one, or the global schema.
+// The caller must hold a lock on the database.
+func (sys *System) validatorFor(paths []string) validation.Validator {
+	validator := sys.validator
+	var file filejson.FileJson = sys
+	// The last path is the document itself
+	for _, name := range paths[:len(paths)-1] {
+		next, status := file.Next(name)
+		if status != http.StatusOK {
+			break
+		}
+		if col, ok := next.(*collection.Collection); ok {
+			if v := col.Schema(); v != nil {
+				validator = *v
+			}
+		}
+		file = next
+	}
+	return validator
+}
@@ -8,24 +8,76 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filter"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/jsonpatch"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/validation"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
 )
 
 // System represents the server, you can put databases into a system
 type System struct {
 	system    skiplist.SkipList[string, filejson.FileJson]
 	validator validation.Validator
+	locks     *lockTable
+	log       *wal.Log
+	dataDir   string
+	snapMu    *sync.Mutex // held while a snapshot is taken
+	snapSeq   uint64      // last log record covered by the newest snapshot
+	admins    []string    // users allowed to use /admin
+}
+
+// Config holds the options the server is started with.
+type Config struct {
+	Tokens  string         // Path to the file of string tokens (-t)
+	Schema  string         // Path to the JSON Schema file (-s)
+	DataDir string         // Directory for durable storage (-d), empty keeps everything in memory
+	Sync    wal.SyncPolicy // When the write-ahead log is synced to disk (-sync)
+
+	// How often a snapshot of the data directory is taken (-snapshot), zero disables periodic snapshots
+	SnapshotInterval time.Duration
+
+	QueueSize   int                 // Events queued for each subscriber (-queue), zero uses the default
+	QueuePolicy subscription.Policy // What to do when a subscriber's queue is full (-queue-policy)
+
+	Admins []string // Users allowed to use /admin (-admins)
+
+	Auth    string // Token backend (-auth): store, the default, keeps random tokens in memory, and signed issues HMAC-signed tokens
+	KeyFile string // Path to the key of signed tokens (-key)
+
+	// How long session tokens are valid at most (-token-lifetime), how long they stay valid
+	// without being used (-idle-timeout) and how long refresh tokens are valid (-refresh-lifetime).
+	// Zero uses the default, except for the idle timeout, which zero disables.
+	TokenLifetime   time.Duration
+	IdleTimeout     time.Duration
+	RefreshLifetime time.Duration
+
+	// How often expired tokens are removed, subscriptions whose token expired are closed and the
+	// recent events of paths without subscribers are forgotten (-sweep), zero disables sweeping
+	SweepInterval time.Duration
+}
+
+// Server is the http.Handler serving the database.
+// Close must be called on shutdown so that durable storage is flushed.
+type Server struct {
+	http.Handler
+	sys  *System
+	auth authentication.Backend
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 // NewSystem creates a new System instance with the given schema.
@@ -36,47 +88,154 @@ func NewSystem(schema string) (System, error) {
 	if err != nil {
 		return System{}, errors.New("invalid schema passed with -s")
 	}
-	return System{system: list, validator: val}, nil
+	return System{system: list, validator: val, locks: &lockTable{}, snapMu: &sync.Mutex{}}, nil
 }
 
 // New creates a new http.Handler instance with the specified tokens and schema.
 func New(tokens string, schema string) (http.Handler, error) {
-	sys, err := NewSystem(schema)
+	return NewServer(Config{Tokens: tokens, Schema: schema})
+}
+
+// NewServer creates a new Server from config.
+// If config.DataDir is set, the data stored there is loaded before the Server is returned.
+func NewServer(config Config) (*Server, error) {
+	sys, err := NewSystem(config.Schema)
 	if err != nil {
 		slog.Error(err.Error())
 		return nil, err
 	}
+	if config.DataDir != "" {
+		err = sys.openLog(config.DataDir, config.Sync)
+		if err != nil {
+			slog.Error("Error when loading data directory", "error", err)
+			return nil, err
+		}
+	}
+	sys.admins = config.Admins
+	tokens := config.Tokens
 	// Set the handlers for the appropriate paths
 	mux := http.NewServeMux()
-	subs := subscription.New()
-	auth := authentication.New()
+	subs := subscription.NewWithQueue(config.QueueSize, config.QueuePolicy)
+	auth, err := newBackend(config)
+	if err != nil {
+		slog.Error("Error when creating token backend", "error", err)
+		return nil, err
+	}
 	err = auth.UnexpiredToken(tokens)
 	if err != nil {
 		slog.Error("Error when adding tokens", "error", err)
 	}
 	handleMethods := func(w http.ResponseWriter, r *http.Request) {
-		sys.handleRequest(w, r, &auth, &subs)
+		sys.handleRequest(w, r, auth, &subs)
+	}
+	handleWebSocket := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleWebSocket(w, r, auth, &subs)
 	}
 	handleAuthentication := func(w http.ResponseWriter, r *http.Request) {
-		sys.handleAuth(w, r, &auth)
+		sys.handleAuth(w, r, auth)
+	}
+	handlePassword := func(w http.ResponseWriter, r *http.Request) {
+		sys.handlePassword(w, r, auth)
+	}
+	handleGroup := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleGroup(w, r, auth)
+	}
+	handleSnapshot := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleSnapshot(w, r, auth)
+	}
+	handleMetrics := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleMetrics(w, r, auth, &subs)
+	}
+	handleRegister := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleRegister(w, r, auth)
+	}
+	handleTokens := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleTokens(w, r, auth)
+	}
+	handleSessions := func(w http.ResponseWriter, r *http.Request) {
+		sys.handleSessions(w, r, auth)
 	}
 	mux.HandleFunc("/v1/", handleMethods)
+	mux.HandleFunc("/v1/_ws", handleWebSocket)
 	mux.HandleFunc("/auth", handleAuthentication)
-	return mux, nil
+	mux.HandleFunc("/auth/register", handleRegister)
+	mux.HandleFunc("/auth/password", handlePassword)
+	mux.HandleFunc("/groups/", handleGroup)
+	mux.HandleFunc("/admin/snapshot", handleSnapshot)
+	mux.HandleFunc("/admin/metrics", handleMetrics)
+	mux.HandleFunc("/admin/tokens", handleTokens)
+	mux.HandleFunc("/admin/users/", handleSessions)
+
+	srv := &Server{Handler: mux, sys: &sys, auth: auth, done: make(chan struct{})}
+	if sys.log != nil && config.SnapshotInterval > 0 {
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			sys.snapshotLoop(config.SnapshotInterval, srv.done)
+		}()
+	}
+	if config.SweepInterval > 0 {
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			sweepLoop(config.SweepInterval, auth, &subs, srv.done)
+		}()
+	}
+	return srv, nil
+}
+
+// Close stops the server's background work and flushes and closes its durable storage.
+func (srv *Server) Close() error {
+	close(srv.done)
+	srv.wg.Wait()
+	err := srv.auth.Close()
+	if srv.sys.log == nil {
+		return err
+	}
+	return errors.Join(srv.sys.log.Close(), err)
+}
+
+// newBackend creates the token backend selected by config. The revocation list of signed
+// tokens is kept in the data directory, if there is one.
+func newBackend(config Config) (authentication.Backend, error) {
+	lifetimes := authentication.Lifetimes{
+		Absolute: config.TokenLifetime,
+		Idle:     config.IdleTimeout,
+		Refresh:  config.RefreshLifetime,
+	}
+	switch config.Auth {
+	case "", "store":
+		auth := authentication.NewWithLifetimes(lifetimes)
+		return &auth, nil
+	case "signed":
+		if config.KeyFile == "" {
+			return nil, errors.New("signed tokens need a key file, pass it with -key")
+		}
+		key, err := authentication.LoadKey(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		revocations := ""
+		if config.DataDir != "" {
+			revocations = filepath.Join(config.DataDir, "revoked.jsonl")
+		}
+		return authentication.NewSigned(key, revocations, lifetimes)
+	}
+	return nil, fmt.Errorf("unknown token backend %q: must be store or signed", config.Auth)
 }
 
 // handleAuth handles authentication-related HTTP requests.
-// It processes POST and DELETE requests for token management.
-func (sys *System) handleAuth(w http.ResponseWriter, r *http.Request, auth *authentication.UserToken) {
+// It processes POST requests, which log in with a username and password or exchange a refresh token for
+// new tokens, and DELETE requests, which log out and also revoke the refresh token given in the body.
+func (sys *System) handleAuth(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		message, _ := json.Marshal("Failed to read request body")
 		WriteJsonResponse(w, message, http.StatusBadRequest)
 		return
 	}
-	var userName authentication.UserString
-	json.Unmarshal(body, &userName)
-	user := userName.Username
+	var creds credentials
+	json.Unmarshal(body, &creds)
 
 	switch r.Method {
 	case http.MethodOptions, "'OPTIONS'":
@@ -85,14 +244,35 @@ func (sys *System) handleAuth(w http.ResponseWriter, r *http.Request, auth *auth
 		return
 
 	case http.MethodPost, "'POST'":
-		tok, err := auth.MapToken(user)
-		if err != nil {
+		if creds.RefreshToken != "" {
+			grant, err := auth.Refresh(creds.RefreshToken)
+			if err != nil {
+				message, _ := json.Marshal(err.Error())
+				WriteJsonResponse(w, message, http.StatusUnauthorized)
+				return
+			}
+			grantBytes, _ := json.Marshal(grant)
+			WriteJsonResponse(w, grantBytes, http.StatusOK)
+			return
+		}
+		if creds.Username == "" {
 			message, _ := json.Marshal("No username in request body")
 			WriteJsonResponse(w, message, http.StatusBadRequest)
 			return
 		}
-		tokenBytes, _ := json.Marshal(authentication.Token{Token: tok})
-		WriteJsonResponse(w, tokenBytes, http.StatusOK)
+		if !sys.checkPassword(creds.Username, creds.Password) {
+			message, _ := json.Marshal("invalid username or password")
+			WriteJsonResponse(w, message, http.StatusUnauthorized)
+			return
+		}
+		grant, err := auth.Login(creds.Username)
+		if err != nil {
+			message, _ := json.Marshal(err.Error())
+			WriteJsonResponse(w, message, http.StatusInternalServerError)
+			return
+		}
+		grantBytes, _ := json.Marshal(grant)
+		WriteJsonResponse(w, grantBytes, http.StatusOK)
 		return
 
 	case http.MethodDelete, "'DELETE'":
@@ -110,6 +290,10 @@ func (sys *System) handleAuth(w http.ResponseWriter, r *http.Request, auth *auth
 			WriteJsonResponse(w, message, http.StatusUnauthorized)
 			return
 		}
+		if creds.RefreshToken != "" {
+			// The refresh token may already have been used or revoked
+			auth.DeleteToken(creds.RefreshToken)
+		}
 		w.Header().Set("content-type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.WriteHeader(status)
@@ -117,10 +301,37 @@ func (sys *System) handleAuth(w http.ResponseWriter, r *http.Request, auth *auth
 
 }
 
+// authenticate checks the bearer token in the Authorization header of r and returns the user it belongs to.
+// If the token is missing or invalid, a 401 response is written and false is returned.
+func authenticate(w http.ResponseWriter, r *http.Request, auth authentication.Backend) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		message, _ := json.Marshal("Missing or invalid bearer token")
+		WriteJsonResponse(w, message, http.StatusUnauthorized)
+		return "", false
+	}
+	user := auth.CheckToken(token)
+	if user == "" {
+		message, _ := json.Marshal("Missing or invalid bearer token")
+		WriteJsonResponse(w, message, http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// bearerToken returns the token in the Authorization header of r, or an empty string if there is none.
+func bearerToken(r *http.Request) string {
+	authTokSplit := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authTokSplit) < 2 {
+		return ""
+	}
+	return authTokSplit[1]
+}
+
 // handleRequest handles incoming HTTP requests for paths beginning with "/v1/".
 // It performs various actions based on the HTTP method, including GET, PUT, DELETE, POST, and PATCH.
 // and it supports optional subscription mode for real-time updates.
-func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *authentication.UserToken, subscribers *subscription.Subscribers) {
+func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth authentication.Backend, subscribers *subscription.Subscribers) {
 	var data []byte
 	var status int
 
@@ -130,31 +341,89 @@ func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *a
 	}
 
 	// Check whether the user is authenticated
-	authHeader := r.Header.Get("Authorization")
+	user, ok := authenticate(w, r, auth)
+	if !ok {
+		return
+	}
 
-	if authHeader == "" {
-		message, _ := json.Marshal("Missing or invalid bearer token")
-		WriteJsonResponse(w, message, http.StatusUnauthorized)
+	if isReserved(relativePath(r.URL.Path)) {
+		data, _ := json.Marshal("reserved database: " + strings.Split(relativePath(r.URL.Path), "/")[0])
+		WriteJsonResponse(w, data, http.StatusForbidden)
 		return
 	}
-	authTokSplit := strings.Split(authHeader, " ")
-	authTok := authTokSplit[1]
-	user := auth.CheckToken(authTok)
 
-	if user == "" {
-		message, _ := json.Marshal("Missing or invalid bearer token")
-		WriteJsonResponse(w, message, http.StatusUnauthorized)
+	// Batches and transactions check the permission of each operation
+	who := sys.principal(user)
+	if relativePath(r.URL.Path) == "_batch" {
+		sys.handleBatch(w, r, who, subscribers)
+		return
+	}
+	if paths := strings.Split(relativePath(r.URL.Path), "/"); len(paths) == 2 && paths[1] == "_txn" && r.Method == http.MethodPost {
+		sys.handleTxn(w, r, who, paths[0], subscribers)
 		return
 	}
 
 	var postToken string
 	event := ""
-	var wg1 sync.WaitGroup
-	var wg2 sync.WaitGroup
 	var low string
 	var up string
 	query := r.URL.Query()
 	mode := query.Get("mode")
+	if !sys.authorize(w, who, relativePath(r.URL.Path), requiredPermission(r.Method, mode, relativePath(r.URL.Path))) {
+		return
+	}
+	switch mode {
+	case "acl":
+		sys.handleACL(w, r, relativePath(r.URL.Path), subscribers)
+		return
+	case "schema":
+		sys.handleSchema(w, r, relativePath(r.URL.Path))
+		return
+	case "export":
+		sys.handleExport(w, r, relativePath(r.URL.Path))
+		return
+	case "import":
+		sys.handleImport(w, r, who, relativePath(r.URL.Path), subscribers)
+		return
+	case "index":
+		sys.handleIndex(w, r, relativePath(r.URL.Path))
+		return
+	}
+	var filt *filter.Filter
+	if query.Has("filter") {
+		var err error
+		filt, err = filter.Parse(query.Get("filter"))
+		if err != nil {
+			data, _ = json.Marshal(err.Error())
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("depth") && query.Get("depth") != "all" {
+		data, _ = json.Marshal("depth must be all")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	var limit int
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			data, _ = json.Marshal("limit must be a positive integer")
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+	}
+	var after string
+	if query.Has("cursor") {
+		var err error
+		after, err = collection.DecodeCursor(query.Get("cursor"))
+		if err != nil {
+			data, _ = json.Marshal(err.Error())
+			WriteJsonResponse(w, data, http.StatusBadRequest)
+			return
+		}
+	}
 	itv := query.Get("interval")
 	var bound string
 	if itv == "" {
@@ -168,14 +437,6 @@ func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *a
 		}
 	}
 
-	if mode == "subscribe" {
-		wg1.Add(1)
-		wg2.Add(1)
-		go func() {
-			defer wg1.Done()
-			subscribers.Serve(w, r, &wg2, bound)
-		}()
-	}
 	//curFile is the second last file in the path, lastFile is the last element in the path,
 	//lastFile's type = collection if lastFileType = 1, type = document if lastFileType = 0: size(path's elements) mod2
 	curFile, lastFileName, lastFileType, status := sys.handlePath(r.URL.Path)
@@ -187,15 +448,89 @@ func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *a
 		return
 	}
 
+	// Changes within a database are applied and logged one at a time
+	relPath := relativePath(r.URL.Path)
+	dbName := strings.Split(relPath, "/")[0]
+	unlock := func() {}
+	if isChange(r.Method) {
+		unlock = sys.lockDatabase(dbName)
+		defer unlock()
+	}
+	// Preconditions are checked under the lock, so that nothing changes before the write
+	switch r.Method {
+	case http.MethodPut, "'PUT'", http.MethodPatch, "'PATCH'", http.MethodDelete, "'DELETE'":
+		if hasPreconditions(r) {
+			target, found := curFile.Next(lastFileName)
+			if found != http.StatusOK {
+				target = nil
+			}
+			if !checkPreconditions(r, target) {
+				data, _ = json.Marshal("precondition failed")
+				WriteJsonResponse(w, data, http.StatusPreconditionFailed)
+				return
+			}
+		}
+	}
+	// Documents in collections with the owner-write rule can only be changed by their creator or an admin
+	switch r.Method {
+	case http.MethodPut, "'PUT'", http.MethodPatch, "'PATCH'", http.MethodDelete, "'DELETE'":
+		target, found := curFile.Next(lastFileName)
+		if found == http.StatusOK && !sys.mayModify(who, strings.Split(relPath, "/"), curFile, target) {
+			data, _ = json.Marshal("permission denied: only the creator of " + lastFileName + " may change it")
+			WriteJsonResponse(w, data, http.StatusForbidden)
+			return
+		}
+	}
+	// logOp is the operation written to the write-ahead log if the method succeeds,
+	// and undo puts back the file it replaces if the change cannot be logged
+	var logOp string
+	undo := txnUndo{parent: curFile, name: lastFileName}
+	if old, found := curFile.Next(lastFileName); found == http.StatusOK && isChange(r.Method) {
+		undo.old = old
+	}
+
 	//if it's a valid path, perform http methods
 	switch r.Method {
 	case http.MethodGet, "'GET'":
+		// Reads wait for changes in progress, so that they never see part of a transaction
+		unlockRead := sys.rlockDatabase(dbName)
 		curFile, status = curFile.Next(lastFileName)
 		if status != 200 {
 			data, _ = json.Marshal("unable to retrive file: " + lastFileName)
+		} else if col, ok := curFile.(*collection.Collection); ok {
+			var next string
+			data, status, next = col.GetQuery(r.Context(), collection.Query{Low: low, High: up, Filter: filt, Limit: limit, After: after})
+			if next != "" {
+				w.Header().Set("Link", nextLink(r, next))
+				w.Header().Add("Access-Control-Expose-Headers", "Link")
+			}
 		} else {
 			data, status = curFile.Get(r.Context(), up, low)
+			if doc, ok := curFile.(*document.Document); ok {
+				w.Header().Set("ETag", doc.ETag())
+				w.Header().Add("Access-Control-Expose-Headers", "ETag")
+				// The client already has this version
+				if mode != "subscribe" && notModified(r, doc) {
+					unlockRead()
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
 		}
+		// Subscribers start from this state, so register them before any change
+		if mode == "subscribe" && status == http.StatusOK {
+			opts := subscription.Options{Bound: bound, Filter: filt, Subtree: query.Get("depth") == "all", Token: bearerToken(r), Allowed: sys.readable(who)}
+			sub, initial := subscribers.Subscribe(r.URL.Path, opts, r.Header.Get("Last-Event-ID"))
+			// Replayed events catch up from the last event ID, otherwise start from a snapshot
+			if r.Header.Get("Last-Event-ID") == "" || (len(initial) > 0 && initial[0].Event == "reset") {
+				initial = append(initial, subscribers.Snapshot(sub, data)...)
+			}
+			unlockRead()
+			subscribers.Stream(w, r, sub, initial)
+			return
+		}
+		unlockRead()
 	case http.MethodPut, "'PUT'":
 		event = "update"
 		var insertedFile filejson.FileJson
@@ -236,30 +571,34 @@ func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *a
 			}
 			insertedFile = &doc
 		}
-		data, status = curFile.Put(lastFileName, insertedFile, sys.validator)
+		data, status = curFile.Put(lastFileName, insertedFile, sys.validatorFor(strings.Split(relPath, "/")))
 		if status == http.StatusBadRequest || status == http.StatusInternalServerError {
 			WriteJsonResponse(w, data, status)
 			return
 		}
+		logOp = wal.OpPut
 
 	case http.MethodDelete, "'DELETE'":
 		event = "delete"
 		data, status = curFile.Delete(lastFileName)
+		logOp = wal.OpDelete
 
 	case http.MethodPost, "'POST'":
 		event = "update"
 		curFile1, success := curFile.Next(lastFileName)
 		if success != 200 {
 			data, _ = json.Marshal("unable to retrive collection: " + lastFileName)
-
+			status = http.StatusNotFound
 		} else {
 			col, ok := curFile1.(*collection.Collection)
 			if !ok {
 				slog.Error("Error: Post: curFile is not of type *collection.Collection")
 				return
 			}
-			data, status, postToken = col.Post(user, r)
-
+			data, status, postToken = col.Post(user, r, sys.validatorFor(append(strings.Split(relPath, "/"), "")))
+			relPath = relPath + "/" + postToken
+			undo = txnUndo{parent: col, name: postToken}
+			logOp = wal.OpPut
 		}
 	case http.MethodPatch, "'PATCH'":
 		event = "update"
@@ -268,66 +607,107 @@ func (sys *System) handleRequest(w http.ResponseWriter, r *http.Request, auth *a
 		if succ != 200 || lastFileType == 1 {
 			fmt.Println(succ)
 			data, _ = json.Marshal("unable to retrive document: " + lastFileName)
+			status = http.StatusNotFound
 
 		} else {
 			doc := nextfile.(*document.Document)
 			createdBy := doc.GetCreatedBy()
 			createdAt := doc.GetCreatedAt()
-			doc, data, status = doc.Patch(user, r, createdAt, createdBy, sys.validator)
-			if status != 200 {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			validator := sys.validatorFor(strings.Split(relPath, "/"))
+			var patched *document.Document
+			if mediaType == jsonpatch.MergeMediaType {
+				patched, data, status = doc.MergePatch(user, r, validator)
+			} else {
+				patched, data, status = doc.Patch(user, r, createdAt, createdBy, validator)
+			}
+			// A failed patch returns the document unchanged, and there is nothing to store
+			if status != 200 || patched == doc {
 				WriteJsonResponse(w, data, status)
 				return
 			}
-			insertedFile = doc
-			curFile.Put(lastFileName, insertedFile, sys.validator)
+			insertedFile = patched
+			curFile.Put(lastFileName, insertedFile, validator)
+			logOp = wal.OpPatch
 		}
 	default:
 		data, _ = json.Marshal("Method not found or unsupported") // Check with swagger
 		status = http.StatusMethodNotAllowed
 	}
-	if mode == "subscribe" {
-		wg2.Wait()
-		subscribers.Notify(r.URL.Path, "update", data)
-	} else {
-		WriteJsonResponse(w, data, status)
+	if logOp != "" && status >= 200 && status < 300 {
+		err := sys.logChange(logOp, relPath)
+		if err != nil {
+			slog.Error("Error when writing to the write-ahead log", "error", err)
+			sys.rollback([]txnChange{{undo: undo}})
+			data, _ = json.Marshal("unable to persist change")
+			status = http.StatusInternalServerError
+			event = ""
+		}
+	}
+	if (logOp == wal.OpPut || logOp == wal.OpPatch) && status >= 200 && status < 300 {
+		file, _ := sys.lookup(strings.Split(relPath, "/"))
+		if doc, ok := file.(*document.Document); ok {
+			w.Header().Set("ETag", doc.ETag())
+			w.Header().Add("Access-Control-Expose-Headers", "ETag")
+		}
+	}
+	WriteJsonResponse(w, data, status)
 
-		if event != "" {
-			if event == "delete" {
-				notiPath := r.URL.Path
-				determinPath := strings.Trim(notiPath, "/")
-				determinPaths := strings.Split(determinPath, "/")
-				if len(determinPaths) == 2 {
-					// the delete url of db has no suffix /, add it
-					notiPath = notiPath + "/"
-				}
+	if event != "" {
+		if r.Method == http.MethodPost {
+			sys.notify(subscribers, r.URL.Path+postToken, event)
+		} else {
+			sys.notify(subscribers, r.URL.Path, event)
+		}
+	}
+	unlock()
 
-				index1 := strings.Index(notiPath, "/v1/")
-				pathDel := notiPath[index1+4:]
-				index2 := strings.Index(pathDel, "/")
-				var pathDel2 string
-				pathDel2 = pathDel[index2:]
-				dataDel, err := json.Marshal(pathDel2)
-				if err != nil {
-					slog.Error("Error in Marshal notify path")
-				}
+}
 
-				subscribers.Notify(notiPath, event, dataDel)
-			} else {
-				if r.Method == http.MethodPost {
-					curFile, _ = curFile.Next(lastFileName)
-					curFile, _ = curFile.Next(postToken)
-					data, status = curFile.Get(r.Context(), "", "")
-					subscribers.Notify(r.URL.Path+postToken, event, data)
-				} else {
-					curFile, _ = curFile.Next(lastFileName)
-					data, status = curFile.Get(r.Context(), "", "")
-					subscribers.Notify(r.URL.Path, event, data)
-				}
-			}
+// notify tells subscribers about an event at urlPath, the path of the changed file starting with /v1/.
+// Updates carry the file's new contents and deletes the path of the file relative to its database.
+func (sys *System) notify(subscribers *subscription.Subscribers, urlPath string, event string) {
+	if event == "delete" {
+		determinPaths := strings.Split(strings.Trim(urlPath, "/"), "/")
+		if len(determinPaths) == 2 {
+			// the delete url of db has no suffix /, add it
+			urlPath = urlPath + "/"
 		}
+		pathDel := urlPath[strings.Index(urlPath, "/v1/")+4:]
+		dataDel, err := json.Marshal(pathDel[strings.Index(pathDel, "/"):])
+		if err != nil {
+			slog.Error("Error in Marshal notify path")
+		}
+		subscribers.Notify(urlPath, event, dataDel)
+		return
 	}
-	wg1.Wait()
+	file, status := sys.lookup(strings.Split(relativePath(urlPath), "/"))
+	if status != http.StatusOK {
+		return
+	}
+	data, _ := file.Get(context.Background(), "", "")
+	subscribers.Notify(urlPath, event, data)
+}
 
+// nextLink returns the Link header value pointing at the page of r's listing that follows the document docName.
+func nextLink(r *http.Request, docName string) string {
+	query := r.URL.Query()
+	query.Set("cursor", collection.EncodeCursor(docName))
+	return "<" + r.URL.Path + "?" + query.Encode() + ">; rel=\"next\""
+}
+
+// relativePath returns the part of url after /v1/ without leading or trailing slashes.
+func relativePath(url string) string {
+	return strings.Trim(url[strings.Index(url, "/v1/")+4:], "/")
+}
+
+// isChange reports whether method modifies the stored data.
+func isChange(method string) bool {
+	switch method {
+	case http.MethodPut, "'PUT'", http.MethodDelete, "'DELETE'", http.MethodPost, "'POST'", http.MethodPatch, "'PATCH'":
+		return true
+	}
+	return false
 }
 
 // Options handles HTTP OPTIONS requests.
@@ -336,7 +716,8 @@ func Options(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Allow", "GET,POST,PUT,DELETE,OPTIONS,PATCH")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS,PATCH")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,If-Match,If-None-Match,Last-Event-ID")
+	w.Header().Set("Accept-Patch", jsonpatch.MediaType+","+jsonpatch.MergeMediaType)
 	w.WriteHeader(http.StatusOK)
 }
 
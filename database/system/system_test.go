@@ -3,15 +3,34 @@ package system
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/websocket"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testPassword is the password of the accounts created by login.
+const testPassword = "password1"
+
+// Password hashing is deliberately slow, so tests use the lowest cost.
+func init() {
+	authentication.PasswordCost = bcrypt.MinCost
+}
+
 // initSystem initializes a new System using the specified schema file.
 // Returns an instance of the System.
 func initSystem() System {
@@ -25,15 +44,17 @@ func initSystem() System {
 func TestHandler(t *testing.T) {
 	s := initSystem()
 	auth := authentication.New()
-	authreader := bytes.NewBufferString("{\"username\": \"a_user\"}")
 	response := httptest.NewRecorder()
+	s.handleRegister(response, httptest.NewRequest("POST", "/auth/register", strings.NewReader(`{"username": "a_user", "password": "`+testPassword+`"}`)), &auth)
+	authreader := bytes.NewBufferString(`{"username": "a_user", "password": "` + testPassword + `"}`)
+	response = httptest.NewRecorder()
 	r0, _ := http.NewRequest("POST", "/auth/", authreader)
 	r0.Header.Set("Accept", "application/json")
 	r0.Header.Set("Content-Type", "application/json")
 	s.handleAuth(response, r0, &auth)
-	token := response.Body.String()
-	token = strings.Split(token, ":")[1]
-	token = token[1 : len(token)-2]
+	var grant authentication.Grant
+	json.Unmarshal(response.Body.Bytes(), &grant)
+	token := grant.Token
 
 	body := []byte("{}")
 	reader := bytes.NewReader(body)
@@ -88,3 +109,1333 @@ func TestInitServer(t *testing.T) {
 	}
 
 }
+
+// login registers user with testPassword, unless already registered, and requests a token for user from handler.
+func login(t *testing.T, handler http.Handler, user string) string {
+	creds := `{"username": "` + user + `", "password": "` + testPassword + `"}`
+	response := httptest.NewRecorder()
+	register := httptest.NewRequest("POST", "/auth/register", strings.NewReader(creds))
+	// Admins are registered by an admin, as with a token from the token file
+	if server, ok := handler.(*Server); ok && server.sys.isAdmin(user) {
+		token, _ := server.auth.MapToken(user)
+		register.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.ServeHTTP(response, register)
+	if response.Code != http.StatusCreated && response.Code != http.StatusConflict {
+		t.Fatalf("registration failed: %s", response.Body.String())
+	}
+	response = httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/auth", strings.NewReader(creds))
+	handler.ServeHTTP(response, r)
+	var token authentication.Token
+	err := json.Unmarshal(response.Body.Bytes(), &token)
+	if err != nil || token.Token == "" {
+		t.Fatalf("login failed: %s", response.Body.String())
+	}
+	return token.Token
+}
+
+// request sends an authenticated request to handler and returns the recorded response.
+func request(handler http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	return requestWithHeaders(handler, method, path, token, body, nil)
+}
+
+// requestWithHeaders is like request but also sets the given request headers.
+func requestWithHeaders(handler http.Handler, method string, path string, token string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	handler.ServeHTTP(response, r)
+	return response
+}
+
+// streamRecorder records a stream of server-sent events, which can be read while it is written.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	written chan struct{} // receives after each write
+}
+
+// newStreamRecorder creates an empty streamRecorder.
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{}, 1)}
+}
+
+func (r *streamRecorder) Write(data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.ResponseRecorder.Write(data)
+	select {
+	case r.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func (r *streamRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ResponseRecorder.Flush()
+}
+
+// waitFor waits until the body contains every string in expected and returns it, or fails the test.
+func (r *streamRecorder) waitFor(t *testing.T, expected ...string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		r.mu.Lock()
+		body := r.Body.String()
+		r.mu.Unlock()
+		missing := false
+		for _, e := range expected {
+			missing = missing || !strings.Contains(body, e)
+		}
+		if !missing {
+			return body
+		}
+		select {
+		case <-r.written:
+		case <-timeout:
+			t.Fatalf("Expected %q in %s", expected, body)
+		}
+	}
+}
+
+// TestRestart checks that data written with a data directory survives a restart,
+// including documents that were patched, posted, and deleted.
+func TestRestart(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Server initialization failed: %v", err)
+	}
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": [1]}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+	request(server, "PUT", "/v1/db1/doc1/col/doc2", token, `{"b": 2}`)
+	request(server, "PATCH", "/v1/db1/doc1", token, `[{"op": "ArrayAdd", "path": "/a", "value": 2}]`)
+	request(server, "PUT", "/v1/db1/gone", token, `{}`)
+	request(server, "DELETE", "/v1/db1/gone", token, "")
+	posted := request(server, "POST", "/v1/db1/doc1/col/", token, `{"c": 3}`)
+	var uri map[string]string
+	json.Unmarshal(posted.Body.Bytes(), &uri)
+	server.Close()
+
+	server, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("Server restart failed: %v", err)
+	}
+	defer server.Close()
+	token = login(t, server, "a_user")
+
+	resp := request(server, "GET", "/v1/db1/doc1", token, "")
+	var content document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &content)
+	if resp.Code != http.StatusOK || string(content.Doc) != `{"a":[1,2]}` || content.Metadata.CreatedBy != "a_user" {
+		t.Errorf("Patched document not restored: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request(server, "GET", "/v1/db1/doc1/col/doc2", token, "")
+	if resp.Code != http.StatusOK {
+		t.Errorf("Nested document not restored: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request(server, "GET", uri["uri"], token, "")
+	if resp.Code != http.StatusOK {
+		t.Errorf("Posted document not restored: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request(server, "GET", "/v1/db1/gone", token, "")
+	if resp.Code == http.StatusOK {
+		t.Error("Deleted document was restored")
+	}
+}
+
+// TestUnloggedChange checks that changes which cannot be written to the log are rolled back.
+func TestUnloggedChange(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	defer server.Close()
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a":1}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+	server.sys.log.Close()
+
+	for _, change := range []struct{ method, path, body string }{
+		{"PUT", "/v1/db2", ""},
+		{"PUT", "/v1/db1/doc2", `{"b":2}`},
+		{"PUT", "/v1/db1/doc1", `{"a":2}`},
+		{"PATCH", "/v1/db1/doc1", `[{"op": "ObjectAdd", "path": "/c", "value": 3}]`},
+		{"DELETE", "/v1/db1/doc1", ""},
+		{"POST", "/v1/db1/doc1/col/", `{"d":4}`},
+		{"PUT", "/v1/db1?mode=acl", `{"users": {"other_user": "admin"}}`},
+		{"PUT", "/v1/db1/?mode=index&field=/a", ""},
+	} {
+		if resp := request(server, change.method, change.path, token, change.body); resp.Code != http.StatusInternalServerError {
+			t.Errorf("Expected %s %s to fail, got %d", change.method, change.path, resp.Code)
+		}
+	}
+	if resp := request(server, "GET", "/v1/db2/", token, ""); resp.Code == http.StatusOK {
+		t.Errorf("Expected the new database to be rolled back, got %d", resp.Code)
+	}
+	if resp := request(server, "GET", "/v1/db1/doc2", token, ""); resp.Code == http.StatusOK {
+		t.Errorf("Expected the new document to be rolled back, got %d", resp.Code)
+	}
+	resp := request(server, "GET", "/v1/db1/doc1", token, "")
+	var content document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &content)
+	if resp.Code != http.StatusOK || string(content.Doc) != `{"a":1}` {
+		t.Errorf("Expected the document to be restored, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/db1/doc1/col/", token, ""); resp.Code != http.StatusOK || resp.Body.String() != "[]" {
+		t.Errorf("Expected the posted document to be rolled back, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/db1?mode=acl", token, ""); strings.Contains(resp.Body.String(), "other_user") {
+		t.Errorf("Expected the access control list to be rolled back, got %s", resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/db1/?mode=index", token, ""); strings.Contains(resp.Body.String(), "/a") {
+		t.Errorf("Expected the index to be rolled back, got %s", resp.Body.String())
+	}
+	resp = request(server, "POST", "/v1/db1?mode=import", token, `{"path":"/doc3","doc":{"a":3}}`+"\n")
+	if !strings.Contains(resp.Body.String(), `"status":500`) {
+		t.Errorf("Expected the import to fail, got %s", resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/db1/doc3", token, ""); resp.Code == http.StatusOK {
+		t.Errorf("Expected the imported document to be rolled back, got %d", resp.Code)
+	}
+}
+
+// TestSnapshot checks that a snapshot taken through the admin endpoint truncates the log
+// and that a restart loads the snapshot followed by the changes made after it.
+func TestSnapshot(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir(), Admins: []string{"a_user"}}
+	server, _ := NewServer(config)
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+	request(server, "PUT", "/v1/db1/doc1/col/doc2", token, `{"b": 2}`)
+
+	// The account of a_user accounts for the first two records
+	resp := request(server, "POST", "/admin/snapshot", token, "")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"seq":6}` {
+		t.Fatalf("Snapshot failed: %d %s", resp.Code, resp.Body.String())
+	}
+	request(server, "PUT", "/v1/db1/doc3", token, `{"c": 3}`)
+	request(server, "DELETE", "/v1/db1/doc1/col/doc2", token, "")
+	server.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(config.DataDir, "*.wal"))
+	if len(segments) != 1 {
+		t.Errorf("Expected the snapshotted log to be truncated, found %v", segments)
+	}
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Server restart failed: %v", err)
+	}
+	defer server.Close()
+	token = login(t, server, "a_user")
+	for path, exists := range map[string]bool{
+		"/v1/db1/doc1":          true,
+		"/v1/db1/doc3":          true,
+		"/v1/db1/doc1/col/doc2": false,
+	} {
+		resp = request(server, "GET", path, token, "")
+		if (resp.Code == http.StatusOK) != exists {
+			t.Errorf("Expected %s to exist: %t, got %d after restart", path, exists, resp.Code)
+		}
+	}
+}
+
+// TestExportImport checks that an exported database is recreated by importing it under
+// another name, with its metadata preserved, and that every import line gets a result.
+func TestExportImport(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+	request(server, "PUT", "/v1/db1/doc1/empty/", token, "")
+	request(server, "PUT", "/v1/db1/doc1/col/doc2", token, `{"b": 2}`)
+
+	resp := request(server, "GET", "/v1/db1?mode=export", token, "")
+	lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+	if resp.Code != http.StatusOK || len(lines) != 4 {
+		t.Fatalf("Unexpected export: %d %s", resp.Code, resp.Body.String())
+	}
+	if !strings.HasPrefix(lines[0], `{"path":"/doc1","doc":{"a":1},"meta":{"createdBy":"a_user"`) || lines[1] != `{"path":"/doc1/col/"}` {
+		t.Errorf("Unexpected export lines: %v", lines)
+	}
+
+	other := login(t, server, "b_user")
+	body := resp.Body.String() + "not json\n" + `{"path":"/missing/col/doc"}` + "\n"
+	resp = request(server, "POST", "/v1/db2?mode=import", other, body)
+	var results []importResult
+	json.Unmarshal(resp.Body.Bytes(), &results)
+	if resp.Code != http.StatusOK || len(results) != 6 {
+		t.Fatalf("Unexpected import response: %d %s", resp.Code, resp.Body.String())
+	}
+	for i, status := range []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest} {
+		if results[i].Status != status || results[i].Line != i+1 {
+			t.Errorf("Expected line %d to have status %d, got %+v", i+1, status, results[i])
+		}
+	}
+
+	resp = request(server, "GET", "/v1/db2/doc1/col/doc2", other, "")
+	var content document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &content)
+	if resp.Code != http.StatusOK || content.Metadata.CreatedBy != "a_user" {
+		t.Errorf("Imported document does not keep its metadata: %s", resp.Body.String())
+	}
+	resp = request(server, "GET", "/v1/db2/doc1/empty/", other, "")
+	if resp.Code != http.StatusOK {
+		t.Errorf("Empty collection was not imported: %d", resp.Code)
+	}
+}
+
+// TestNoDefaultACL checks that databases created by a PUT or an import have no access control
+// list unless one is set, also after a restart.
+func TestNoDefaultACL(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	owner := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", owner, "")
+	request(server, "PUT", "/v1/db1/doc1", owner, `{"a":1}`)
+	if resp := request(server, "POST", "/v1/db2?mode=import", owner, `{"path":"/doc1","doc":{"a":1}}`+"\n"); resp.Code != http.StatusOK {
+		t.Fatalf("Import failed: %d %s", resp.Code, resp.Body.String())
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	other := login(t, server, "b_user")
+	for _, db := range []string{"db1", "db2"} {
+		if resp := request(server, "GET", "/v1/"+db+"?mode=acl", other, ""); resp.Code != http.StatusOK || resp.Body.String() != "{}" {
+			t.Errorf("Expected %s to have no access control list, got %d %s", db, resp.Code, resp.Body.String())
+		}
+		if resp := request(server, "GET", "/v1/"+db+"/doc1", other, ""); resp.Code != http.StatusOK {
+			t.Errorf("Expected %s to be open to other users, got %d", db, resp.Code)
+		}
+	}
+}
+
+// TestReimport checks that importing an existing document updates it without dropping its
+// nested collections, also after a restart.
+func TestReimport(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+	request(server, "PUT", "/v1/db1/doc1/col/doc2", token, `{"b": 2}`)
+	resp := request(server, "POST", "/v1/db1?mode=import", token, `{"path":"/doc1","doc":{"a":2}}`+"\n")
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"status":200`) {
+		t.Fatalf("Import failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	for restarted := 0; restarted < 2; restarted++ {
+		resp = request(server, "GET", "/v1/db1/doc1", token, "")
+		var content document.DocumentContent
+		json.Unmarshal(resp.Body.Bytes(), &content)
+		if resp.Code != http.StatusOK || string(content.Doc) != `{"a":2}` {
+			t.Errorf("Expected the imported document to be updated, got %d %s", resp.Code, resp.Body.String())
+		}
+		if resp = request(server, "GET", "/v1/db1/doc1/col/doc2", token, ""); resp.Code != http.StatusOK {
+			t.Errorf("Expected the nested collection to survive the import, got %d (restarted: %d)", resp.Code, restarted)
+		}
+		server.Close()
+		server, _ = NewServer(config)
+		token = login(t, server, "a_user")
+	}
+	server.Close()
+}
+
+// TestFilter checks that collection GETs only return documents matching the filter
+// and that malformed filters are rejected.
+func TestFilter(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/post1", token, `{"author": "alice", "priority": 1}`)
+	request(server, "PUT", "/v1/db1/post2", token, `{"author": "bob", "priority": 5}`)
+	request(server, "PUT", "/v1/db1/post3", token, `{"author": "alice", "priority": 4}`)
+
+	resp := request(server, "GET", "/v1/db1/?filter="+url.QueryEscape(`/author == "alice" && /priority > 3`), token, "")
+	var docs []document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &docs)
+	if resp.Code != http.StatusOK || len(docs) != 1 || docs[0].Path != "/post3" {
+		t.Errorf("Unexpected filtered documents: %d %s", resp.Code, resp.Body.String())
+	}
+
+	resp = request(server, "GET", "/v1/db1/?filter="+url.QueryEscape(`/author ==`), token, "")
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed filter, got %d", resp.Code)
+	}
+}
+
+// Test following the Link header through a paged collection listing.
+func TestPagination(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	for _, name := range []string{"p1", "p2", "p3", "p4", "p5"} {
+		request(server, "PUT", "/v1/db1/"+name, token, `{"n": 1}`)
+	}
+
+	seen := make([]string, 0)
+	next := "/v1/db1/?limit=2"
+	for pages := 0; next != "" && pages < 10; pages++ {
+		resp := request(server, "GET", next, token, "")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %d %s", resp.Code, resp.Body.String())
+		}
+		var docs []document.DocumentContent
+		json.Unmarshal(resp.Body.Bytes(), &docs)
+		for _, doc := range docs {
+			seen = append(seen, doc.Path)
+		}
+		next = ""
+		link := resp.Header().Get("Link")
+		if link != "" {
+			next = strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<")
+		}
+	}
+	if strings.Join(seen, " ") != "/p1 /p2 /p3 /p4 /p5" {
+		t.Errorf("Unexpected pages: %v", seen)
+	}
+
+	resp := request(server, "GET", "/v1/db1/?limit=0", token, "")
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a zero limit, got %d", resp.Code)
+	}
+	resp = request(server, "GET", "/v1/db1/?cursor=%21", token, "")
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cursor, got %d", resp.Code)
+	}
+}
+
+// Test declaring an index and querying through it across a restart.
+func TestIndex(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/post1", token, `{"author": "alice"}`)
+	request(server, "PUT", "/v1/db1/post2", token, `{"author": "bob"}`)
+
+	resp := request(server, "PUT", "/v1/db1/?mode=index&field=/author", token, "")
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected index to be created, got %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request(server, "PUT", "/v1/db1/post1?mode=index&field=/author", token, "")
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an index on a document, got %d", resp.Code)
+	}
+	// The index is restored from the snapshot and the changes after it from the log
+	request(server, "POST", "/admin/snapshot", token, "")
+	request(server, "PATCH", "/v1/db1/post2", token, `[{"op": "ObjectAdd", "path": "/extra", "value": 1}]`)
+	request(server, "PUT", "/v1/db1/post3", token, `{"author": "alice"}`)
+	request(server, "DELETE", "/v1/db1/post1", token, "")
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	token = login(t, server, "a_user")
+	resp = request(server, "GET", "/v1/db1/?mode=index", token, "")
+	if resp.Body.String() != `["/author"]` {
+		t.Errorf("Index not restored: %s", resp.Body.String())
+	}
+	resp = request(server, "GET", "/v1/db1/?filter="+url.QueryEscape(`/author == "alice"`), token, "")
+	var docs []document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &docs)
+	if len(docs) != 1 || docs[0].Path != "/post3" {
+		t.Errorf("Unexpected documents for alice: %s", resp.Body.String())
+	}
+
+	resp = request(server, "DELETE", "/v1/db1/?mode=index&field=/author", token, "")
+	if resp.Code != http.StatusNoContent {
+		t.Errorf("Expected index to be dropped, got %d", resp.Code)
+	}
+}
+
+// Test merge patching a document, which keeps its nested collections and survives a restart.
+func TestMergePatch(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"title": "old", "tags": ["a"], "draft": true}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", token, "")
+
+	response := requestWithHeaders(server, "PATCH", "/v1/db1/doc1", token, `{"title": "new", "draft": null}`,
+		map[string]string{"Content-Type": "application/merge-patch+json"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected merge patch to succeed, got %d %s", response.Code, response.Body.String())
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	token = login(t, server, "a_user")
+	resp := request(server, "GET", "/v1/db1/doc1", token, "")
+	var content document.DocumentContent
+	json.Unmarshal(resp.Body.Bytes(), &content)
+	if string(content.Doc) != `{"tags":["a"],"title":"new"}` || content.Metadata.LastModifiedBy != "a_user" {
+		t.Errorf("Unexpected merged document: %s", resp.Body.String())
+	}
+	resp = request(server, "GET", "/v1/db1/doc1/col/", token, "")
+	if resp.Code != http.StatusOK {
+		t.Errorf("Nested collection lost by merge patch: %d", resp.Code)
+	}
+}
+
+// Test that a patch with a failing operation stores nothing.
+func TestPatchAtomic(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": [1]}`)
+	before := request(server, "GET", "/v1/db1/doc1", token, "").Body.String()
+
+	other := login(t, server, "other_user")
+	request(server, "PUT", "/v1/db1?mode=acl", token, `{"users": {"a_user": "admin", "other_user": "write"}}`)
+	resp := request(server, "PATCH", "/v1/db1/doc1", other, `[{"op": "ArrayAdd", "path": "/a", "value": 2}, {"op": "ArrayRemove", "path": "/b", "value": 1}]`)
+	var result document.PatchResult
+	json.Unmarshal(resp.Body.Bytes(), &result)
+	if resp.Code != http.StatusOK || !result.PatchFailed {
+		t.Errorf("Expected a failed patch result for a failing patch, got %d %s", resp.Code, resp.Body.String())
+	}
+	after := request(server, "GET", "/v1/db1/doc1", token, "").Body.String()
+	if before != after {
+		t.Errorf("Failed patch changed the document from %s to %s", before, after)
+	}
+}
+
+// Test conditional PUT, PATCH and DELETE with entity tags.
+func TestConditional(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	resp := request(server, "PUT", "/v1/db1/doc1", token, `{"a": 1}`)
+	etag := resp.Header().Get("ETag")
+	if etag == "" || request(server, "GET", "/v1/db1/doc1", token, "").Header().Get("ETag") != etag {
+		t.Fatalf("Expected matching ETags from PUT and GET, got %q", etag)
+	}
+	for value, status := range map[string]int{etag: http.StatusNotModified, "W/" + etag: http.StatusNotModified, "*": http.StatusNotModified, `"stale"`: http.StatusOK} {
+		resp = requestWithHeaders(server, "GET", "/v1/db1/doc1", token, "", map[string]string{"If-None-Match": value})
+		if resp.Code != status || (status == http.StatusNotModified && (resp.Body.Len() != 0 || resp.Header().Get("ETag") != etag)) {
+			t.Errorf("GET with If-None-Match %s: expected %d, got %d %s", value, status, resp.Code, resp.Body.String())
+		}
+	}
+
+	tests := []struct {
+		method, path, body, header, value string
+		status                            int
+	}{
+		{"PUT", "/v1/db1/doc1", `{"a": 2}`, "If-None-Match", "*", http.StatusPreconditionFailed},
+		{"PUT", "/v1/db1/doc2", `{"a": 2}`, "If-None-Match", "*", http.StatusCreated},
+		{"PUT", "/v1/db1/doc3", `{"a": 2}`, "If-Match", "*", http.StatusPreconditionFailed},
+		{"PUT", "/v1/db1/doc1", `{"a": 2}`, "If-Match", `"stale"`, http.StatusPreconditionFailed},
+		{"PATCH", "/v1/db1/doc1", `[{"op": "ObjectAdd", "path": "/b", "value": 1}]`, "If-Match", `W/` + etag, http.StatusPreconditionFailed},
+		{"PATCH", "/v1/db1/doc1", `[{"op": "ObjectAdd", "path": "/b", "value": 1}]`, "If-Match", `"stale", ` + etag, http.StatusOK},
+		{"DELETE", "/v1/db1/doc1", "", "If-Match", etag, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		resp = requestWithHeaders(server, test.method, test.path, token, test.body, map[string]string{test.header: test.value})
+		if resp.Code != test.status {
+			t.Errorf("%s %s with %s %s: expected %d, got %d %s", test.method, test.path, test.header, test.value, test.status, resp.Code, resp.Body.String())
+		}
+	}
+
+	etag = request(server, "GET", "/v1/db1/doc1", token, "").Header().Get("ETag")
+	resp = requestWithHeaders(server, "DELETE", "/v1/db1/doc1", token, "", map[string]string{"If-Match": etag})
+	if resp.Code != http.StatusNoContent {
+		t.Errorf("Expected delete with current ETag to succeed, got %d", resp.Code)
+	}
+}
+
+// Test that a transaction either applies all of its operations or none of them, across a restart.
+func TestTxn(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/from", token, `{"balance": 10}`)
+	etag := request(server, "GET", "/v1/db1/from", token, "").Header().Get("ETag")
+
+	resp := request(server, "POST", "/v1/db1/_txn", token, `{"ops": [
+		{"method": "PATCH", "path": "/from", "contentType": "application/merge-patch+json", "body": {"balance": 5}, "ifMatch": `+strconv.Quote(etag)+`},
+		{"method": "PUT", "path": "/to", "body": {"balance": 5}, "ifNoneMatch": "*"},
+		{"method": "PUT", "path": "/to/log/"}
+	]}`)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"committed":true`) {
+		t.Fatalf("Expected transaction to commit, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	// The stale precondition fails after the first operation was applied, which is rolled back
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"ops": [{"method": "DELETE", "path": "/to"}, {"method": "PATCH", "path": "/from", "body": {"balance": 0}, "contentType": "application/merge-patch+json", "ifMatch": ` + strconv.Quote(etag) + `}]}`, http.StatusPreconditionFailed},
+		{`{"ops": [{"method": "DELETE", "path": "/to"}, {"method": "PUT", "path": "/missing/col/doc", "body": {}}]}`, http.StatusNotFound},
+		{`{"ops": [{"method": "DELETE", "path": "/to"}, {"method": "GET", "path": "/from"}]}`, http.StatusBadRequest},
+		{`{"ops": [{"method": "DELETE", "path": "/to"}, {"method": "PATCH", "path": "/from", "body": [{"op": "ArrayAdd", "path": "/missing/x", "value": 1}]}]}`, http.StatusBadRequest},
+		{`{"ops": []}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp = request(server, "POST", "/v1/db1/_txn", token, test.body)
+		if resp.Code != test.status || strings.Contains(resp.Body.String(), `"committed":true`) {
+			t.Errorf("%s: expected %d, got %d %s", test.body, test.status, resp.Code, resp.Body.String())
+		}
+	}
+	if resp = request(server, "GET", "/v1/db1/to/log/", token, ""); resp.Code != http.StatusOK {
+		t.Errorf("Expected rolled back delete to keep nested collections, got %d", resp.Code)
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	token = login(t, server, "a_user")
+	for path, balance := range map[string]string{"/v1/db1/from": `{"balance":5}`, "/v1/db1/to": `{"balance":5}`} {
+		var doc document.DocumentContent
+		json.Unmarshal(request(server, "GET", path, token, "").Body.Bytes(), &doc)
+		if string(doc.Doc) != balance {
+			t.Errorf("%s: expected %s after restart, got %s", path, balance, string(doc.Doc))
+		}
+	}
+}
+
+// Test a batch that spans databases, with and without stopping on the first error.
+func TestBatch(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db2", token, "")
+
+	body := `[
+		{"method": "PUT", "path": "/db1/doc1", "body": {"a": 1}},
+		{"method": "PUT", "path": "/db1/missing/col/doc", "body": {}},
+		{"method": "PUT", "path": "/db2/doc1", "body": {"a": 2}},
+		{"method": "PUT", "path": "/db1"},
+		{"method": "POST", "path": "/db1/", "body": {"a": 3}}
+	]`
+	resp := request(server, "POST", "/v1/_batch", token, body)
+	var results []txnResult
+	json.Unmarshal(resp.Body.Bytes(), &results)
+	expected := []int{http.StatusCreated, http.StatusNotFound, http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest}
+	if resp.Code != http.StatusOK || len(results) != len(expected) {
+		t.Fatalf("Unexpected batch response %d %s", resp.Code, resp.Body.String())
+	}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Errorf("Operation %d: expected %d, got %d %s", i, status, results[i].Status, results[i].Message)
+		}
+	}
+	// Databases and posted documents are rejected with the reason
+	if !strings.Contains(results[3].Message, "cannot create or delete databases") || !strings.Contains(results[4].Message, "cannot POST") {
+		t.Errorf("Expected the batch limits in the messages, got %s", resp.Body.String())
+	}
+
+	resp = request(server, "POST", "/v1/_batch?stopOnError=true", token, `[
+		{"method": "DELETE", "path": "/db1/doc1"},
+		{"method": "PATCH", "path": "/db1/doc1", "body": []},
+		{"method": "DELETE", "path": "/db2/doc1"}
+	]`)
+	json.Unmarshal(resp.Body.Bytes(), &results)
+	if len(results) != 3 || results[0].Status != http.StatusNoContent || results[1].Status != http.StatusNotFound || results[2].Status != 0 {
+		t.Errorf("Unexpected batch response with stopOnError %s", resp.Body.String())
+	}
+	if resp = request(server, "GET", "/v1/db2/doc1", token, ""); resp.Code != http.StatusOK {
+		t.Errorf("Expected operation after the failure not to be applied, got %d", resp.Code)
+	}
+}
+
+// Test subscribing to several paths over one WebSocket.
+func TestWebSocket(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+
+	conn, err := websocket.Dial(httpServer.URL+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("Unable to open websocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	exchange := func(message string) wsResponse {
+		if message != "" {
+			conn.WriteMessage([]byte(message))
+		}
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unable to read from websocket: %v", err)
+		}
+		var resp wsResponse
+		json.Unmarshal(data, &resp)
+		return resp
+	}
+
+	if resp := exchange(`{"type": "auth", "token": "` + token + `"}`); resp.Type != "auth" {
+		t.Fatalf("Expected authentication to succeed, got %+v", resp)
+	}
+	if resp := exchange(`{"type": "subscribe", "path": "/v1/db1"}`); resp.Type != "subscribed" || resp.Path != "/v1/db1/" {
+		t.Fatalf("Expected subscription to the database, got %+v", resp)
+	}
+	if resp := exchange(`{"type": "subscribe", "path": "/v1/db1/missing/col"}`); resp.Type != "error" {
+		t.Errorf("Expected an error for a missing path, got %+v", resp)
+	}
+	request(server, "PUT", "/v1/db1/doc1", token, `{"a": 1}`)
+	if resp := exchange(""); resp.Type != "event" || resp.Path != "/v1/db1/" || resp.Event != "update" {
+		t.Errorf("Expected an update event for the database, got %+v", resp)
+	}
+	if resp := exchange(`{"type": "subscribe", "path": "/v1/db1/doc1"}`); resp.Type != "subscribed" {
+		t.Fatalf("Expected subscription to the document, got %+v", resp)
+	}
+	// New subscribers start from the current state
+	if resp := exchange(""); resp.Type != "event" || resp.Path != "/v1/db1/doc1" || resp.Event != "update" || !strings.Contains(string(resp.Data), `"a":1`) {
+		t.Errorf("Expected a snapshot of the document, got %+v", resp)
+	}
+	if resp := exchange(`{"type": "unsubscribe", "path": "/v1/db1/"}`); resp.Type != "unsubscribed" {
+		t.Fatalf("Expected to unsubscribe from the database, got %+v", resp)
+	}
+	request(server, "DELETE", "/v1/db1/doc1", token, "")
+	if resp := exchange(""); resp.Type != "event" || resp.Path != "/v1/db1/doc1" || resp.Event != "delete" {
+		t.Errorf("Expected only a delete event for the document, got %+v", resp)
+	}
+}
+
+// Test that subtree subscribers are not sent changes they cannot read and that subscriptions
+// that lose read access are closed while the connection stays open.
+func TestWebSocketACL(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	owner := login(t, server, "a_user")
+	other := login(t, server, "b_user")
+	request(server, "PUT", "/v1/db1", owner, "")
+	request(server, "PUT", "/v1/db1/doc1", owner, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/secret/", owner, "")
+	request(server, "PUT", "/v1/db1/doc1/public/", owner, "")
+	request(server, "PUT", "/v1/db1?mode=acl", owner, `{"users": {"a_user": "admin", "b_user": "read"}}`)
+	request(server, "PUT", "/v1/db1/doc1/secret/?mode=acl", owner, `{"users": {"a_user": "admin"}}`)
+
+	conn, err := websocket.Dial(httpServer.URL+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("Unable to open websocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read := func() wsResponse {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unable to read from websocket: %v", err)
+		}
+		var resp wsResponse
+		json.Unmarshal(data, &resp)
+		return resp
+	}
+	conn.WriteMessage([]byte(`{"type": "auth", "token": "` + other + `"}`))
+	read()
+	conn.WriteMessage([]byte(`{"type": "subscribe", "path": "/v1/db1/", "depth": "all"}`))
+	if resp := read(); resp.Type != "subscribed" {
+		t.Fatalf("Expected subscription to the database, got %+v", resp)
+	}
+
+	request(server, "PUT", "/v1/db1/doc1/secret/x", owner, `{"b": 2}`)
+	request(server, "PUT", "/v1/db1/doc1/public/y", owner, `{"c": 3}`)
+	for {
+		resp := read()
+		if strings.Contains(string(resp.Data), "secret") {
+			t.Fatalf("Expected no event from a collection without read access, got %+v", resp)
+		}
+		if strings.Contains(string(resp.Data), "/v1/db1/doc1/public/y") {
+			break
+		}
+	}
+
+	request(server, "PUT", "/v1/db1?mode=acl", owner, `{"users": {"a_user": "admin"}}`)
+	if resp := read(); resp.Type != "forbidden" || resp.Path != "/v1/db1/" {
+		t.Fatalf("Expected the subscription to be closed, got %+v", resp)
+	}
+	conn.WriteMessage([]byte(`{"type": "subscribe", "path": "/v1/db1/"}`))
+	if resp := read(); resp.Type != "error" || !strings.Contains(resp.Message, "permission denied") {
+		t.Errorf("Expected subscribing again to be forbidden, got %+v", resp)
+	}
+}
+
+// Test that a WebSocket client must authenticate before subscribing.
+func TestWebSocketUnauthenticated(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	conn, err := websocket.Dial(httpServer.URL+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("Unable to open websocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage([]byte(`{"type": "subscribe", "path": "/v1/db1/"}`))
+	data, _ := conn.ReadMessage()
+	if !strings.Contains(string(data), `"error"`) {
+		t.Errorf("Expected an error, got %s", string(data))
+	}
+	if _, err = conn.ReadMessage(); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+// Test that the metrics endpoint reports the subscriber counts.
+func TestMetrics(t *testing.T) {
+	server, _ := NewServer(Config{Tokens: "../uexptok.json", Schema: "../schema.json", Admins: []string{"a_user"}})
+	token := login(t, server, "a_user")
+	resp := request(server, "GET", "/admin/metrics", token, "")
+	var metrics subscription.Metrics
+	err := json.Unmarshal(resp.Body.Bytes(), &metrics)
+	if resp.Code != http.StatusOK || err != nil || metrics.Subscribers != 0 {
+		t.Errorf("Unexpected metrics %d %s", resp.Code, resp.Body.String())
+	}
+	if resp = request(server, "GET", "/admin/metrics", "invalid", ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with an invalid token, got %d", resp.Code)
+	}
+}
+
+// Test that a subscriber starts with the documents in its interval and that existing subscribers
+// do not receive them again.
+func TestSubscribeSnapshot(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+	request(server, "PUT", "/v1/db1/a", token, `{"n": 1}`)
+	request(server, "PUT", "/v1/db1/b", token, `{"n": 2}`)
+	request(server, "PUT", "/v1/db1/c", token, `{"n": 3}`)
+
+	// The returned function ends the subscription and waits for its handler to return
+	subscribe := func(path string) (*streamRecorder, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r, _ := http.NewRequestWithContext(ctx, "GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		response := newStreamRecorder()
+		done := make(chan struct{})
+		go func() {
+			server.ServeHTTP(response, r)
+			close(done)
+		}()
+		return response, func() {
+			cancel()
+			<-done
+		}
+	}
+	// Subscribers are registered by the time their snapshot arrives
+	existing, stopExisting := subscribe("/v1/db1/?mode=subscribe")
+	existing.waitFor(t, `"n":3`)
+	subscriber, stop := subscribe("/v1/db1/?mode=subscribe&interval=[a,b]")
+	subscriber.waitFor(t, `"n":2`)
+	request(server, "PUT", "/v1/db1/a", token, `{"n": 4}`)
+	subscriber.waitFor(t, `"n":4`)
+	existing.waitFor(t, `"n":4`)
+	stop()
+	stopExisting()
+
+	body := subscriber.Body.String()
+	first, second, update := strings.Index(body, `"n":1`), strings.Index(body, `"n":2`), strings.Index(body, `"n":4`)
+	if first == -1 || second == -1 || strings.Contains(body, `"n":3`) {
+		t.Errorf("Expected a snapshot of the documents in the interval, got %s", body)
+	}
+	if update < second || strings.Count(body, "event: update") != 3 {
+		t.Errorf("Expected the update after the snapshot, got %s", body)
+	}
+	body = existing.Body.String()
+	if strings.Count(body, `"n":1`) != 1 || !strings.Contains(body, `"n":4`) {
+		t.Errorf("Existing subscriber should only receive its own snapshot and the update, got %s", body)
+	}
+}
+
+// TestAccounts checks registration, password login and password change, and that
+// accounts survive a restart but cannot be reached through /v1/.
+func TestAccounts(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	post := func(path string, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return response
+	}
+	if resp := post("/auth/register", `{"username": "a_user", "password": "short"}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a short password, got %d", resp.Code)
+	}
+	if resp := post("/auth/register", `{"username": "a_user", "password": "password1"}`); resp.Code != http.StatusCreated {
+		t.Fatalf("Registration failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := post("/auth/register", `{"username": "a_user", "password": "password2"}`); resp.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken username, got %d", resp.Code)
+	}
+	if resp := post("/auth", `{"username": "a_user", "password": "password2"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got %d", resp.Code)
+	}
+	if resp := post("/auth", `{"username": "b_user", "password": "password1"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown user, got %d", resp.Code)
+	}
+	token := login(t, server, "a_user")
+
+	resp := request(server, "PUT", "/auth/password", token, `{"password": "wrong pass", "newPassword": "password2"}`)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong current password, got %d", resp.Code)
+	}
+	resp = request(server, "PUT", "/auth/password", token, `{"password": "password1", "newPassword": "password2"}`)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Password change failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/_users/a_user", token, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected the accounts to be reserved, got %d", resp.Code)
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	if resp := post("/auth", `{"username": "a_user", "password": "password1"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old password to be rejected after a restart, got %d", resp.Code)
+	}
+	if resp := post("/auth", `{"username": "a_user", "password": "password2"}`); resp.Code != http.StatusOK {
+		t.Errorf("Expected the new password to be accepted after a restart, got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+// TestACL checks that access control lists on databases and collections, granted to users
+// and groups, are inherited and enforced, and that they survive a restart.
+func TestACL(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir(), Admins: []string{"admin"}}
+	server, _ := NewServer(config)
+	owner := login(t, server, "a_user")
+	other := login(t, server, "b_user")
+	admin := login(t, server, "admin")
+	request(server, "PUT", "/v1/db1", owner, "")
+	request(server, "PUT", "/v1/db1/doc1", owner, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/col/", owner, "")
+
+	if resp := request(server, "GET", "/v1/db1/doc1", other, ""); resp.Code != http.StatusOK {
+		t.Errorf("Expected a new database to be open to everyone, got %d", resp.Code)
+	}
+	request(server, "PUT", "/v1/db1?mode=acl", owner, `{"users": {"a_user": "admin"}}`)
+	if resp := request(server, "GET", "/v1/db1/doc1", other, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without read access, got %d", resp.Code)
+	}
+	if resp := request(server, "GET", "/v1/db1/?mode=subscribe", other, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 when subscribing without read access, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/groups/team", admin, `{"members": ["b_user"]}`); resp.Code != http.StatusCreated {
+		t.Fatalf("Group creation failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/groups/team", other, `{"members": ["a_user", "b_user"]}`); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected members who do not own a group not to change it, got %d", resp.Code)
+	}
+	resp := request(server, "PUT", "/v1/db1?mode=acl", owner, `{"users": {"a_user": "admin"}, "groups": {"team": "read"}}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Setting access control list failed: %d %s", resp.Code, resp.Body.String())
+	}
+	request(server, "PUT", "/v1/db1/doc1/col/?mode=acl", owner, `{"users": {"b_user": "write"}}`)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"GET", "/v1/db1/doc1", "", http.StatusOK},
+		{"PUT", "/v1/db1/doc2", `{"b": 2}`, http.StatusForbidden},
+		{"PUT", "/v1/db1/doc1/col/doc2", `{"b": 2}`, http.StatusCreated},
+		{"PUT", "/v1/db1?mode=acl", `{"users": {"b_user": "admin"}}`, http.StatusForbidden},
+		{"DELETE", "/v1/db1", "", http.StatusForbidden},
+		{"POST", "/v1/db1/_txn", `{"ops": [{"method": "PUT", "path": "/doc3", "body": {}}]}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		resp := request(server, test.method, test.path, other, test.body)
+		if resp.Code != test.want {
+			t.Errorf("%s %s: expected %d, got %d %s", test.method, test.path, test.want, resp.Code, resp.Body.String())
+		}
+	}
+	// The nearest access control list replaces those of the database
+	if resp := request(server, "GET", "/v1/db1/doc1/col/", owner, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected the list of the collection to replace that of the database, got %d", resp.Code)
+	}
+	resp = request(server, "POST", "/v1/_batch", other, `[{"method": "PUT", "path": "/db1/doc3", "body": {}}, {"method": "PUT", "path": "/db1/doc1/col/doc3", "body": {}}]`)
+	if !strings.Contains(resp.Body.String(), `"status":403`) || !strings.Contains(resp.Body.String(), `"status":201`) {
+		t.Errorf("Expected batch operations to be checked one by one, got %s", resp.Body.String())
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	other = login(t, server, "b_user")
+	if resp := request(server, "GET", "/v1/db1/doc1", other, ""); resp.Code != http.StatusOK {
+		t.Errorf("Expected group access to survive a restart, got %d", resp.Code)
+	}
+	if resp := request(server, "DELETE", "/v1/db1", other, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected access control lists to survive a restart, got %d", resp.Code)
+	}
+}
+
+// TestOwnerWrite checks that documents in a collection with the owner-write rule can only be
+// replaced, patched and deleted by their creator or an admin, while others can still add documents.
+func TestOwnerWrite(t *testing.T) {
+	server, _ := New("../uexptok.json", "../schema.json")
+	admin := login(t, server, "a_user")
+	poster := login(t, server, "b_user")
+	other := login(t, server, "c_user")
+	request(server, "PUT", "/v1/chat", admin, "")
+	request(server, "PUT", "/v1/chat?mode=acl", admin, `{"users": {"a_user": "admin", "b_user": "write", "c_user": "write"}, "rules": ["owner-write"]}`)
+	if resp := request(server, "PUT", "/v1/chat?mode=acl", admin, `{"rules": ["owner-only"]}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown rule, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/chat/post1", poster, `{"text": "hi"}`); resp.Code != http.StatusCreated {
+		t.Fatalf("Creating a post failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	tests := []struct {
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{"PUT", other, `{"text": "hacked"}`, http.StatusForbidden},
+		{"PATCH", other, `[{"op": "ObjectAdd", "path": "/extra", "value": 1}]`, http.StatusForbidden},
+		{"DELETE", other, "", http.StatusForbidden},
+		{"PATCH", poster, `[{"op": "ObjectAdd", "path": "/extra", "value": 1}]`, http.StatusOK},
+		{"PUT", poster, `{"text": "edited"}`, http.StatusOK},
+		{"DELETE", admin, "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		resp := request(server, test.method, "/v1/chat/post1", test.token, test.body)
+		if resp.Code != test.want {
+			t.Errorf("%s: expected %d, got %d %s", test.method, test.want, resp.Code, resp.Body.String())
+		}
+	}
+
+	request(server, "PUT", "/v1/chat/post2", poster, `{"text": "hi"}`)
+	resp := request(server, "POST", "/v1/chat/_txn", other, `{"ops": [{"method": "DELETE", "path": "/post2"}]}`)
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected the rule to apply to transactions, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	resp = request(server, "POST", "/v1/chat?mode=import", other, `{"path":"/post2","doc":{"text":"hacked"},"meta":{"createdBy":"c_user"}}`+"\n")
+	if !strings.Contains(resp.Body.String(), `"status":403`) {
+		t.Errorf("Expected the rule to apply to imports, got %d %s", resp.Code, resp.Body.String())
+	}
+	resp = request(server, "POST", "/v1/chat?mode=import", other, `{"path":"/post3","doc":{"text":"mine"},"meta":{"createdBy":"b_user"}}`+"\n")
+	if !strings.Contains(resp.Body.String(), `"status":201`) {
+		t.Fatalf("Expected a new post to be imported, got %d %s", resp.Code, resp.Body.String())
+	}
+	var content document.DocumentContent
+	json.Unmarshal(request(server, "GET", "/v1/chat/post2", poster, "").Body.Bytes(), &content)
+	if string(content.Doc) != `{"text":"hi"}` {
+		t.Errorf("Expected the post to be unchanged, got %s", content.Doc)
+	}
+	json.Unmarshal(request(server, "GET", "/v1/chat/post3", other, "").Body.Bytes(), &content)
+	if content.Metadata.CreatedBy != "c_user" {
+		t.Errorf("Expected an imported post to be created by the importing user, got %s", content.Metadata.CreatedBy)
+	}
+}
+
+// TestAdmin checks that only admins can use the admin API and register the accounts of admins,
+// and that it lists tokens without revealing them, revokes the sessions of a user and creates service tokens.
+func TestAdmin(t *testing.T) {
+	server, _ := NewServer(Config{Tokens: "../uexptok.json", Schema: "../schema.json", Admins: []string{"a_user", "z_user"}})
+	creds := `{"username": "z_user", "password": "` + testPassword + `"}`
+	if resp := request(server, "POST", "/auth/register", "", creds); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for registering an admin without being one, got %d", resp.Code)
+	}
+	admin := login(t, server, "a_user")
+	user := login(t, server, "b_user")
+	login(t, server, "b_user")
+	if resp := request(server, "POST", "/auth/register", user, creds); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for registering an admin as a user, got %d", resp.Code)
+	}
+	if resp := request(server, "POST", "/auth/register", admin, creds); resp.Code != http.StatusCreated {
+		t.Errorf("Expected an admin to register another admin, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	if resp := request(server, "GET", "/admin/tokens", user, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user who is not an admin, got %d", resp.Code)
+	}
+	resp := request(server, "GET", "/admin/tokens", admin, "")
+	var sessions []authentication.Session
+	json.Unmarshal(resp.Body.Bytes(), &sessions)
+	count := 0
+	for _, session := range sessions {
+		if session.User == "b_user" && !session.Refresh && time.Until(session.ExpiresAt) > 0 {
+			count++
+		}
+	}
+	if resp.Code != http.StatusOK || count != 2 || strings.Contains(resp.Body.String(), user) {
+		t.Errorf("Unexpected token list %d %s", resp.Code, resp.Body.String())
+	}
+
+	resp = request(server, "POST", "/admin/tokens", admin, `{"username": "ingest", "lifetime": "720h"}`)
+	var service serviceToken
+	json.Unmarshal(resp.Body.Bytes(), &service)
+	if resp.Code != http.StatusCreated || service.Token == "" || time.Until(service.ExpiresAt) < 719*time.Hour {
+		t.Fatalf("Service token creation failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/v1/ingested", service.Token, ""); resp.Code != http.StatusCreated {
+		t.Errorf("Expected the service token to authenticate, got %d", resp.Code)
+	}
+
+	// Both logins issued a session token and a refresh token
+	resp = request(server, "DELETE", "/admin/users/b_user/sessions", admin, "")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"revoked":4}` {
+		t.Errorf("Unexpected revocation %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/ingested/", user, ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token to be rejected, got %d", resp.Code)
+	}
+}
+
+// TestSignedTokens checks that signed tokens stay valid across a restart and that a logged out
+// token stays invalid after one.
+func TestSignedTokens(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600)
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: filepath.Join(dir, "data"), Auth: "signed", KeyFile: keyFile}
+	if _, err := NewServer(Config{Schema: "../schema.json", Auth: "signed"}); err == nil {
+		t.Errorf("Expected an error without a key file")
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	token := login(t, server, "a_user")
+	loggedOut := login(t, server, "a_user")
+	if resp := request(server, "DELETE", "/auth", loggedOut, ""); resp.Code != http.StatusNoContent {
+		t.Errorf("Logout failed: %d %s", resp.Code, resp.Body.String())
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	if resp := request(server, "PUT", "/v1/db1", token, ""); resp.Code != http.StatusCreated {
+		t.Errorf("Expected the token to survive a restart, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db2", loggedOut, ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the logged out token to stay revoked, got %d", resp.Code)
+	}
+}
+
+// TestRefreshTokens checks that logging in returns when the token expires and a refresh token,
+// which can be exchanged once for new tokens and is revoked by logging out.
+func TestRefreshTokens(t *testing.T) {
+	server, _ := NewServer(Config{Schema: "../schema.json"})
+	login(t, server, "a_user")
+	resp := request(server, "POST", "/auth", "", `{"username": "a_user", "password": "`+testPassword+`"}`)
+	var grant authentication.Grant
+	json.Unmarshal(resp.Body.Bytes(), &grant)
+	if resp.Code != http.StatusOK || grant.RefreshToken == "" || !grant.ExpiresAt.After(time.Now()) {
+		t.Fatalf("Unexpected login response %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/v1/db1", grant.RefreshToken, ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a refresh token to be rejected as a bearer token, got %d", resp.Code)
+	}
+
+	resp = request(server, "POST", "/auth", "", `{"refreshToken": "`+grant.RefreshToken+`"}`)
+	var renewed authentication.Grant
+	json.Unmarshal(resp.Body.Bytes(), &renewed)
+	if resp.Code != http.StatusOK || renewed.Token == "" || renewed.RefreshToken == grant.RefreshToken {
+		t.Fatalf("Unexpected refresh response %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/v1/db1", renewed.Token, ""); resp.Code != http.StatusCreated {
+		t.Errorf("Expected the refreshed token to authenticate, got %d", resp.Code)
+	}
+	if resp := request(server, "POST", "/auth", "", `{"refreshToken": "`+grant.RefreshToken+`"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used refresh token to be rejected, got %d", resp.Code)
+	}
+
+	if resp := request(server, "DELETE", "/auth", renewed.Token, `{"refreshToken": "`+renewed.RefreshToken+`"}`); resp.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed: %d", resp.Code)
+	}
+	if resp := request(server, "POST", "/auth", "", `{"refreshToken": "`+renewed.RefreshToken+`"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected logging out to revoke the refresh token, got %d", resp.Code)
+	}
+}
+
+// TestSweep checks that the janitor keeps subscriptions open past the idle timeout of their token,
+// ends them once it reaches its absolute lifetime, and stops when the server is closed.
+func TestSweep(t *testing.T) {
+	server, _ := NewServer(Config{Schema: "../schema.json", TokenLifetime: 400 * time.Millisecond, IdleTimeout: 50 * time.Millisecond, SweepInterval: 20 * time.Millisecond})
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+
+	r, _ := http.NewRequest("GET", "/v1/db1/?mode=subscribe", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(response, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected an open subscription to keep its token from idling out")
+	case <-time.After(200 * time.Millisecond):
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the subscription to end once its token expired")
+	}
+	if body := response.Body.String(); !strings.Contains(body, "event: expired") {
+		t.Errorf("Expected an expired event, got %s", body)
+	}
+	if resp := request(server, "GET", "/v1/db1/", token, ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the expired token to be rejected, got %d", resp.Code)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+// TestSchema checks that documents are validated against the schema of the nearest database or
+// collection that has one, that schemas can only be changed by admins, and that they survive a restart.
+func TestSchema(t *testing.T) {
+	config := Config{Tokens: "../uexptok.json", Schema: "../schema.json", DataDir: t.TempDir()}
+	server, _ := NewServer(config)
+	owner := login(t, server, "a_user")
+	other := login(t, server, "b_user")
+	request(server, "PUT", "/v1/db1", owner, "")
+	request(server, "PUT", "/v1/db1/doc1", owner, `{"a": 1}`)
+	request(server, "PUT", "/v1/db1/doc1/posts/", owner, "")
+	request(server, "PUT", "/v1/db1/?mode=acl", owner, `{"users": {"a_user": "admin", "b_user": "write"}}`)
+
+	workspace := `{"type": "object", "required": ["name"]}`
+	if resp := request(server, "PUT", "/v1/db1/?mode=schema", other, workspace); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 when setting a schema without admin access, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/?mode=schema", owner, `{"type": 5}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid schema, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/doc1?mode=schema", owner, workspace); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a schema on a document, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/?mode=schema", owner, workspace); resp.Code != http.StatusOK {
+		t.Fatalf("Setting the schema failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/v1/db1/doc1/posts/?mode=schema", owner, `{"required": ["body"]}`); resp.Code != http.StatusOK {
+		t.Fatalf("Setting the schema failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "GET", "/v1/db1/?mode=schema", other, ""); resp.Code != http.StatusOK || resp.Body.String() != workspace {
+		t.Errorf("Unexpected schema %d %s", resp.Code, resp.Body.String())
+	}
+
+	if resp := request(server, "PUT", "/v1/db1/doc2", other, `{"a": 1}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a document without a name to be rejected, got %d", resp.Code)
+	}
+	if resp := request(server, "POST", "/v1/db1/", other, `{"a": 1}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a posted document without a name to be rejected, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/doc2", other, `{"name": "general"}`); resp.Code != http.StatusCreated {
+		t.Errorf("Expected a document with a name to be accepted, got %d", resp.Code)
+	}
+	if resp := request(server, "PATCH", "/v1/db1/doc2", other, `[{"op": "remove", "path": "/name"}]`); !strings.Contains(resp.Body.String(), `"patchFailed":true`) {
+		t.Errorf("Expected a patch removing the name to be rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+	// The nearest schema applies, not the schemas of every ancestor
+	if resp := request(server, "PUT", "/v1/db1/doc1/posts/p1", other, `{"name": "general"}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected the schema of the collection to apply, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/doc1/posts/p1", other, `{"body": "hello"}`); resp.Code != http.StatusCreated {
+		t.Errorf("Expected a post with a body to be accepted, got %d", resp.Code)
+	}
+	txn := `{"ops": [{"method": "PUT", "path": "/doc3", "body": {"a": 1}}]}`
+	if resp := request(server, "POST", "/v1/db1/_txn", other, txn); !strings.Contains(resp.Body.String(), "does not conform to the schema") {
+		t.Errorf("Expected transactions to be validated against the schema, got %d %s", resp.Code, resp.Body.String())
+	}
+	server.Close()
+
+	server, _ = NewServer(config)
+	defer server.Close()
+	owner = login(t, server, "a_user")
+	if resp := request(server, "PUT", "/v1/db1/doc2", owner, `{"a": 1}`); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected the schema to survive a restart, got %d", resp.Code)
+	}
+	if resp := request(server, "DELETE", "/v1/db1/?mode=schema", owner, ""); resp.Code != http.StatusNoContent {
+		t.Errorf("Removing the schema failed: %d", resp.Code)
+	}
+	if resp := request(server, "GET", "/v1/db1/?mode=schema", owner, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected no schema after removing it, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/v1/db1/doc2", owner, `{"a": 1}`); resp.Code != http.StatusOK {
+		t.Errorf("Expected the global schema to apply once the schema is removed, got %d", resp.Code)
+	}
+}
+
+// TestGroups checks that only admins create groups, that the owner of a group or an admin may
+// change or remove it, and that a removed group cannot be taken over by another user.
+func TestGroups(t *testing.T) {
+	server, _ := NewServer(Config{Tokens: "../uexptok.json", Schema: "../schema.json", Admins: []string{"admin"}})
+	admin := login(t, server, "admin")
+	owner := login(t, server, "a_user")
+	other := login(t, server, "b_user")
+
+	if resp := request(server, "PUT", "/groups/team", other, `{"members": ["b_user"]}`); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 when a user who is not an admin creates a group, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/groups/team", admin, `{"members": ["a_user"], "owner": "a_user"}`); resp.Code != http.StatusCreated {
+		t.Fatalf("Group creation failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "PUT", "/groups/team", owner, `{"members": ["a_user", "c_user"]}`); resp.Code != http.StatusOK {
+		t.Errorf("Expected the owner to change the group, got %d %s", resp.Code, resp.Body.String())
+	}
+	resp := request(server, "GET", "/groups/team", other, "")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"members":["a_user","c_user"],"owner":"a_user"}` {
+		t.Errorf("Unexpected group %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(server, "DELETE", "/groups/team", other, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 when a user who does not own the group removes it, got %d", resp.Code)
+	}
+	if resp := request(server, "DELETE", "/groups/team", owner, ""); resp.Code != http.StatusNoContent {
+		t.Errorf("Expected the owner to remove the group, got %d", resp.Code)
+	}
+	if resp := request(server, "PUT", "/groups/team", other, `{"members": ["b_user"]}`); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected a removed group not to be taken over, got %d", resp.Code)
+	}
+}
+
+// TestWebSocketExpiry checks that the janitor ends WebSocket subscriptions whose token expired
+// with an expired message and closes the connection.
+func TestWebSocketExpiry(t *testing.T) {
+	server, _ := NewServer(Config{Schema: "../schema.json", TokenLifetime: 400 * time.Millisecond, IdleTimeout: 50 * time.Millisecond, SweepInterval: 20 * time.Millisecond})
+	defer server.Close()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	token := login(t, server, "a_user")
+	request(server, "PUT", "/v1/db1", token, "")
+
+	conn, err := websocket.Dial(httpServer.URL+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("Unable to open websocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage([]byte(`{"type": "auth", "token": "` + token + `"}`))
+	conn.ReadMessage()
+	conn.WriteMessage([]byte(`{"type": "subscribe", "path": "/v1/db1/"}`))
+	if data, _ := conn.ReadMessage(); !strings.Contains(string(data), `"subscribed"`) {
+		t.Fatalf("Expected subscription to the database, got %s", data)
+	}
+
+	data, err := conn.ReadMessage()
+	var resp wsResponse
+	json.Unmarshal(data, &resp)
+	if err != nil || resp.Type != "expired" || resp.Path != "/v1/db1/" {
+		t.Fatalf("Expected an expired message, got %s %v", data, err)
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("Expected the connection to be closed once the token expired")
+	}
+}
@@ -0,0 +1,300 @@
+package system
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// transferLine is one line of an export or import stream. Path is relative to the database,
+// as in document.DocumentContent. Lines whose path ends in a slash are collections and
+// carry no doc or meta, so that empty collections survive the round trip.
+type transferLine struct {
+	Path     string             `json:"path"`
+	Doc      json.RawMessage    `json:"doc,omitempty"`
+	Metadata *document.Metadata `json:"meta,omitempty"`
+}
+
+// importResult reports the outcome of importing one line.
+type importResult struct {
+	Line    int    `json:"line"`
+	Path    string `json:"path,omitempty"`
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// handleExport handles GET /v1/{db}?mode=export, which streams every document and collection
+// in the database, parents before children, as newline-delimited JSON.
+func (sys *System) handleExport(w http.ResponseWriter, r *http.Request, relPath string) {
+	if r.Method != http.MethodGet {
+		data, _ := json.Marshal("export only supports GET")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.Contains(relPath, "/") {
+		data, _ := json.Marshal("export is only supported for databases")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	db, status := sys.Next(relPath)
+	if status != http.StatusOK {
+		data, _ := json.Marshal("unable to export database " + relPath + ": does not exist")
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+
+	// Take a consistent view, then stream it without blocking writers
+	unlock := sys.rlockDatabase(relPath)
+	records := dumpFile(make([]wal.Record, 0), relPath, db)
+	unlock()
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	// The first record is the database itself
+	for _, rec := range records[1:] {
+		if r.Context().Err() != nil {
+			return
+		}
+		// Only data is exported, not index declarations
+		if rec.Op != wal.OpPut {
+			continue
+		}
+		line := transferLine{Path: strings.TrimPrefix(rec.Path, relPath), Doc: rec.Doc, Metadata: rec.Meta}
+		if rec.Meta == nil {
+			line.Path += "/"
+		}
+		err := encoder.Encode(line)
+		if err != nil {
+			slog.Error("Error when writing export", "error", err)
+			return
+		}
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// handleImport handles POST /v1/{db}?mode=import, which recreates the documents and collections
+// in a newline-delimited JSON export, creating the database if it does not exist. Document
+// metadata is preserved, and each document is validated against the schema. Each line needs
+// write access and is subject to the owner-write rule, as a PUT would be. Responds with
+// a result for every line.
+func (sys *System) handleImport(w http.ResponseWriter, r *http.Request, who acl.Principal, relPath string, subscribers *subscription.Subscribers) {
+	if r.Method != http.MethodPost {
+		data, _ := json.Marshal("import only supports POST")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.Contains(relPath, "/") {
+		data, _ := json.Marshal("import is only supported for databases")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	unlock := sys.lockDatabase(relPath)
+	defer unlock()
+	_, status := sys.Next(relPath)
+	if status != http.StatusOK {
+		err := sys.createCollection([]string{relPath})
+		if err != nil {
+			data, _ := json.Marshal("unable to create database " + relPath + ": " + err.Error())
+			WriteJsonResponse(w, data, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	results := make([]importResult, 0)
+	reader := bufio.NewReader(r.Body)
+	for number := 1; ; number++ {
+		text, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(text))) > 0 {
+			result := sys.importLine(relPath, text, who, subscribers)
+			result.Line = number
+			results = append(results, result)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			results = append(results, importResult{Line: number, Status: http.StatusBadRequest, Message: "unable to read request body"})
+			break
+		}
+	}
+	data, _ := json.Marshal(results)
+	WriteJsonResponse(w, data, http.StatusOK)
+}
+
+// importLine imports a single line of an export into the database dbName on behalf of who.
+// The caller must hold the database's write lock.
+func (sys *System) importLine(dbName string, text []byte, who acl.Principal, subscribers *subscription.Subscribers) importResult {
+	var line transferLine
+	err := json.Unmarshal(text, &line)
+	if err != nil {
+		return importResult{Status: http.StatusBadRequest, Message: "line is not valid JSON"}
+	}
+	result := importResult{Path: line.Path}
+	trimmed := strings.Trim(line.Path, "/")
+	if !strings.HasPrefix(line.Path, "/") || trimmed == "" || strings.Contains(trimmed, "//") {
+		result.Status = http.StatusBadRequest
+		result.Message = "invalid path"
+		return result
+	}
+	paths := append([]string{dbName}, strings.Split(trimmed, "/")...)
+	isCollection := len(paths)%2 == 1
+	if isCollection != strings.HasSuffix(line.Path, "/") {
+		result.Status = http.StatusBadRequest
+		result.Message = "collection paths must end in a slash and document paths must not"
+		return result
+	}
+	if sys.permission(who, paths) < acl.Write {
+		result.Status = http.StatusForbidden
+		result.Message = forbidden(acl.Write)
+		return result
+	}
+	fullPath := strings.Join(paths, "/")
+	name := paths[len(paths)-1]
+
+	if isCollection {
+		_, status := sys.lookup(paths)
+		if status == http.StatusOK {
+			result.Status = http.StatusOK
+			return result
+		}
+		err = sys.createCollection(paths)
+		if err != nil {
+			result.Status = http.StatusBadRequest
+			result.Message = err.Error()
+			return result
+		}
+		result.Status = http.StatusCreated
+		return result
+	}
+
+	undo, status, err := sys.importDocument(paths, name, line, who)
+	result.Status = status
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	// Updates are logged as patches, which keep nested collections on replay
+	logOp := wal.OpPut
+	if result.Status == http.StatusOK {
+		logOp = wal.OpPatch
+	}
+	err = sys.logChange(logOp, fullPath)
+	if err != nil {
+		slog.Error("Error when writing to the write-ahead log", "error", err)
+		sys.rollback([]txnChange{{undo: undo}})
+		result.Status = http.StatusInternalServerError
+		result.Message = "unable to persist change"
+		return result
+	}
+	file, _ := sys.lookup(paths)
+	data, _ := file.Get(context.Background(), "", "")
+	subscribers.Notify("/v1/"+fullPath, "update", data)
+	return result
+}
+
+// importDocument stores the document of line at paths on behalf of who, creating its parent
+// collection if needed. An existing document is updated like a PATCH, keeping its nested collections.
+// In collections with the owner-write rule, only admins keep the imported creator: documents
+// otherwise keep their creator, and new documents are created by who.
+// Returns how to undo the import and its status, 200 OK if the document existed.
+func (sys *System) importDocument(paths []string, name string, line transferLine, who acl.Principal) (txnUndo, int, error) {
+	if len(line.Doc) == 0 || !sys.validatorFor(paths).ValidateSchema(line.Doc) {
+		return txnUndo{}, http.StatusBadRequest, errors.New("document does not conform to the schema")
+	}
+	parent, status := sys.lookup(paths[:len(paths)-1])
+	if status != http.StatusOK {
+		err := sys.createCollection(paths[:len(paths)-1])
+		if err != nil {
+			return txnUndo{}, http.StatusNotFound, err
+		}
+		parent, _ = sys.lookup(paths[:len(paths)-1])
+	}
+	col, ok := parent.(*collection.Collection)
+	if !ok {
+		return txnUndo{}, http.StatusBadRequest, errors.New("parent is not a collection")
+	}
+
+	existing, found := col.Next(name)
+	if found != http.StatusOK {
+		existing = nil
+	}
+	if !sys.mayModify(who, paths, col, existing) {
+		return txnUndo{}, http.StatusForbidden, errors.New("permission denied: only the creator of " + name + " may change it")
+	}
+
+	var meta document.Metadata
+	if line.Metadata != nil {
+		meta = *line.Metadata
+	}
+	now := time.Now().UnixMilli()
+	if granted, _ := sys.granted(who, paths); col.ACL().HasRule(acl.OwnerWrite) && granted < acl.Admin {
+		meta = document.Metadata{CreatedBy: who.User, CreatedAt: now, LastModifiedBy: who.User, LastModifiedAt: now}
+		if doc, ok := existing.(*document.Document); ok {
+			meta.CreatedBy, meta.CreatedAt = doc.GetCreatedBy(), doc.GetCreatedAt()
+		}
+	}
+	if meta.CreatedBy == "" {
+		meta.CreatedBy = who.User
+		meta.CreatedAt = now
+	}
+	if meta.LastModifiedBy == "" {
+		meta.LastModifiedBy = meta.CreatedBy
+		meta.LastModifiedAt = meta.CreatedAt
+	}
+
+	undo := txnUndo{parent: col, name: name, old: existing}
+	status = http.StatusCreated
+	var doc *document.Document
+	if existing != nil {
+		status = http.StatusOK
+		doc = existing.(*document.Document).Update(line.Doc, meta)
+	} else {
+		restored := document.Restore(document.DocumentContent{Path: strings.Join(paths, "/"), Doc: line.Doc, Metadata: meta})
+		doc = &restored
+	}
+	if !col.Restore(name, doc) {
+		return txnUndo{}, http.StatusInternalServerError, errors.New("inserting into collection failed")
+	}
+	return undo, status, nil
+}
+
+// createCollection creates and logs the empty database or collection at paths, whose parent must exist.
+func (sys *System) createCollection(paths []string) error {
+	parent, status := sys.lookup(paths[:len(paths)-1])
+	if status != http.StatusOK {
+		return errors.New("parent document does not exist")
+	}
+	path := strings.Join(paths, "/")
+	col := collection.NewWithPath(path)
+	data, status := parent.Put(paths[len(paths)-1], &col, sys.validator)
+	if status != http.StatusCreated {
+		var message string
+		json.Unmarshal(data, &message)
+		return errors.New(message)
+	}
+	err := sys.logChange(wal.OpPut, path)
+	if err != nil {
+		slog.Error("Error when writing to the write-ahead log", "error", err)
+		parent.Delete(paths[len(paths)-1])
+		return errors.New("unable to persist change")
+	}
+	return nil
+}
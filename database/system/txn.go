@@ -0,0 +1,261 @@
+package system
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filejson"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// txnRequest is the body of a transaction.
+type txnRequest struct {
+	Ops []txnOp `json:"ops"`
+}
+
+// txnOp is one operation of a transaction. Path is relative to the database, as in
+// document.DocumentContent, and ends in a slash for collections. Body is the document
+// of a PUT or the patch of a PATCH, whose format is selected by ContentType as for
+// the PATCH method. IfMatch and IfNoneMatch are preconditions, as the HTTP headers.
+type txnOp struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	IfMatch     string          `json:"ifMatch,omitempty"`
+	IfNoneMatch string          `json:"ifNoneMatch,omitempty"`
+}
+
+// txnResult reports the outcome of one operation of a transaction.
+type txnResult struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// txnResponse is the response to a transaction.
+type txnResponse struct {
+	Committed bool        `json:"committed"`
+	Results   []txnResult `json:"results"`
+}
+
+// txnUndo records the file a change replaced, so that it can be put back.
+type txnUndo struct {
+	parent filejson.FileJson
+	name   string
+	old    filejson.FileJson // nil if there was no file
+}
+
+// txnChange is an operation of a transaction that was applied.
+type txnChange struct {
+	undo    txnUndo
+	rec     wal.Record
+	urlPath string // path of the changed file starting with /v1/
+	event   string
+}
+
+// handleTxn handles POST /v1/{db}/_txn, which applies a list of PUT, PATCH and DELETE operations
+// within the database dbName atomically. Operations are applied in order, so later operations see
+// the changes of earlier ones. If any operation fails, every change is rolled back, nothing is logged,
+// and the response has the status of the failed operation. Otherwise the transaction is logged as a
+// single record, and subscribers are notified once it has committed.
+func (sys *System) handleTxn(w http.ResponseWriter, r *http.Request, who acl.Principal, dbName string, subscribers *subscription.Subscribers) {
+	var txn txnRequest
+	err := json.NewDecoder(r.Body).Decode(&txn)
+	defer r.Body.Close()
+	if err != nil || len(txn.Ops) == 0 {
+		data, _ := json.Marshal("transaction must be an object with a non-empty list of ops")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	unlock := sys.lockDatabase(dbName)
+	defer unlock()
+	_, status := sys.Next(dbName)
+	if status != http.StatusOK {
+		data, _ := json.Marshal("unable to retrive database: " + dbName)
+		WriteJsonResponse(w, data, http.StatusNotFound)
+		return
+	}
+
+	response := txnResponse{Results: make([]txnResult, len(txn.Ops))}
+	changes := make([]txnChange, 0, len(txn.Ops))
+	failed := 0
+	for i, op := range txn.Ops {
+		response.Results[i] = txnResult{Method: op.Method, Path: op.Path}
+		if failed != 0 {
+			response.Results[i].Message = "not applied: an earlier operation failed"
+			continue
+		}
+		change, status, message := sys.applyTxnOp(dbName, who, op)
+		response.Results[i].Status = status
+		response.Results[i].Message = message
+		if status >= 300 {
+			failed = status
+			continue
+		}
+		changes = append(changes, change)
+	}
+	if failed == 0 && sys.log != nil {
+		records := make([]wal.Record, len(changes))
+		for i, change := range changes {
+			records[i] = change.rec
+		}
+		_, err = sys.log.Append(wal.Record{Op: wal.OpTxn, Ops: records})
+		if err != nil {
+			slog.Error("Error when writing to the write-ahead log", "error", err)
+			failed = http.StatusInternalServerError
+		}
+	}
+	if failed != 0 {
+		sys.rollback(changes)
+		data, _ := json.Marshal(response)
+		WriteJsonResponse(w, data, failed)
+		return
+	}
+
+	response.Committed = true
+	data, _ := json.Marshal(response)
+	WriteJsonResponse(w, data, http.StatusOK)
+	for _, change := range changes {
+		sys.notify(subscribers, change.urlPath, change.event)
+	}
+}
+
+// applyTxnOp applies a single operation of a transaction in the database dbName on behalf of who,
+// which needs write access to the path of the operation.
+// Returns the change made and the status of the operation, with a message if it failed.
+func (sys *System) applyTxnOp(dbName string, who acl.Principal, op txnOp) (txnChange, int, string) {
+	var change txnChange
+	trimmed := strings.Trim(op.Path, "/")
+	if !strings.HasPrefix(op.Path, "/") || trimmed == "" || strings.Contains(trimmed, "//") {
+		return change, http.StatusBadRequest, "invalid path"
+	}
+	paths := append([]string{dbName}, strings.Split(trimmed, "/")...)
+	if sys.permission(who, paths) < acl.Write {
+		return change, http.StatusForbidden, forbidden(acl.Write)
+	}
+	user := who.User
+	fullPath := strings.Join(paths, "/")
+	isCollection := len(paths)%2 == 1
+	name := paths[len(paths)-1]
+	parent, status := sys.lookup(paths[:len(paths)-1])
+	if status != http.StatusOK {
+		return change, http.StatusNotFound, "parent does not exist"
+	}
+	old, found := parent.Next(name)
+	if found != http.StatusOK {
+		old = nil
+	}
+	if !sys.mayModify(who, paths, parent, old) {
+		return change, http.StatusForbidden, "permission denied: only the creator of " + name + " may change it"
+	}
+	if !preconditionsHold(op.IfMatch, op.IfNoneMatch, old) {
+		return change, http.StatusPreconditionFailed, "precondition failed"
+	}
+
+	var data []byte
+	var logOp string
+	change.event = "update"
+	switch strings.ToUpper(op.Method) {
+	case http.MethodPut:
+		logOp = wal.OpPut
+		if isCollection {
+			col := collection.NewWithPath(fullPath)
+			data, status = parent.Put(name, &col, sys.validator)
+			break
+		}
+		now := time.Now().UnixMilli()
+		doc := document.Restore(document.DocumentContent{Path: fullPath, Doc: op.Body,
+			Metadata: document.Metadata{CreatedBy: user, CreatedAt: now, LastModifiedBy: user, LastModifiedAt: now}})
+		data, status = parent.Put(name, &doc, sys.validatorFor(paths))
+		if status == http.StatusBadRequest && len(data) == 0 {
+			data, _ = json.Marshal("document does not conform to the schema")
+		}
+	case http.MethodPatch:
+		logOp = wal.OpPatch
+		doc, ok := old.(*document.Document)
+		if !ok {
+			return change, http.StatusNotFound, "unable to retrive document: " + name
+		}
+		var patched *document.Document
+		validator := sys.validatorFor(paths)
+		patched, data, status = doc.ApplyPatch(user, op.ContentType, op.Body, validator)
+		if status == http.StatusOK && patched == doc {
+			// The patch failed and the document is unchanged
+			return change, http.StatusBadRequest, txnMessage(data)
+		}
+		if status == http.StatusOK {
+			data, status = parent.Put(name, patched, validator)
+		}
+	case http.MethodDelete:
+		logOp = wal.OpDelete
+		change.event = "delete"
+		data, status = parent.Delete(name)
+	default:
+		return change, http.StatusBadRequest, "method must be PUT, PATCH or DELETE"
+	}
+	if status >= 300 {
+		return change, status, txnMessage(data)
+	}
+
+	change.undo = txnUndo{parent: parent, name: name, old: old}
+	change.urlPath = "/v1/" + fullPath
+	if isCollection {
+		change.urlPath += "/"
+	}
+	if sys.log != nil {
+		rec, err := sys.changeRecord(logOp, fullPath)
+		if err != nil {
+			sys.rollback([]txnChange{change})
+			return change, http.StatusInternalServerError, err.Error()
+		}
+		change.rec = rec
+	}
+	return change, status, ""
+}
+
+// rollback undoes changes, most recent first.
+func (sys *System) rollback(changes []txnChange) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		undo := changes[i].undo
+		if undo.old == nil {
+			undo.parent.Delete(undo.name)
+			continue
+		}
+		col, ok := undo.parent.(*collection.Collection)
+		if ok {
+			col.Restore(undo.name, undo.old.(*document.Document))
+			continue
+		}
+		undo.parent.Delete(undo.name)
+		undo.parent.Put(undo.name, undo.old, sys.validator)
+	}
+}
+
+// txnMessage extracts a readable message from the marshaled response of a failed operation.
+func txnMessage(data []byte) string {
+	var message string
+	if json.Unmarshal(data, &message) == nil {
+		return message
+	}
+	var result document.PatchResult
+	if json.Unmarshal(data, &result) == nil && result.Message != "" {
+		for i, op := range result.Results {
+			if !op.Success {
+				return result.Message + ": operation " + strconv.Itoa(i) + ": " + op.Message
+			}
+		}
+		return result.Message
+	}
+	return string(data)
+}
@@ -0,0 +1,212 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/wal"
+)
+
+// Reserved databases are stored and logged like any other database but cannot be reached through /v1/.
+const (
+	usersDB  = "_users"  // user accounts, one document per user
+	groupsDB = "_groups" // groups of users, one document per group
+)
+
+// account is the document of a user in usersDB.
+type account struct {
+	Password authentication.PasswordHash `json:"password"`
+}
+
+// credentials is the body of registration and login requests.
+type credentials struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// passwordChange is the body of password change requests.
+type passwordChange struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+// errNotFound is returned by getReserved for documents that do not exist.
+var errNotFound = errors.New("no such document")
+
+// handleRegister handles POST /auth/register, which creates an account for the username
+// and password in the body. Responds with 409 if the username is taken. Only admins may
+// register the accounts of admins, so that nobody else can claim an admin's name: the first
+// admin authenticates with a token from the token file.
+func (sys *System) handleRegister(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	var creds credentials
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	defer r.Body.Close()
+	if err != nil || creds.Username == "" || strings.Contains(creds.Username, "/") {
+		data, _ := json.Marshal("body must have a username without slashes and a password")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	if sys.isAdmin(creds.Username) && !sys.isAdmin(auth.CheckToken(bearerToken(r))) {
+		data, _ := json.Marshal("permission denied: only admins may register the account of an admin")
+		WriteJsonResponse(w, data, http.StatusForbidden)
+		return
+	}
+	hash, err := authentication.HashPassword(creds.Password)
+	if err != nil {
+		data, _ := json.Marshal(err.Error())
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	unlock := sys.lockDatabase(usersDB)
+	defer unlock()
+	var existing account
+	err = sys.getReserved(usersDB, creds.Username, &existing)
+	if err == nil {
+		data, _ := json.Marshal("username is taken: " + creds.Username)
+		WriteJsonResponse(w, data, http.StatusConflict)
+		return
+	}
+	err = sys.putReserved(usersDB, creds.Username, creds.Username, account{Password: hash})
+	if err != nil {
+		slog.Error("Error when saving account", "error", err)
+		data, _ := json.Marshal("unable to save account")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"username": creds.Username})
+	WriteJsonResponse(w, data, http.StatusCreated)
+}
+
+// handlePassword handles PUT /auth/password, which changes the password of the authenticated
+// user given the current password.
+func (sys *System) handlePassword(w http.ResponseWriter, r *http.Request, auth authentication.Backend) {
+	if r.Method == http.MethodOptions {
+		Options(w, r)
+		return
+	}
+	user, ok := authenticate(w, r, auth)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPut {
+		data, _ := json.Marshal("Method not found or unsupported")
+		WriteJsonResponse(w, data, http.StatusMethodNotAllowed)
+		return
+	}
+	var change passwordChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	defer r.Body.Close()
+	if err != nil {
+		data, _ := json.Marshal("body must have the password and newPassword")
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	hash, err := authentication.HashPassword(change.NewPassword)
+	if err != nil {
+		data, _ := json.Marshal(err.Error())
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+
+	unlock := sys.lockDatabase(usersDB)
+	defer unlock()
+	var acct account
+	err = sys.getReserved(usersDB, user, &acct)
+	if err != nil || !acct.Password.Verify(change.Password) {
+		data, _ := json.Marshal("invalid password")
+		WriteJsonResponse(w, data, http.StatusUnauthorized)
+		return
+	}
+	acct.Password = hash
+	err = sys.putReserved(usersDB, user, user, acct)
+	if err != nil {
+		slog.Error("Error when saving account", "error", err)
+		data, _ := json.Marshal("unable to save account")
+		WriteJsonResponse(w, data, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkPassword reports whether password is the password of user.
+func (sys *System) checkPassword(user string, password string) bool {
+	var acct account
+	unlock := sys.rlockDatabase(usersDB)
+	err := sys.getReserved(usersDB, user, &acct)
+	unlock()
+	// Unknown users have the zero hash, which takes as long to check, so timing does not reveal them
+	return acct.Password.Verify(password) && err == nil
+}
+
+// getReserved decodes the document name in the reserved database dbName into v.
+// The caller must hold a lock on dbName.
+func (sys *System) getReserved(dbName string, name string, v any) error {
+	file, status := sys.lookup([]string{dbName, name})
+	doc, ok := file.(*document.Document)
+	if status != http.StatusOK || !ok {
+		return errNotFound
+	}
+	return json.Unmarshal(doc.GetDoc(), v)
+}
+
+// putReserved stores v as the document name in the reserved database dbName on behalf of user,
+// creating the database if needed, and logs it. Reserved documents are not validated against
+// the schema. The caller must hold the write lock on dbName.
+func (sys *System) putReserved(dbName string, name string, user string, v any) error {
+	if _, status := sys.Next(dbName); status != http.StatusOK {
+		err := sys.createCollection([]string{dbName})
+		if err != nil {
+			return err
+		}
+	}
+	file, _ := sys.Next(dbName)
+	col := file.(*collection.Collection)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	meta := document.Metadata{CreatedBy: user, CreatedAt: now, LastModifiedBy: user, LastModifiedAt: now}
+	undo := txnUndo{parent: col, name: name}
+	if old, status := col.Next(name); status == http.StatusOK {
+		undo.old = old
+		created := old.(*document.Document).GetContent().Metadata
+		meta.CreatedBy, meta.CreatedAt = created.CreatedBy, created.CreatedAt
+	}
+	doc := document.Restore(document.DocumentContent{Path: dbName + "/" + name, Doc: data, Metadata: meta})
+	if !col.Restore(name, &doc) {
+		return errors.New("unable to store " + dbName + "/" + name)
+	}
+	err = sys.logChange(wal.OpPut, dbName+"/"+name)
+	if err != nil {
+		sys.rollback([]txnChange{{undo: undo}})
+	}
+	return err
+}
+
+// isReserved reports whether the path relative to /v1/ is in a database that cannot be
+// reached through the API.
+func isReserved(relPath string) bool {
+	dbName := strings.Split(relPath, "/")[0]
+	return dbName == usersDB || dbName == groupsDB
+}
@@ -0,0 +1,257 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/filter"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/subscription"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/websocket"
+)
+
+// wsRequest is a message from a WebSocket client. Type is auth, subscribe or unsubscribe.
+// Path starts with /v1/, as for subscriptions over HTTP, and Interval, Filter, Depth and LastEventID
+// have the meaning of the interval, filter and depth parameters and the Last-Event-ID header.
+type wsRequest struct {
+	Type        string `json:"type"`
+	Token       string `json:"token,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Interval    string `json:"interval,omitempty"`
+	Filter      string `json:"filter,omitempty"`
+	Depth       string `json:"depth,omitempty"`
+	LastEventID string `json:"lastEventId,omitempty"`
+}
+
+// wsResponse is a message to a WebSocket client. Type is the type of the request it answers,
+// error, or event for the events of a subscription, whose path is the subscribed path.
+type wsResponse struct {
+	Type    string          `json:"type"`
+	Path    string          `json:"path,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	ID      uint64          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// wsSession is an open WebSocket connection and its subscriptions by path.
+type wsSession struct {
+	conn *websocket.Conn
+	subs map[string]*subscription.Subscription
+	wg   sync.WaitGroup // forwarding goroutines
+}
+
+// handleWebSocket handles /v1/_ws, over which a client can subscribe to many paths at once.
+// The client authenticates with the Authorization header of the handshake or with an auth
+// message carrying its token, and then sends subscribe and unsubscribe messages. The events
+// of every subscription are multiplexed over the connection, tagged with the subscribed path.
+func (sys *System) handleWebSocket(w http.ResponseWriter, r *http.Request, auth authentication.Backend, subscribers *subscription.Subscribers) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		data, _ := json.Marshal("unable to open websocket: " + err.Error())
+		WriteJsonResponse(w, data, http.StatusBadRequest)
+		return
+	}
+	session := &wsSession{conn: conn, subs: make(map[string]*subscription.Subscription)}
+	defer func() {
+		for _, sub := range session.subs {
+			subscribers.Unsubscribe(sub)
+		}
+		session.wg.Wait()
+		conn.Close()
+	}()
+
+	user, token := "", ""
+	if authTok, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		user, token = auth.CheckToken(authTok), authTok
+	}
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req wsRequest
+		if json.Unmarshal(data, &req) != nil {
+			session.send(wsResponse{Type: "error", Message: "message must be a JSON object"})
+			continue
+		}
+		if req.Type == "auth" {
+			user, token = auth.CheckToken(req.Token), req.Token
+			if user == "" {
+				session.send(wsResponse{Type: "error", Message: "Missing or invalid bearer token"})
+				return
+			}
+			session.send(wsResponse{Type: "auth"})
+			continue
+		}
+		if user == "" {
+			session.send(wsResponse{Type: "error", Message: "Missing or invalid bearer token"})
+			return
+		}
+
+		switch req.Type {
+		case "subscribe":
+			// The token may have expired since the client authenticated
+			if auth.CheckToken(token) == "" {
+				session.send(wsResponse{Type: "expired", Message: subscription.ErrExpired.Error()})
+				return
+			}
+			sys.wsSubscribe(session, user, token, req, subscribers)
+		case "unsubscribe":
+			path := subscriptionPath(req.Path)
+			sub, ok := session.subs[path]
+			if !ok {
+				session.send(wsResponse{Type: "error", Path: req.Path, Message: "not subscribed"})
+				continue
+			}
+			subscribers.Unsubscribe(sub)
+			delete(session.subs, path)
+			session.send(wsResponse{Type: "unsubscribed", Path: path})
+		default:
+			session.send(wsResponse{Type: "error", Message: "type must be auth, subscribe or unsubscribe"})
+		}
+	}
+}
+
+// wsSubscribe subscribes session to the path of req on behalf of user, who authenticated with token
+// and needs read access, sends the current state of the path unless events are replayed from the
+// last event ID, and forwards its events until the subscription ends. If token expires, the client
+// is sent an expired message and the connection is closed. If the user loses read access to the
+// path, the client is sent a forbidden message for it.
+func (sys *System) wsSubscribe(session *wsSession, user string, token string, req wsRequest, subscribers *subscription.Subscribers) {
+	path := subscriptionPath(req.Path)
+	if sub, ok := session.subs[path]; ok {
+		select {
+		case <-sub.Done():
+			// Read access was revoked, and the client may subscribe again once it is granted
+		default:
+			session.send(wsResponse{Type: "error", Path: path, Message: "already subscribed"})
+			return
+		}
+	}
+	if !strings.HasPrefix(path, "/v1/") || isReserved(relativePath(path)) {
+		session.send(wsResponse{Type: "error", Path: req.Path, Message: "invalid path"})
+		return
+	}
+	bound := req.Interval
+	if bound == "" {
+		bound = "[,]"
+	}
+	if !strings.HasPrefix(bound, "[") || !strings.HasSuffix(bound, "]") || !strings.Contains(bound, ",") {
+		session.send(wsResponse{Type: "error", Path: path, Message: "interval must be of the form [low,high]"})
+		return
+	}
+	if req.Depth != "" && req.Depth != "all" {
+		session.send(wsResponse{Type: "error", Path: path, Message: "depth must be all"})
+		return
+	}
+	var filt *filter.Filter
+	if req.Filter != "" {
+		var err error
+		filt, err = filter.Parse(req.Filter)
+		if err != nil {
+			session.send(wsResponse{Type: "error", Path: path, Message: err.Error()})
+			return
+		}
+	}
+
+	comma := strings.Index(bound, ",")
+	low, high := bound[1:comma], bound[comma+1:len(bound)-1]
+
+	// Groups are read before the database is locked
+	who := sys.principal(user)
+	paths := strings.Split(relativePath(path), "/")
+	// Subscribers start from this state, so register them before any change
+	unlock := sys.rlockDatabase(paths[0])
+	file, status := sys.lookup(paths)
+	if status != http.StatusOK {
+		unlock()
+		session.send(wsResponse{Type: "error", Path: req.Path, Message: "invalid path"})
+		return
+	}
+	if sys.permission(who, paths) < acl.Read {
+		unlock()
+		session.send(wsResponse{Type: "error", Path: req.Path, Message: forbidden(acl.Read)})
+		return
+	}
+	var data []byte
+	if col, ok := file.(*collection.Collection); ok {
+		data, status, _ = col.GetQuery(context.Background(), collection.Query{Low: low, High: high, Filter: filt})
+	} else {
+		data, status = file.Get(context.Background(), high, low)
+	}
+	opts := subscription.Options{Bound: bound, Filter: filt, Subtree: req.Depth == "all", Token: token, Allowed: sys.readable(who)}
+	sub, replay := subscribers.Subscribe(path, opts, req.LastEventID)
+	// Replayed events catch up from the last event ID, otherwise start from a snapshot
+	if status == http.StatusOK && (req.LastEventID == "" || (len(replay) > 0 && replay[0].Event == "reset")) {
+		replay = append(replay, subscribers.Snapshot(sub, data)...)
+	}
+	unlock()
+	session.subs[path] = sub
+	session.send(wsResponse{Type: "subscribed", Path: path})
+	session.wg.Add(1)
+	go func() {
+		defer session.wg.Done()
+		for _, msg := range replay {
+			session.send(wsResponse{Type: "event", Path: path, Event: msg.Event, ID: msg.ID, Data: msg.Data})
+		}
+		for {
+			select {
+			case <-sub.Ready():
+				for _, msg := range sub.Drain() {
+					session.send(wsResponse{Type: "event", Path: path, Event: msg.Event, ID: msg.ID, Data: msg.Data})
+				}
+			case <-sub.Done():
+				if errors.Is(sub.Err(), subscription.ErrExpired) {
+					// Deliver what was queued before the token expired
+					for _, msg := range sub.Drain() {
+						session.send(wsResponse{Type: "event", Path: path, Event: msg.Event, ID: msg.ID, Data: msg.Data})
+					}
+					session.send(wsResponse{Type: "expired", Path: path, Message: sub.Err().Error()})
+					session.conn.Close()
+					return
+				}
+				// Other subscriptions of the connection may still be readable
+				if errors.Is(sub.Err(), subscription.ErrForbidden) {
+					session.send(wsResponse{Type: "forbidden", Path: path, Message: sub.Err().Error()})
+					return
+				}
+				// A subscriber too slow for one path is too slow for the connection
+				if err := sub.Err(); err != nil {
+					session.send(wsResponse{Type: "error", Path: path, Message: err.Error()})
+					session.conn.Close()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// send writes resp to the client of session.
+func (session *wsSession) send(resp wsResponse) {
+	data, _ := json.Marshal(resp)
+	err := session.conn.WriteMessage(data)
+	if err != nil {
+		slog.Info("Unable to write to websocket", "error", err)
+	}
+}
+
+// subscriptionPath returns the key under which subscribers of path are notified:
+// databases and collections end in a slash and documents do not.
+func subscriptionPath(path string) string {
+	if !strings.HasPrefix(path, "/v1/") {
+		return path
+	}
+	trimmed := strings.TrimSuffix(path, "/")
+	if len(strings.Split(relativePath(trimmed+"/"), "/"))%2 == 1 {
+		return trimmed + "/"
+	}
+	return trimmed
+}
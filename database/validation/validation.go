@@ -2,9 +2,11 @@
 package validation
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 
 	"github.com/santhosh-tekuri/jsonschema/v5"
@@ -13,6 +15,7 @@ import (
 // Validator represents a JSON schema validator.
 type Validator struct {
 	schema *jsonschema.Schema
+	source []byte // nil if the schema was compiled from a file
 }
 
 // NewValidator creates a new Validator instance based on the provided JSON schema.
@@ -30,6 +33,35 @@ func NewValidator(schema string) (Validator, error) {
 	return Validator{schema: jsonschema}, nil
 }
 
+// schemaURL is the URL under which schemas given as bytes are compiled.
+const schemaURL = "schema.json"
+
+// NewValidatorFromBytes creates a new Validator instance from the JSON schema in schema,
+// which is kept so that Source can return it. References to other documents are not loaded,
+// since the schema may come from a client.
+// Returns an error if the provided schema is invalid.
+func NewValidatorFromBytes(schema []byte) (Validator, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("unable to load %s: references to other schemas are not supported", url)
+	}
+	err := compiler.AddResource(schemaURL, bytes.NewReader(schema))
+	if err != nil {
+		return Validator{}, err
+	}
+	compiled, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return Validator{}, err
+	}
+	return Validator{schema: compiled, source: bytes.Clone(schema)}, nil
+}
+
+// Source returns the JSON schema a Validator created by NewValidatorFromBytes was compiled from,
+// or nil for a Validator created by NewValidator.
+func (v Validator) Source() []byte {
+	return v.source
+}
+
 // ValidateSchema validates the provided JSON data against the schema.
 // Returns true if the data conforms to the schema, false otherwise.
 func (v Validator) ValidateSchema(jsondata []byte) bool {
@@ -77,3 +77,25 @@ func TestInvalidSchema(t *testing.T) {
 		t.Error("Invalid schema was validated!")
 	}
 }
+
+// TestNewValidatorFromBytes tests compiling a schema given as bytes, which is returned by Source,
+// and that invalid schemas and references to other schemas are rejected.
+func TestNewValidatorFromBytes(t *testing.T) {
+	schema := []byte(`{"type": "object", "required": ["name"]}`)
+	val, err := NewValidatorFromBytes(schema)
+	if err != nil {
+		t.Fatalf("Schema is invalid: %v", err)
+	}
+	if !val.ValidateSchema([]byte(`{"name": "myName"}`)) || val.ValidateSchema([]byte(`{"age": 21}`)) {
+		t.Error("Schema given as bytes validated incorrectly")
+	}
+	if string(val.Source()) != string(schema) {
+		t.Errorf("Expected the source of the schema, got %s", val.Source())
+	}
+	if _, err := NewValidatorFromBytes([]byte(`{"type": 5}`)); err == nil {
+		t.Error("Invalid schema was validated!")
+	}
+	if _, err := NewValidatorFromBytes([]byte(`{"$ref": "http://localhost/schema.json"}`)); err == nil {
+		t.Error("Expected references to other schemas to be rejected")
+	}
+}
@@ -0,0 +1,410 @@
+// Package wal implements the write-ahead log that makes the database durable.
+//
+// Every change applied to the in-memory tree is appended to the log as a Record
+// holding the resulting state of the changed node, so replaying the records in
+// order rebuilds the tree after a restart.
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/acl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+)
+
+// Operations stored in a Record.
+const (
+	OpPut    = "put"    // create or overwrite a database, collection or document
+	OpPatch  = "patch"  // replace a document's content, keeping its nested collections
+	OpDelete = "delete" // remove a database, collection or document
+
+	OpIndex     = "index"     // declare a secondary index on a collection
+	OpDropIndex = "dropindex" // remove a secondary index from a collection
+	OpACL       = "acl"       // replace or, if ACL is nil, remove the access control list of a collection
+	OpSchema    = "schema"    // replace or, if Schema is empty, remove the JSON schema of a collection
+
+	OpTxn = "txn" // apply the records in Ops together
+)
+
+// segmentExt is the file extension of log segments.
+const segmentExt = ".wal"
+
+// BatchInterval is how often the log is synced to disk under SyncBatch.
+const BatchInterval = 100 * time.Millisecond
+
+// SyncPolicy determines when appended records are forced to stable storage.
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = iota // fsync after every append
+	SyncBatch                    // fsync every BatchInterval
+	SyncNever                    // leave flushing to the operating system
+)
+
+// Record is a single change in the log.
+// Path is the slash separated path below /v1/, such as "db/doc/col".
+// Doc and Meta are only set for document puts and patches,
+// Field, the indexed JSON pointer, only for index operations,
+// ACL only for access control list operations, Schema only for schema operations,
+// and Ops, which have no sequence numbers, only for transactions.
+type Record struct {
+	Seq    uint64             `json:"seq"`
+	Op     string             `json:"op"`
+	Path   string             `json:"path"`
+	Doc    json.RawMessage    `json:"doc,omitempty"`
+	Meta   *document.Metadata `json:"meta,omitempty"`
+	Field  string             `json:"field,omitempty"`
+	ACL    *acl.ACL           `json:"acl,omitempty"`
+	Schema json.RawMessage    `json:"schema,omitempty"`
+	Ops    []Record           `json:"ops,omitempty"`
+}
+
+// Log is an append-only sequence of records stored in a directory.
+type Log struct {
+	mu     sync.Mutex
+	dir    string
+	file   *os.File
+	writer *bufio.Writer
+	seq    uint64
+	policy SyncPolicy
+	dirty  bool
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// ParseSyncPolicy converts the -sync flag value (always, batch or never) into a SyncPolicy.
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch policy {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q: must be always, batch or never", policy)
+}
+
+// Open opens the log stored in dir, creating the directory if needed.
+// A torn record at the end of the log, left behind by a crash, is discarded.
+func Open(dir string, policy SyncPolicy) (*Log, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, policy: policy, done: make(chan struct{})}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		err = l.scan(segment, last, func(rec Record) error {
+			l.seq = rec.Seq
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var name string
+	if len(segments) == 0 {
+		name = segmentName(l.seq + 1)
+	} else {
+		name = segments[len(segments)-1]
+		// A freshly rotated segment is empty, so its name carries the sequence number
+		first, err := segmentSeq(name)
+		if err != nil {
+			return nil, err
+		}
+		if first > l.seq+1 {
+			l.seq = first - 1
+		}
+	}
+	l.file, err = os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.writer = bufio.NewWriter(l.file)
+
+	if policy == SyncBatch {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// Replay calls apply on every record with a sequence number greater than after, in order.
+// Replay stops at the first error returned by apply.
+func (l *Log) Replay(after uint64, apply func(Record) error) error {
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		err = l.scan(segment, false, func(rec Record) error {
+			if rec.Seq <= after {
+				return nil
+			}
+			return apply(rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append assigns the next sequence number to rec and writes it to the log,
+// syncing it according to the log's policy. Returns the assigned sequence number.
+// If the record cannot be written or synced, it is removed from the log again,
+// so that it is not replayed, and its sequence number is not used.
+func (l *Log) Append(rec Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errors.New("write-ahead log is closed")
+	}
+
+	rec.Seq = l.seq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	// Earlier records are written first, so that a failure only removes this one
+	err = l.writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+	info, err := l.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	_, err = l.writer.Write(line)
+	if err == nil {
+		switch l.policy {
+		case SyncAlways:
+			err = l.sync()
+		case SyncBatch:
+			l.dirty = true
+		case SyncNever:
+			err = l.writer.Flush()
+		}
+	}
+	if err != nil {
+		l.discard(info.Size())
+		return 0, err
+	}
+	l.seq = rec.Seq
+	return rec.Seq, nil
+}
+
+// discard removes everything after offset from the current segment, including what is
+// still buffered, after an append failed. The caller must hold l.mu.
+func (l *Log) discard(offset int64) {
+	l.writer.Reset(l.file)
+	// The segment is truncated by name, since its file may be what failed
+	err := os.Truncate(l.file.Name(), offset)
+	if err != nil {
+		slog.Error("Unable to remove a failed record from the write-ahead log", "error", err)
+	}
+}
+
+// Seq returns the sequence number of the last record in the log.
+func (l *Log) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Sync flushes buffered records and forces them to stable storage.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.sync()
+}
+
+// Rotate syncs and closes the current segment and starts a new one.
+// Returns the sequence number of the last record in the closed segment.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errors.New("write-ahead log is closed")
+	}
+	err := l.sync()
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.seq+1)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	l.file.Close()
+	l.file = file
+	l.writer = bufio.NewWriter(file)
+	return l.seq, nil
+}
+
+// Truncate deletes every segment that only holds records with sequence numbers up to seq.
+// The current segment is never deleted.
+func (l *Log) Truncate(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segments); i++ {
+		// A segment ends right before the next one starts
+		next, err := segmentSeq(segments[i+1])
+		if err != nil {
+			return err
+		}
+		if next-1 > seq {
+			break
+		}
+		err = os.Remove(filepath.Join(l.dir, segments[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the log. Appending to a closed log fails.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	err := l.sync()
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.done)
+	l.wg.Wait()
+
+	closeErr := l.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sync flushes the buffer and fsyncs the current segment. The caller must hold l.mu.
+func (l *Log) sync() error {
+	err := l.writer.Flush()
+	if err != nil {
+		return err
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// syncLoop periodically syncs the log until it is closed. Used by SyncBatch.
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty && !l.closed {
+				err := l.sync()
+				if err != nil {
+					slog.Error("Failed to sync write-ahead log", "error", err)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// segments returns the names of the log segments in dir, oldest first.
+func (l *Log) segments() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentExt) {
+			segments = append(segments, entry.Name())
+		}
+	}
+	// Names are zero padded, so lexical order is sequence order
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// scan reads every record in the named segment and passes it to fn.
+// If repair is true, a torn or corrupt tail is truncated instead of reported as an error.
+func (l *Log) scan(name string, repair bool, fn func(Record) error) error {
+	path := filepath.Join(l.dir, name)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		var rec Record
+		if err == nil {
+			err = json.Unmarshal(line, &rec)
+		} else if err == io.EOF {
+			err = errors.New("record is missing its terminating newline")
+		}
+		if err != nil {
+			if !repair {
+				return fmt.Errorf("corrupt record in %s at offset %d: %w", name, offset, err)
+			}
+			slog.Warn("Discarding torn write-ahead log tail", "segment", name, "offset", offset)
+			return os.Truncate(path, offset)
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// segmentName returns the file name of a segment whose first record is seq.
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+// segmentSeq returns the sequence number of the first record of the named segment.
+func segmentSeq(name string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+}
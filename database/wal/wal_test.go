@@ -0,0 +1,186 @@
+// Test cases for wal.
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group06/document"
+)
+
+// readAll replays log from the beginning and returns every record.
+func readAll(t *testing.T, log *Log) []Record {
+	records := make([]Record, 0)
+	err := log.Replay(0, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error replaying log: %v", err)
+	}
+	return records
+}
+
+// Tests that appended records are replayed in order after the log is reopened.
+func TestAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatch, SyncNever} {
+		log, err := Open(filepath.Join(dir, strconv.Itoa(int(policy))), policy)
+		if err != nil {
+			t.Fatalf("unexpected error opening log: %v", err)
+		}
+		log.Append(Record{Op: OpPut, Path: "db"})
+		log.Append(Record{Op: OpPut, Path: "db/doc", Doc: []byte(`{"a":1}`), Meta: &document.Metadata{CreatedBy: "user1"}})
+		log.Append(Record{Op: OpDelete, Path: "db/doc"})
+		log.Close()
+
+		log, err = Open(log.dir, policy)
+		if err != nil {
+			t.Fatalf("unexpected error reopening log: %v", err)
+		}
+		records := readAll(t, log)
+		if len(records) != 3 {
+			t.Fatalf("expected 3 records, got %d", len(records))
+		}
+		if records[1].Seq != 2 || records[1].Path != "db/doc" || records[1].Meta.CreatedBy != "user1" {
+			t.Errorf("unexpected second record %+v", records[1])
+		}
+		seq, _ := log.Append(Record{Op: OpPut, Path: "db2"})
+		if seq != 4 {
+			t.Errorf("expected sequence 4 after reopening, got %d", seq)
+		}
+		log.Close()
+	}
+}
+
+// Tests that Replay skips records at or before the given sequence number.
+func TestReplayAfter(t *testing.T) {
+	log, _ := Open(t.TempDir(), SyncNever)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		log.Append(Record{Op: OpPut, Path: "db"})
+	}
+	count := 0
+	log.Replay(3, func(rec Record) error {
+		count++
+		return nil
+	})
+	if count != 2 {
+		t.Errorf("expected 2 records after sequence 3, got %d", count)
+	}
+}
+
+// Tests that a torn record at the end of the log is discarded on open.
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	log, _ := Open(dir, SyncAlways)
+	log.Append(Record{Op: OpPut, Path: "db"})
+	log.Close()
+
+	segment := filepath.Join(dir, segmentName(1))
+	file, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte(`{"seq":2,"op":"pu`))
+	file.Close()
+
+	log, err := Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatalf("unexpected error opening log with torn tail: %v", err)
+	}
+	defer log.Close()
+	if len(readAll(t, log)) != 1 {
+		t.Error("expected the torn record to be discarded")
+	}
+	seq, _ := log.Append(Record{Op: OpPut, Path: "db2"})
+	if seq != 2 {
+		t.Errorf("expected sequence 2 after repair, got %d", seq)
+	}
+}
+
+// Tests parsing of the -sync flag.
+func TestParseSyncPolicy(t *testing.T) {
+	policy, err := ParseSyncPolicy("batch")
+	if err != nil || policy != SyncBatch {
+		t.Errorf("expected SyncBatch, got %v, %v", policy, err)
+	}
+	_, err = ParseSyncPolicy("sometimes")
+	if err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// Tests that appending to a closed log fails.
+func TestAppendClosed(t *testing.T) {
+	log, _ := Open(t.TempDir(), SyncAlways)
+	log.Close()
+	_, err := log.Append(Record{Op: OpPut, Path: "db"})
+	if err == nil {
+		t.Error("expected an error appending to a closed log")
+	}
+}
+
+// failingWriter writes half of each write to file and then fails, like a full disk.
+type failingWriter struct {
+	file *os.File
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	n, _ := w.file.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+// Tests that a failed append leaves no partial record and does not use up its sequence number.
+func TestAppendFailure(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncNever} {
+		log, _ := Open(t.TempDir(), policy)
+		log.Append(Record{Op: OpPut, Path: "db"})
+		log.writer = bufio.NewWriter(failingWriter{log.file})
+		_, err := log.Append(Record{Op: OpPut, Path: "db/failed"})
+		if err == nil {
+			t.Fatal("expected an error when the write fails")
+		}
+		seq, err := log.Append(Record{Op: OpPut, Path: "db/doc"})
+		if err != nil || seq != 2 {
+			t.Errorf("expected sequence 2 after a failed append, got %d (%v)", seq, err)
+		}
+		log.Close()
+
+		log, _ = Open(log.dir, policy)
+		records := readAll(t, log)
+		if len(records) != 2 || records[1].Path != "db/doc" || records[1].Seq != 2 {
+			t.Errorf("unexpected records after a failed append %+v", records)
+		}
+		log.Close()
+	}
+}
+
+// Tests that rotated segments are truncated and that sequence numbers continue after reopening.
+func TestRotateTruncate(t *testing.T) {
+	dir := t.TempDir()
+	log, _ := Open(dir, SyncAlways)
+	log.Append(Record{Op: OpPut, Path: "db"})
+	log.Append(Record{Op: OpPut, Path: "db2"})
+	seq, err := log.Rotate()
+	if err != nil || seq != 2 {
+		t.Fatalf("expected rotation after 2, got %d, %v", seq, err)
+	}
+	err = log.Truncate(seq)
+	if err != nil {
+		t.Fatalf("unexpected error truncating log: %v", err)
+	}
+	segments, _ := log.segments()
+	if len(segments) != 1 || segments[0] != segmentName(3) {
+		t.Errorf("expected only the new segment to remain, got %v", segments)
+	}
+	log.Close()
+
+	log, _ = Open(dir, SyncAlways)
+	defer log.Close()
+	seq, _ = log.Append(Record{Op: OpPut, Path: "db3"})
+	if seq != 3 {
+		t.Errorf("expected sequence 3 after reopening an empty segment, got %d", seq)
+	}
+}
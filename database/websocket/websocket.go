@@ -0,0 +1,329 @@
+// Package websocket implements the WebSocket protocol of RFC 6455, as needed to exchange
+// text messages over a single connection: the opening handshake on both sides, framing with
+// fragmented messages, ping and pong, and the closing handshake. Extensions and subprotocols
+// are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize is the largest message ReadMessage accepts.
+const MaxMessageSize = 1 << 20
+
+// Frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes.
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+)
+
+// ErrBadHandshake is returned by Upgrade for requests that are not valid WebSocket handshakes.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Conn is a WebSocket connection. ReadMessage must not be called concurrently, but
+// WriteMessage and Close may be called from any goroutine.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // clients mask the frames they send
+
+	wmu    sync.Mutex
+	closed bool // whether a close frame was sent
+}
+
+// Upgrade completes the opening handshake of r and takes over its connection.
+// On error nothing has been written to w, so the caller can still respond.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if r.Method != http.MethodGet || !hasToken(r.Header, "Connection", "upgrade") ||
+		!hasToken(r.Header, "Upgrade", "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		err != nil || len(decoded) != 16 {
+		return nil, ErrBadHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: connection cannot be taken over")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Dial opens a client connection to rawURL, whose scheme is ws or http, sending header
+// with the handshake.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "http" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: http.Header{}}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: status %d", ErrBadHandshake, resp.StatusCode)
+	}
+	return &Conn{conn: conn, reader: reader, client: true}, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and closes meanwhile.
+// Returns io.EOF once the peer has closed the connection.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			err = c.writeFrame(true, opPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// Echo the status code to complete the closing handshake
+			code := make([]byte, 0, 2)
+			if len(payload) >= 2 {
+				code = payload[:2]
+			}
+			c.writeFrame(true, opClose, code)
+			return nil, io.EOF
+		case opText, opBinary:
+			if fragmented {
+				return nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			message = payload
+		case opContinuation:
+			if !fragmented {
+				return nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+			if len(message)+len(payload) > MaxMessageSize {
+				return nil, c.fail(CloseTooLarge, "message too large")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// WriteMessage sends data as a single text message.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(true, opText, data)
+}
+
+// Close sends a normal close frame, if none was sent yet, and closes the connection.
+func (c *Conn) Close() error {
+	c.writeFrame(true, opClose, closePayload(CloseNormal, ""))
+	return c.conn.Close()
+}
+
+// SetReadDeadline sets the time after which ReadMessage fails, or none if t is zero.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// fail sends a close frame with code and reason and returns an error with reason.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeFrame(true, opClose, closePayload(code, reason))
+	return errors.New("websocket: " + reason)
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	// Clients must mask their frames and servers must not
+	if masked == c.client {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid masking")
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > MaxMessageSize {
+		return false, 0, nil, c.fail(CloseTooLarge, "message too large")
+	}
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(c.reader, mask[:])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends payload in a frame that ends its message if fin is set, masking it if
+// c is a client. Nothing is sent after a close frame.
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return errors.New("websocket: connection closed")
+	}
+	if opcode == opClose {
+		c.closed = true
+	}
+
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame[1] = byte(length)
+	case length <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if c.client {
+		frame[1] |= 0x80
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value for the client's key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// closePayload returns the payload of a close frame with code and reason.
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// hasToken reports whether the comma-separated header name contains token, ignoring case.
+func hasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Test cases for websocket.
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer starts a server that echoes every message back.
+func echoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msg)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestAcceptKey checks the accept key against the example in RFC 6455 section 1.3.
+func TestAcceptKey(t *testing.T) {
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Expected s3pPLMBiTxaQ9kYGzzhZRbK+xOo=, got %s", key)
+	}
+}
+
+// TestEcho checks that messages of every length encoding round trip.
+func TestEcho(t *testing.T) {
+	server := echoServer(t)
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	for _, size := range []int{0, 5, 125, 126, 0xffff, 0x10000} {
+		msg := strings.Repeat("a", size)
+		err = conn.WriteMessage([]byte(msg))
+		if err != nil {
+			t.Fatalf("Write of %d bytes failed: %v", size, err)
+		}
+		reply, err := conn.ReadMessage()
+		if err != nil || string(reply) != msg {
+			t.Errorf("Expected echo of %d bytes, got %d bytes and %v", size, len(reply), err)
+		}
+	}
+}
+
+// TestFragmentsAndPing checks that fragmented messages are joined and pings answered in between.
+func TestFragmentsAndPing(t *testing.T) {
+	server := echoServer(t)
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	// Send the fragments as separate frames, with a ping between them
+	conn.writeFrame(false, opText, []byte("hello "))
+	conn.writeFrame(true, opPing, []byte("p"))
+	conn.writeFrame(true, opContinuation, []byte("world"))
+
+	fin, opcode, payload, err := conn.readFrame()
+	if err != nil || !fin || opcode != opPong || string(payload) != "p" {
+		t.Errorf("Expected pong, got opcode %d %q %v", opcode, payload, err)
+	}
+	reply, err := conn.ReadMessage()
+	if err != nil || string(reply) != "hello world" {
+		t.Errorf("Expected joined message, got %q %v", reply, err)
+	}
+}
+
+// TestClose checks the closing handshake.
+func TestClose(t *testing.T) {
+	server := echoServer(t)
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.writeFrame(true, opClose, closePayload(CloseNormal, ""))
+	fin, opcode, payload, err := conn.readFrame()
+	if err != nil || !fin || opcode != opClose || string(payload) != string(closePayload(CloseNormal, "")) {
+		t.Errorf("Expected close echoing the status, got opcode %d %q %v", opcode, payload, err)
+	}
+	if err = conn.WriteMessage([]byte("late")); err == nil {
+		t.Errorf("Expected no writes after close")
+	}
+	conn.conn.Close()
+}
+
+// TestUnmaskedClientFrame checks that the server rejects unmasked frames from clients.
+func TestUnmaskedClientFrame(t *testing.T) {
+	server := echoServer(t)
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.conn.Close()
+	conn.client = false
+	conn.WriteMessage([]byte("unmasked"))
+	conn.client = true
+	_, err = conn.ReadMessage()
+	if err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
+
+// TestBadHandshake checks that plain requests are not upgraded.
+func TestBadHandshake(t *testing.T) {
+	server := echoServer(t)
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", resp.StatusCode)
+	}
+
+	conn, _ := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.Contains(line, "400") {
+		t.Errorf("Expected 400 for an unsupported version, got %q", line)
+	}
+}